@@ -3,6 +3,7 @@ package caddy_test
 import (
 	"fmt"
 	"reflector/caddy"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,14 +36,117 @@ func TestCaddyVersion(t *testing.T) {
 
 func TestCaddyJSON(t *testing.T) {
 	cj := caddy.NewCaddyJSON([]string{":8443"})
-	cj.AddProxyLocation("example.com", "/", "localhost:8080")
+	cj.AddProxyLocation("example.com", "", 443, "/", "localhost:8080")
 	jsn := cj.Marshal()
 	fmt.Print(string(jsn))
 }
 
+func TestCaddyJSONGRPCProxyLocation(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.AddGRPCProxyLocation("example.com", "", 443, "/svc/*", "127.0.0.1:8080")
+	jsn := string(cj.Marshal())
+	fmt.Print(jsn)
+	if !strings.Contains(jsn, `"transport":{"protocol":"http","versions":["h2c"]}`) {
+		t.Fatalf("grpc proxy location should use an h2c transport")
+	}
+}
+
+func TestCaddyJSONProxyLocationBeforeStatic(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.AddProxyLocation("example.com", "", 443, "/xhttp*", "127.0.0.1:8080")
+	cj.AddRootStaticLocation("example.com", "", 443, "/srv/camo")
+	cj.AddProxyLocation("example.com", "", 443, "/sub/*", "127.0.0.1:8081")
+	jsn := string(cj.Marshal())
+	sub := strings.Index(jsn, `"/sub/*"`)
+	static := strings.Index(jsn, `"file_server"`)
+	if sub < 0 || static < 0 || sub > static {
+		t.Fatalf("proxy locations should come before the static root: %s", jsn)
+	}
+}
+
+func TestCaddyJSONRootProxyLocation(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.AddRootProxyLocation("example.com", "", 443, "127.0.0.1:8081", []string{"Alt-Svc"})
+	cj.AddProxyLocation("example.com", "", 443, "/xhttp*", "127.0.0.1:8080")
+	jsn := string(cj.Marshal())
+	xhttp := strings.Index(jsn, `"/xhttp*"`)
+	mirror := strings.Index(jsn, `"127.0.0.1:8081"`)
+	if xhttp < 0 || mirror < 0 || xhttp > mirror {
+		t.Fatalf("proxy locations should come before the root proxy: %s", jsn)
+	}
+	if !strings.Contains(jsn, `"hide":["Alt-Svc"]`) {
+		t.Fatalf("root proxy should hide upstream headers: %s", jsn)
+	}
+}
+
+func TestCaddyJSONStaticCamoOptions(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.SetResponseHeaders("example.com", "", 443, map[string]string{"Server": "nginx"}, []string{"X-Powered-By"})
+	cj.AddTryFiles("example.com", "", 443, "/srv/camo", []string{"{path}", "/index.html"})
+	cj.AddRootStaticLocation("example.com", "", 443, "/srv/camo")
+	cj.AddErrorPages("example.com", "", 443, "/srv/camo", map[int]string{404: "404.html"})
+	cj.AddProxyLocation("example.com", "", 443, "/xhttp*", "127.0.0.1:8080")
+	jsn := string(cj.Marshal())
+	headers := strings.Index(jsn, `"handler":"headers"`)
+	xhttp := strings.Index(jsn, `"/xhttp*"`)
+	tryFiles := strings.Index(jsn, `"try_files":["{http.request.uri.path}","/index.html"]`)
+	fileServer := strings.Index(jsn, `"handler":"file_server"`)
+	if headers < 0 || xhttp < 0 || tryFiles < 0 || fileServer < 0 ||
+		headers > xhttp || xhttp > tryFiles || tryFiles > fileServer {
+		t.Fatalf("routes should be headers, proxy, try_files, static: %s", jsn)
+	}
+	if !strings.Contains(jsn, `"set":{"Server":["nginx"]},"delete":["X-Powered-By"],"deferred":true`) {
+		t.Fatalf("header changes should be deferred past caddy's own: %s", jsn)
+	}
+	errors := strings.Index(jsn, `"errors":`)
+	if errors < 0 || !strings.Contains(jsn[errors:], `"handler":"headers"`) ||
+		!strings.Contains(jsn[errors:], `"expression":"{http.error.status_code} == 404"`) ||
+		!strings.Contains(jsn[errors:], `"uri":"/404.html"`) ||
+		!strings.Contains(jsn[errors:], `"status_code":"{http.error.status_code}"`) {
+		t.Fatalf("404s should be answered with the template page and headers: %s", jsn)
+	}
+}
+
+func TestCaddyJSONMatchedProxyLocation(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.AddRootStaticLocation("example.com", "", 443, "/srv/camo")
+	cj.AddMatchedProxyLocation("example.com", "", 443, "/xhttp*", "127.0.0.1:8080", caddy.ProxyMatch{
+		Headers:   map[string]string{"X-Token": "t0k3n"},
+		Cookies:   map[string]string{"sid": "abc", "lang": "en"},
+		Query:     map[string]string{"v": "2"},
+		ClientIPs: []string{"10.0.0.0/8"},
+	})
+	jsn := string(cj.Marshal())
+	expected := `"match":[{"path":["/xhttp*"],` +
+		`"expression":"{http.request.cookie.lang} == \"en\" \u0026\u0026 {http.request.cookie.sid} == \"abc\"",` +
+		`"header":{"X-Token":["t0k3n"]},"query":{"v":["2"]},"client_ip":{"ranges":["10.0.0.0/8"]}}]`
+	if !strings.Contains(jsn, expected) {
+		t.Fatalf("proxy route should require every match: %s", jsn)
+	}
+	if strings.Index(jsn, `"/xhttp*"`) > strings.Index(jsn, `"handler":"file_server"`) {
+		t.Fatalf("requests failing the match should fall through to the decoy: %s", jsn)
+	}
+}
+
+func TestCaddyJSONDecoyProxyLocation(t *testing.T) {
+	cj := caddy.NewCaddyJSON([]string{":8443"})
+	cj.AddRootStaticLocation("example.com", "", 443, "/srv/camo")
+	cj.AddErrorPages("example.com", "", 443, "/srv/camo", map[int]string{404: "/404.html"})
+	cj.AddDecoyProxyLocation("example.com", "", 443, "/sub/*", "127.0.0.1:8081")
+	jsn := string(cj.Marshal())
+	expected := `"handle_response":[{"match":{"status_code":[404]},` +
+		`"routes":[{"handle":[{"handler":"error","status_code":"404"}]}]}]`
+	if !strings.Contains(jsn, expected) {
+		t.Fatalf("upstream 404s should become caddy errors: %s", jsn)
+	}
+	if strings.Index(jsn, `"/sub/*"`) > strings.Index(jsn, `"handler":"file_server"`) {
+		t.Fatalf("subscription route should go before the decoy: %s", jsn)
+	}
+}
+
 func TestCaddy(t *testing.T) {
 	c := caddy.NewPortableCaddy("v2.10.0")
-	c.AddProxyLocation("localhost", "/", "http://localhost:8080")
+	c.AddProxyLocation("localhost", "", 8443, "/", "localhost:8080")
 	c.Start()
 	time.Sleep(10 * time.Second)
 	c.Stop()
@@ -3,7 +3,9 @@ package caddy
 import (
 	"encoding/json"
 	"fmt"
+	"reflector/utils"
 	"slices"
+	"strings"
 )
 
 type caddyJSON struct {
@@ -23,11 +25,18 @@ type caddyJSONAppHTTP struct {
 type caddyJSONAppHTTPServer struct {
 	Listen []string                      `json:"listen,omitempty"`
 	Routes []caddyJSONAppHTTPServerRoute `json:"routes,omitempty"`
+	// h1, h2, h2c, h3, caddy enables h1, h2 and h3 when unset
+	Protocols []string `json:"protocols,omitempty"`
+	// routes of responses a handler failed with, e.g. file_server 404s
+	Errors *caddyJSONAppHTTPServerErrors `json:"errors,omitempty"`
 }
 
-func (cs *caddyJSONAppHTTPServer) findRouteHost(
-	hostname string) (int, bool) {
-	for id, route := range cs.Routes {
+type caddyJSONAppHTTPServerErrors struct {
+	Routes []caddyJSONAppHTTPServerRoute `json:"routes,omitempty"`
+}
+
+func findRouteHost(routes []caddyJSONAppHTTPServerRoute, hostname string) (int, bool) {
+	for id, route := range routes {
 		if _, exists := route.findMatchHost(hostname); exists {
 			return id, true
 		}
@@ -35,46 +44,87 @@ func (cs *caddyJSONAppHTTPServer) findRouteHost(
 	return -1, false
 }
 
-func (cs *caddyJSONAppHTTPServer) ensureRouteToHost(hostname string) int {
-	if cs.Routes == nil {
-		cs.Routes = []caddyJSONAppHTTPServerRoute{}
+func ensureRouteToHost(routes *[]caddyJSONAppHTTPServerRoute, hostname string) int {
+	if *routes == nil {
+		*routes = []caddyJSONAppHTTPServerRoute{}
 	}
-	routeId, exists := cs.findRouteHost(hostname)
+	routeId, exists := findRouteHost(*routes, hostname)
 	if !exists {
-		cs.Routes = append(cs.Routes, caddyJSONAppHTTPServerRoute{
+		*routes = append(*routes, caddyJSONAppHTTPServerRoute{
 			Match: []caddyJSONAppHTTPServerRouteMatch{{
 				Host: []string{hostname},
 			}},
 			Terminal: true,
 		})
-		return len(cs.Routes) - 1
+		return len(*routes) - 1
 	}
 	return routeId
 }
 
+func (cs *caddyJSONAppHTTPServer) hostSubroute(hostname string) *caddyJSONAppHTTPServerRouteHandle {
+	route := &cs.Routes[ensureRouteToHost(&cs.Routes, hostname)]
+	return &route.Handle[route.ensureHandleSubroute()]
+}
+
+func (cs *caddyJSONAppHTTPServer) hostErrorSubroute(hostname string) *caddyJSONAppHTTPServerRouteHandle {
+	if cs.Errors == nil {
+		cs.Errors = &caddyJSONAppHTTPServerErrors{}
+	}
+	route := &cs.Errors.Routes[ensureRouteToHost(&cs.Errors.Routes, hostname)]
+	return &route.Handle[route.ensureHandleSubroute()]
+}
+
+// index of the first route the decoy answers with, path routes go before it
+func decoyRouteIndex(routes []caddyJSONAppHTTPServerRouteHandleRoute) int {
+	insertAt := slices.IndexFunc(routes, func(r caddyJSONAppHTTPServerRouteHandleRoute) bool {
+		return r.isDecoy()
+	})
+	if insertAt < 0 {
+		return len(routes)
+	}
+	return insertAt
+}
+
+// reverse_proxy handler to dial, transport, hide and handle_response can be
+// set on it before adding the route
+func reverseProxyHandle(dial string) caddyJSONAppHTTPServerRouteHandleRouteHandle {
+	return caddyJSONAppHTTPServerRouteHandleRouteHandle{
+		Handler: "reverse_proxy",
+		Upstreams: []caddyJSONAppHTTPServerRouteHandleRouteHandleUpstream{{
+			Dial: dial,
+		}},
+		// xhttp stream modes stall otherwise
+		FlushInterval: -1,
+	}
+}
+
+// caddy defaults to http/1.1 + h2 upstreams when the transport is unset,
+// websocket upgrades are passed through by default.
+// A nil match proxies everything the path routes don't match
 func (cs *caddyJSONAppHTTPServer) addRouteReverseProxy(
-	hostname string, dial string, path string) *caddyJSONAppHTTPServer {
-	route := &cs.Routes[cs.ensureRouteToHost(hostname)]
-	subrouteHandler := &route.Handle[route.ensureHandleSubroute()]
-	subrouteHandler.Routes = append(subrouteHandler.Routes,
-		caddyJSONAppHTTPServerRouteHandleRoute{
-			Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
-				Handler: "reverse_proxy",
-				Upstreams: []caddyJSONAppHTTPServerRouteHandleRouteHandleUpstream{{
-					Dial: dial,
-				}},
-			}},
-			Match: []caddyJSONAppHTTPServerRouteHandleRouteMatch{{
-				Path: []string{path},
-			}},
-		})
+	hostname string,
+	match *caddyJSONAppHTTPServerRouteHandleRouteMatch,
+	proxy caddyJSONAppHTTPServerRouteHandleRouteHandle,
+) *caddyJSONAppHTTPServer {
+	subrouteHandler := cs.hostSubroute(hostname)
+	proxyRoute := caddyJSONAppHTTPServerRouteHandleRoute{
+		Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{proxy},
+	}
+	if match == nil {
+		subrouteHandler.Routes = append(subrouteHandler.Routes, proxyRoute)
+		return cs
+	}
+	proxyRoute.Match = []caddyJSONAppHTTPServerRouteHandleRouteMatch{*match}
+	// path routes go before the decoy, its file_server answers everything
+	// that reaches it
+	subrouteHandler.Routes = slices.Insert(subrouteHandler.Routes,
+		decoyRouteIndex(subrouteHandler.Routes), proxyRoute)
 	return cs
 }
 
 func (cs *caddyJSONAppHTTPServer) addRouteRootStaticLocation(
 	hostname string, directory string) *caddyJSONAppHTTPServer {
-	route := &cs.Routes[cs.ensureRouteToHost(hostname)]
-	subrouteHandler := &route.Handle[route.ensureHandleSubroute()]
+	subrouteHandler := cs.hostSubroute(hostname)
 	subrouteHandler.Routes = append(subrouteHandler.Routes,
 		caddyJSONAppHTTPServerRouteHandleRoute{
 			Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
@@ -87,6 +137,107 @@ func (cs *caddyJSONAppHTTPServer) addRouteRootStaticLocation(
 	return cs
 }
 
+// requests are rewritten to the first of tryFiles that exists in directory,
+// e.g. {path}, /index.html for single page apps
+func (cs *caddyJSONAppHTTPServer) addRouteTryFiles(
+	hostname string, directory string, tryFiles []string) *caddyJSONAppHTTPServer {
+	subrouteHandler := cs.hostSubroute(hostname)
+	expanded := []string{}
+	for _, file := range tryFiles {
+		// the caddyfile shorthands, json only knows the long placeholders
+		expanded = append(expanded, strings.NewReplacer(
+			"{path}", "{http.request.uri.path}",
+			"{query}", "{http.request.uri.query}",
+		).Replace(file))
+	}
+	tryFilesRoute := caddyJSONAppHTTPServerRouteHandleRoute{
+		Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
+			Handler: "rewrite",
+			URI:     "{http.matchers.file.relative}",
+		}},
+		Match: []caddyJSONAppHTTPServerRouteHandleRouteMatch{{
+			File: &caddyJSONAppHTTPServerRouteHandleRouteMatchFile{
+				Root:     directory,
+				TryFiles: expanded,
+			},
+		}},
+	}
+	// right before the static files, after every path route
+	insertAt := slices.IndexFunc(subrouteHandler.Routes, func(r caddyJSONAppHTTPServerRouteHandleRoute) bool {
+		return r.isDecoy() && len(r.Match) == 0
+	})
+	if insertAt < 0 {
+		insertAt = len(subrouteHandler.Routes)
+	}
+	subrouteHandler.Routes = slices.Insert(subrouteHandler.Routes, insertAt, tryFilesRoute)
+	return cs
+}
+
+// header changes go first, they apply to every response of the host,
+// including error pages
+func (cs *caddyJSONAppHTTPServer) addRouteResponseHeaders(
+	hostname string, set map[string]string, remove []string) *caddyJSONAppHTTPServer {
+	response := &caddyJSONAppHTTPServerRouteHandleRouteHandleResponse{
+		Delete: remove,
+		// caddy sets Server itself, deferred changes are applied after that
+		Deferred: true,
+	}
+	for name, value := range set {
+		if response.Set == nil {
+			response.Set = map[string][]string{}
+		}
+		response.Set[name] = []string{value}
+	}
+	headersRoute := caddyJSONAppHTTPServerRouteHandleRoute{
+		Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
+			Handler:  "headers",
+			Response: response,
+		}},
+	}
+	for _, subrouteHandler := range []*caddyJSONAppHTTPServerRouteHandle{
+		cs.hostSubroute(hostname), cs.hostErrorSubroute(hostname),
+	} {
+		// set again by another inbound of the same camo
+		if len(subrouteHandler.Routes) > 0 && !subrouteHandler.Routes[0].isDecoy() && len(subrouteHandler.Routes[0].Match) == 0 {
+			subrouteHandler.Routes[0] = headersRoute
+			continue
+		}
+		subrouteHandler.Routes = slices.Insert(subrouteHandler.Routes, 0, headersRoute)
+	}
+	return cs
+}
+
+// pages by status code, paths relative to directory, served with the status
+// of the error
+func (cs *caddyJSONAppHTTPServer) addRouteErrorPages(
+	hostname string, directory string, pages map[int]string) *caddyJSONAppHTTPServer {
+	subrouteHandler := cs.hostErrorSubroute(hostname)
+	codes := []int{}
+	for code := range pages {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		subrouteHandler.Routes = append(subrouteHandler.Routes,
+			caddyJSONAppHTTPServerRouteHandleRoute{
+				Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
+					Handler: "vars",
+					Root:    directory,
+				}, {
+					Handler: "rewrite",
+					URI:     "/" + strings.TrimPrefix(pages[code], "/"),
+				}, {
+					Handler:    "file_server",
+					StatusCode: "{http.error.status_code}",
+				}},
+				Match: []caddyJSONAppHTTPServerRouteHandleRouteMatch{{
+					Expression: fmt.Sprintf("{http.error.status_code} == %d", code),
+				}},
+			})
+	}
+	return cs
+}
+
 type caddyJSONAppHTTPServerRoute struct {
 	Match    []caddyJSONAppHTTPServerRouteMatch  `json:"match,omitempty"`
 	Handle   []caddyJSONAppHTTPServerRouteHandle `json:"handle,omitempty"`
@@ -136,19 +287,118 @@ type caddyJSONAppHTTPServerRouteHandleRoute struct {
 	Match  []caddyJSONAppHTTPServerRouteHandleRouteMatch  `json:"match,omitempty"`
 }
 
+// routes that answer with the decoy, catch-alls and try_files, header
+// changes only pass requests on
+func (r caddyJSONAppHTTPServerRouteHandleRoute) isDecoy() bool {
+	if len(r.Match) > 0 {
+		return r.Match[0].File != nil
+	}
+	return len(r.Handle) == 0 || r.Handle[0].Handler != "headers"
+}
+
 type caddyJSONAppHTTPServerRouteHandleRouteHandle struct {
 	Handler   string                                                 `json:"handler,omitempty"`
 	Root      string                                                 `json:"root,omitempty"`
 	Upstreams []caddyJSONAppHTTPServerRouteHandleRouteHandleUpstream `json:"upstreams,omitempty"`
 	Hide      []string                                               `json:"hide,omitempty"`
+	Transport *caddyJSONAppHTTPServerRouteHandleRouteHandleTransport `json:"transport,omitempty"`
+	// nanoseconds, -1 flushes immediately
+	FlushInterval int `json:"flush_interval,omitempty"`
+	// rewrite
+	URI string `json:"uri,omitempty"`
+	// file_server, a placeholder to answer error pages with the error status
+	StatusCode string `json:"status_code,omitempty"`
+	// headers
+	Response *caddyJSONAppHTTPServerRouteHandleRouteHandleResponse `json:"response,omitempty"`
+	// reverse_proxy, routes for upstream responses instead of passing them on
+	HandleResponse []caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandler `json:"handle_response,omitempty"`
+}
+
+type caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandler struct {
+	Match  *caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandlerMatch `json:"match,omitempty"`
+	Routes []caddyJSONAppHTTPServerRouteHandleRoute                          `json:"routes,omitempty"`
+}
+
+type caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandlerMatch struct {
+	StatusCode []int `json:"status_code,omitempty"`
+}
+
+type caddyJSONAppHTTPServerRouteHandleRouteHandleResponse struct {
+	Set      map[string][]string `json:"set,omitempty"`
+	Delete   []string            `json:"delete,omitempty"`
+	Deferred bool                `json:"deferred,omitempty"`
 }
 
 type caddyJSONAppHTTPServerRouteHandleRouteHandleUpstream struct {
 	Dial string `json:"dial,omitempty"`
 }
 
+type caddyJSONAppHTTPServerRouteHandleRouteHandleTransport struct {
+	Protocol string   `json:"protocol,omitempty"`
+	Versions []string `json:"versions,omitempty"`
+}
+
 type caddyJSONAppHTTPServerRouteHandleRouteMatch struct {
-	Path []string `json:"path,omitempty"`
+	Path       []string                                             `json:"path,omitempty"`
+	File       *caddyJSONAppHTTPServerRouteHandleRouteMatchFile     `json:"file,omitempty"`
+	Expression string                                               `json:"expression,omitempty"`
+	Header     map[string][]string                                  `json:"header,omitempty"`
+	Query      map[string][]string                                  `json:"query,omitempty"`
+	ClientIP   *caddyJSONAppHTTPServerRouteHandleRouteMatchClientIP `json:"client_ip,omitempty"`
+}
+
+type caddyJSONAppHTTPServerRouteHandleRouteMatchClientIP struct {
+	Ranges []string `json:"ranges,omitempty"`
+}
+
+// Conditions a proxy location requires on top of its path, all of them have
+// to hold, requests failing any fall through to the decoy
+type ProxyMatch struct {
+	Headers map[string]string
+	Cookies map[string]string
+	Query   map[string]string
+	// cidrs or addresses
+	ClientIPs []string
+}
+
+func (pm ProxyMatch) routeMatch(path string) *caddyJSONAppHTTPServerRouteHandleRouteMatch {
+	match := &caddyJSONAppHTTPServerRouteHandleRouteMatch{
+		Path: []string{path},
+	}
+	for name, value := range pm.Headers {
+		if match.Header == nil {
+			match.Header = map[string][]string{}
+		}
+		match.Header[name] = []string{value}
+	}
+	for name, value := range pm.Query {
+		if match.Query == nil {
+			match.Query = map[string][]string{}
+		}
+		match.Query[name] = []string{value}
+	}
+	// caddy has no cookie matcher, its placeholders have the cookies
+	names := []string{}
+	for name := range pm.Cookies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	conditions := []string{}
+	for _, name := range names {
+		conditions = append(conditions, fmt.Sprintf("{http.request.cookie.%s} == %q", name, pm.Cookies[name]))
+	}
+	match.Expression = strings.Join(conditions, " && ")
+	if len(pm.ClientIPs) > 0 {
+		match.ClientIP = &caddyJSONAppHTTPServerRouteHandleRouteMatchClientIP{
+			Ranges: pm.ClientIPs,
+		}
+	}
+	return match
+}
+
+type caddyJSONAppHTTPServerRouteHandleRouteMatchFile struct {
+	Root     string   `json:"root,omitempty"`
+	TryFiles []string `json:"try_files,omitempty"`
 }
 
 func NewCaddyJSON(httpsListen []string) *caddyJSON {
@@ -172,15 +422,86 @@ func (cj *caddyJSON) ensureServer(name string, listen []string) *caddyJSONAppHTT
 			&caddyJSONAppHTTPServer{Listen: listen}
 	}
 	server := cj.Apps.Http.Servers[name]
+	for _, address := range listen {
+		if !slices.Contains(server.Listen, address) {
+			server.Listen = append(server.Listen, address)
+		}
+	}
 	return server
 }
 
-func (cj *caddyJSON) AddProxyLocation(domain string, httpsPort int, url string, proxyTarget string) {
-	cj.ensureServer(domain, []string{fmt.Sprintf(":%d", httpsPort)}).
-		addRouteReverseProxy(domain, proxyTarget, url)
+func (cj *caddyJSON) AddProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteReverseProxy(domain, ProxyMatch{}.routeMatch(url), reverseProxyHandle(proxyTarget))
+}
+
+// 404s of the upstream are answered the way the decoy answers missing files,
+// with the error pages and headers of the host, the upstream's own response
+// never reaches the client
+func (cj *caddyJSON) AddDecoyProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	proxy := reverseProxyHandle(proxyTarget)
+	proxy.HandleResponse = []caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandler{{
+		Match: &caddyJSONAppHTTPServerRouteHandleRouteHandleResponseHandlerMatch{
+			StatusCode: []int{404},
+		},
+		Routes: []caddyJSONAppHTTPServerRouteHandleRoute{{
+			Handle: []caddyJSONAppHTTPServerRouteHandleRouteHandle{{
+				Handler:    "error",
+				StatusCode: "404",
+			}},
+		}},
+	}}
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteReverseProxy(domain, ProxyMatch{}.routeMatch(url), proxy)
+}
+
+func (cj *caddyJSON) AddMatchedProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string, match ProxyMatch) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteReverseProxy(domain, match.routeMatch(url), reverseProxyHandle(proxyTarget))
 }
 
-func (cj *caddyJSON) AddRootStaticLocation(domain string, httpsPort int, staticDir string) {
-	cj.ensureServer(domain, []string{fmt.Sprintf(":%d", httpsPort)}).
+// gRPC upstreams require cleartext http/2
+func (cj *caddyJSON) AddGRPCProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	proxy := reverseProxyHandle(proxyTarget)
+	proxy.Transport = &caddyJSONAppHTTPServerRouteHandleRouteHandleTransport{
+		Protocol: "http",
+		Versions: []string{"h2c"},
+	}
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteReverseProxy(domain, ProxyMatch{}.routeMatch(url), proxy)
+}
+
+func (cj *caddyJSON) AddRootStaticLocation(domain string, listen string, httpsPort int, staticDir string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
 		addRouteRootStaticLocation(domain, staticDir)
 }
+
+// Proxies everything the path locations don't match to proxyTarget, hidden
+// upstream response headers are left out
+func (cj *caddyJSON) AddRootProxyLocation(domain string, listen string, httpsPort int, proxyTarget string, hide []string) {
+	proxy := reverseProxyHandle(proxyTarget)
+	proxy.Hide = hide
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteReverseProxy(domain, nil, proxy)
+}
+
+func (cj *caddyJSON) AddTryFiles(domain string, listen string, httpsPort int, staticDir string, tryFiles []string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteTryFiles(domain, staticDir, tryFiles)
+}
+
+// set replaces headers, remove deletes them, e.g. Server
+func (cj *caddyJSON) SetResponseHeaders(domain string, listen string, httpsPort int, set map[string]string, remove []string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteResponseHeaders(domain, set, remove)
+}
+
+func (cj *caddyJSON) AddErrorPages(domain string, listen string, httpsPort int, staticDir string, pages map[int]string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		addRouteErrorPages(domain, staticDir, pages)
+}
+
+func (cj *caddyJSON) SetProtocols(domain string, listen string, httpsPort int, protocols []string) {
+	cj.ensureServer(domain, []string{utils.ListenAddress(listen, httpsPort)}).
+		Protocols = protocols
+}
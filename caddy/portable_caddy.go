@@ -11,6 +11,7 @@ import (
 	"reflector/log"
 	"reflector/utils"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,6 +23,9 @@ type PortableCaddy struct {
 	binaryLocation string
 	caddyjson      *caddyJSON
 	currentProcess *exec.Cmd
+	processExited  chan struct{}
+	stateLock      sync.Mutex
+	running        bool
 }
 
 func (c *PortableCaddy) caddyVersion() *caddyVersion {
@@ -107,10 +111,40 @@ func (c *PortableCaddy) Start() {
 			Update("error", err).Msg("failed to start:")
 	}
 
-	go forwardCaddyLogs(stdout)
-	go forwardCaddyLogs(stderr)
+	logsForwarded := sync.WaitGroup{}
+	logsForwarded.Add(2)
+	go func() { forwardCaddyLogs(stdout); logsForwarded.Done() }()
+	go func() { forwardCaddyLogs(stderr); logsForwarded.Done() }()
+
+	c.setRunning(true)
+	c.processExited = make(chan struct{})
+	go func(process *exec.Cmd, exited chan struct{}) {
+		// pipes have to be drained before Wait closes them
+		logsForwarded.Wait()
+		err := process.Wait()
+		c.setRunning(false)
+		log.GetDefaultLogger().Info().
+			Update("err", err).
+			Msg("caddy exited")
+		close(exited)
+	}(c.currentProcess, c.processExited)
+}
+
+func (c *PortableCaddy) setRunning(running bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.running = running
+}
 
-	c.currentProcess.Start()
+func (c *PortableCaddy) IsRunning() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.running
+}
+
+// caddy config changes go through its API, the process is never restarted
+func (c *PortableCaddy) Restarts() int {
+	return 0
 }
 
 func (c *PortableCaddy) Reload() {
@@ -132,17 +166,52 @@ func (c *PortableCaddy) Reload() {
 	}
 }
 
-func (c *PortableCaddy) AddRootStaticLocation(domain string, httpsPort int, staticDir string) {
-	c.caddyjson.AddRootStaticLocation(domain, httpsPort, staticDir)
+func (c *PortableCaddy) AddRootStaticLocation(domain string, listen string, httpsPort int, staticDir string) {
+	c.caddyjson.AddRootStaticLocation(domain, listen, httpsPort, staticDir)
+}
+
+func (c *PortableCaddy) AddProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	c.caddyjson.AddProxyLocation(domain, listen, httpsPort, url, proxyTarget)
+}
+
+func (c *PortableCaddy) AddDecoyProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	c.caddyjson.AddDecoyProxyLocation(domain, listen, httpsPort, url, proxyTarget)
 }
 
-func (c *PortableCaddy) AddProxyLocation(domain string, httpsPort int, url string, proxyTarget string) {
-	c.caddyjson.AddProxyLocation(domain, httpsPort, url, proxyTarget)
+func (c *PortableCaddy) AddGRPCProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string) {
+	c.caddyjson.AddGRPCProxyLocation(domain, listen, httpsPort, url, proxyTarget)
+}
+
+func (c *PortableCaddy) AddRootProxyLocation(domain string, listen string, httpsPort int, proxyTarget string, hide []string) {
+	c.caddyjson.AddRootProxyLocation(domain, listen, httpsPort, proxyTarget, hide)
+}
+
+func (c *PortableCaddy) AddMatchedProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string, match ProxyMatch) {
+	c.caddyjson.AddMatchedProxyLocation(domain, listen, httpsPort, url, proxyTarget, match)
+}
+
+func (c *PortableCaddy) AddTryFiles(domain string, listen string, httpsPort int, staticDir string, tryFiles []string) {
+	c.caddyjson.AddTryFiles(domain, listen, httpsPort, staticDir, tryFiles)
+}
+
+func (c *PortableCaddy) SetResponseHeaders(domain string, listen string, httpsPort int, set map[string]string, remove []string) {
+	c.caddyjson.SetResponseHeaders(domain, listen, httpsPort, set, remove)
+}
+
+func (c *PortableCaddy) AddErrorPages(domain string, listen string, httpsPort int, staticDir string, pages map[int]string) {
+	c.caddyjson.AddErrorPages(domain, listen, httpsPort, staticDir, pages)
+}
+
+func (c *PortableCaddy) SetProtocols(domain string, listen string, httpsPort int, protocols []string) {
+	c.caddyjson.SetProtocols(domain, listen, httpsPort, protocols)
 }
 
 func (c *PortableCaddy) Stop() {
+	if c.currentProcess == nil {
+		return
+	}
 	syscall.Kill(c.currentProcess.Process.Pid, syscall.SIGTERM)
-	c.currentProcess.Wait()
+	<-c.processExited
 	// for range 30 {
 	// 	time.Sleep(time.Second)
 	// 	if c.currentProcess.ProcessState.Exited() {
@@ -0,0 +1,189 @@
+package camo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflector/log"
+	"reflector/utils"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata of an unpacked camo, kept next to it as <name>.json
+type CacheEntry struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Digest   string `json:"digest,omitempty"`
+	Subdir   string `json:"subdir,omitempty"`
+	// sha256 of the cosign key the camo was verified with
+	VerifiedKey string    `json:"verified_key,omitempty"`
+	PulledAt    time.Time `json:"pulled_at"`
+	Size        int64     `json:"size"`
+}
+
+func (cc *CamoController) cacheEntryPath(name string) string {
+	return filepath.Join(cc.camoDir, name+".json")
+}
+
+func (cc *CamoController) writeCacheEntry(entry CacheEntry) error {
+	entryBytes, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cc.cacheEntryPath(entry.Name), entryBytes, 0o644)
+}
+
+// metadata of the camo at location, empty for camos unpacked before it was
+// kept
+func (cc *CamoController) cacheEntry(location string) CacheEntry {
+	entry := CacheEntry{}
+	if entryBytes, err := os.ReadFile(cc.cacheEntryPath(filepath.Base(location))); err == nil {
+		json.Unmarshal(entryBytes, &entry)
+	}
+	return entry
+}
+
+// empty without a key
+func verifiedKey(publicKeyPEM []byte) string {
+	if publicKeyPEM == nil {
+		return ""
+	}
+	keyHash := sha256.Sum256(publicKeyPEM)
+	return hex.EncodeToString(keyHash[:])
+}
+
+// Unpacked camos, oldest first, entries from before metadata was kept only
+// have a name and a size
+func (cc *CamoController) CacheEntries() ([]CacheEntry, error) {
+	dirEntries, err := os.ReadDir(cc.camoDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []CacheEntry{}
+	for _, dirEntry := range dirEntries {
+		// .pull- dirs are camos being unpacked
+		if !dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		entry := CacheEntry{Name: dirEntry.Name()}
+		if entryBytes, err := os.ReadFile(cc.cacheEntryPath(entry.Name)); err == nil {
+			if err := json.Unmarshal(entryBytes, &entry); err != nil {
+				log.GetDefaultLogger().Warning().
+					Update("err", err.Error()).
+					Update("name", entry.Name).
+					Msg("unreadable camo metadata")
+			}
+		} else if entry.Size, err = utils.DirSize(filepath.Join(cc.camoDir, entry.Name)); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].PulledAt.Before(entries[j].PulledAt)
+	})
+	return entries, nil
+}
+
+func (cc *CamoController) inUse(entry CacheEntry) bool {
+	for _, template := range cc.keepTemplates {
+		if cc.camoInternalNameFromTemplate(template) == entry.Name {
+			return true
+		}
+	}
+	for _, location := range cc.preparedCamoLocations {
+		if filepath.Base(location) == entry.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *CamoController) removeCacheEntry(entry CacheEntry) error {
+	if err := os.RemoveAll(filepath.Join(cc.camoDir, entry.Name)); err != nil {
+		return err
+	}
+	if err := os.Remove(cc.cacheEntryPath(entry.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Removes every entry that is not unpacked from one of keep, loaded camos
+// are never removed
+func (cc *CamoController) Prune(keep []string) ([]CacheEntry, error) {
+	entries, err := cc.CacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	keepNames := []string{}
+	for _, template := range keep {
+		keepNames = append(keepNames, cc.camoInternalNameFromTemplate(template))
+	}
+	removed := []CacheEntry{}
+	for _, entry := range entries {
+		if slices.Contains(keepNames, entry.Name) || cc.inUse(entry) {
+			continue
+		}
+		if err := cc.removeCacheEntry(entry); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Re-downloads the template regardless of the cache
+func (cc *CamoController) Pull(template string) error {
+	delete(cc.preparedCamoLocations, template)
+	return cc.preLoadCamo(template, PullAlways)
+}
+
+// Removes unused entries oldest first until the cache fits its size limit,
+// call it once every camo is loaded
+func (cc *CamoController) EnforceMaxCacheSize() error {
+	if cc.maxCacheSize == 0 {
+		return nil
+	}
+	entries, err := cc.CacheEntries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	for _, entry := range entries {
+		if total <= cc.maxCacheSize {
+			return nil
+		}
+		if cc.inUse(entry) {
+			continue
+		}
+		if err := cc.removeCacheEntry(entry); err != nil {
+			return err
+		}
+		total -= entry.Size
+		log.GetDefaultLogger().Info().
+			Update("name", entry.Name).
+			Update("template", entry.Template).
+			Update("size", utils.FormatSize(entry.Size)).
+			Msg("pruned camo over the cache size limit")
+	}
+	if total > cc.maxCacheSize {
+		log.GetDefaultLogger().Warning().
+			Update("size", utils.FormatSize(total)).
+			Update("limit", utils.FormatSize(cc.maxCacheSize)).
+			Update("dir", strings.TrimSuffix(cc.camoDir, "/")).
+			Msg("camos in use exceed the cache size limit")
+	}
+	return nil
+}
@@ -1,9 +1,19 @@
 package camo_test
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflector/camo"
 	"reflector/log"
+	"strings"
 	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 )
 
 func dismiss(a any, _ error) any {
@@ -13,6 +23,7 @@ func dismiss(a any, _ error) any {
 func TestCamoController(t *testing.T) {
 	log.SetDefaultLogger(log.NewLogger("camo", log.DEBUG))
 	cc := camo.NewCamoController()
+	cc.SetCamoDir(t.TempDir())
 	templ := "docker://docker.io/z1xs4xg62/camo:example"
 	cc.PreLoadCamo(templ)
 	log.GetDefaultLogger().
@@ -20,3 +31,274 @@ func TestCamoController(t *testing.T) {
 		Update("location", dismiss(cc.CamoLocation(templ))).
 		Msg("camo loaded")
 }
+
+func writeTemplate(t *testing.T, content string) string {
+	t.Helper()
+	template := t.TempDir()
+	if err := os.WriteFile(filepath.Join(template, "index.html"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return template
+}
+
+func TestCamoCache(t *testing.T) {
+	camoDir := t.TempDir()
+	small, large := writeTemplate(t, "small"), writeTemplate(t, strings.Repeat("large", 100))
+
+	cc := camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	if err := cc.PreLoadCamoWithPullPolicy(small, camo.PullNever); err == nil {
+		t.Fatal("never should not pull a missing camo")
+	}
+	if err := cc.PreLoadCamoWithPullPolicy(small, "sometimes"); err == nil {
+		t.Fatal("unknown pull policies should fail")
+	}
+	if err := cc.PreLoadCamoWithPullPolicy(small, camo.PullIfNotPresent); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cc.CacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Template != small || entries[0].Size != 5 || entries[0].PulledAt.IsZero() {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	// a fresh controller, like the one of 'reflector camo'
+	cc = camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	if err := cc.PreLoadCamoWithPullPolicy(small, camo.PullNever); err != nil {
+		t.Fatalf("never should use the cached camo: %v", err)
+	}
+	firstPull := entries[0].PulledAt
+	location, _ := cc.CamoLocation(small)
+	if err := os.WriteFile(filepath.Join(small, "index.html"), []byte("fresh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Pull(small); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := cc.CacheEntries(); !entries[0].PulledAt.After(firstPull) {
+		t.Fatalf("pull should refresh the camo, got %+v", entries)
+	}
+	if content, _ := os.ReadFile(filepath.Join(location, "index.html")); string(content) != "fresh" {
+		t.Fatalf("pull should swap the new camo in, got %q", content)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(camoDir, ".pull-*")); len(leftovers) != 0 {
+		t.Fatalf("pull should clean up after itself, found %v", leftovers)
+	}
+	// a failed pull keeps serving the old camo
+	if err := os.Rename(small, small+"-gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Pull(small); err == nil {
+		t.Fatal("pulling a removed template should fail")
+	}
+	if content, _ := os.ReadFile(filepath.Join(location, "index.html")); string(content) != "fresh" {
+		t.Fatalf("a failed pull should keep the old camo, got %q", content)
+	}
+	if err := os.Rename(small+"-gone", small); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit only fits the large camo, but the config still uses the small one
+	cc = camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	cc.SetMaxCacheSize(502)
+	cc.KeepTemplate(large)
+	cc.KeepTemplate(small)
+	if err := cc.PreLoadCamo(large); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.EnforceMaxCacheSize(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := cc.CacheEntries(); len(entries) != 2 {
+		t.Fatalf("templates of the config should stay, got %+v", entries)
+	}
+	if err := cc.PreLoadCamoWithPullPolicy(small, camo.PullNever); err != nil {
+		t.Fatalf("loading the large camo should not evict the small one: %v", err)
+	}
+
+	// the small one is unused once the config drops it
+	cc = camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	cc.SetMaxCacheSize(502)
+	cc.KeepTemplate(large)
+	if err := cc.EnforceMaxCacheSize(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = cc.CacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Template != large {
+		t.Fatalf("expected only the large camo to stay, got %+v", entries)
+	}
+
+	cc = camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	if removed, err := cc.Prune([]string{large}); err != nil || len(removed) != 0 {
+		t.Fatalf("kept templates should stay, removed %+v, %v", removed, err)
+	}
+	if removed, err := cc.Prune(nil); err != nil || len(removed) != 1 {
+		t.Fatalf("expected the large camo removed, got %+v, %v", removed, err)
+	}
+	if entries, _ := cc.CacheEntries(); len(entries) != 0 {
+		t.Fatalf("expected an empty cache, got %+v", entries)
+	}
+}
+
+func TestCamoPinnedTemplate(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	img, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := strings.TrimPrefix(server.URL, "http://") + "/camo/site"
+	if err := crane.Push(img, repository+":latest"); err != nil {
+		t.Fatal(err)
+	}
+	template := "docker://" + repository + "@" + digest.String()
+
+	cc := camo.NewCamoController()
+	cc.SetCamoDir(t.TempDir())
+	// nothing signed the image
+	cc.SetVerificationKey(template, []byte("-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n"))
+	if err := cc.PreLoadCamo(template); err == nil {
+		t.Fatal("unverified camo was loaded")
+	}
+
+	camoDir := t.TempDir()
+	cc = camo.NewCamoController()
+	cc.SetCamoDir(camoDir)
+	if err := cc.PreLoadCamo(template); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := cc.CacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Digest != digest.String() || !strings.HasPrefix(entries[0].Name, "site") {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	// cached before a key was set, it has to be pulled and verified again
+	for _, pullPolicy := range []string{camo.PullIfNotPresent, camo.PullNever} {
+		cc = camo.NewCamoController()
+		cc.SetCamoDir(camoDir)
+		cc.SetVerificationKey(template, []byte("-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n"))
+		if err := cc.PreLoadCamoWithPullPolicy(template, pullPolicy); err == nil {
+			t.Fatalf("%s: unverified cached camo was loaded", pullPolicy)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	hits := 0
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Errorf("forwarding headers reached the upstream")
+		}
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, `<a href="%s/about">about</a> <img src="//%s/logo.png">`, upstream.URL, r.Host)
+		case "/old":
+			http.Redirect(w, r, upstream.URL+"/new", http.StatusFound)
+		case "/login":
+			w.Header().Set("Set-Cookie", "session=1; Domain="+r.Host+"; Path=/")
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprint(w, "login")
+		case "/lang":
+			w.Header().Set("Vary", "Accept-Language")
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, r.Header.Get("Accept-Language"))
+		}
+	}))
+	defer upstream.Close()
+
+	mirror, err := camo.NewMirror("proxy://" + upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "decoy.example"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		rec := httptest.NewRecorder()
+		mirror.ServeHTTP(rec, req)
+		return rec
+	}
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	index := get("/").Body.String()
+	if strings.Contains(index, host) || !strings.Contains(index, "https://decoy.example/about") || !strings.Contains(index, "//decoy.example/logo.png") {
+		t.Errorf("links were not rewritten: %s", index)
+	}
+	get("/")
+	if hits != 1 {
+		t.Errorf("cacheable page was fetched %d times", hits)
+	}
+	if location := get("/old").Header().Get("Location"); location != "https://decoy.example/new" {
+		t.Errorf("redirect to %s", location)
+	}
+	login := get("/login")
+	get("/login")
+	if cookie := login.Header().Get("Set-Cookie"); strings.Contains(strings.ToLower(cookie), "domain") {
+		t.Errorf("cookie keeps the upstream domain: %s", cookie)
+	}
+	if hits != 4 {
+		t.Errorf("uncacheable pages should always be fetched, %d upstream requests", hits)
+	}
+
+	getLang := func(lang string) string {
+		req := httptest.NewRequest(http.MethodGet, "/lang", nil)
+		req.Host = "decoy.example"
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		mirror.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	if en, de := getLang("en"), getLang("de"); en != "en" || de != "de" {
+		t.Errorf("responses that vary were served from the cache: %q, %q", en, de)
+	}
+	if en := getLang("en"); en != "en" || hits != 6 {
+		t.Errorf("each variant should be cached, got %q after %d upstream requests", en, hits)
+	}
+
+	upstream.Close()
+	failed := get("/down")
+	if failed.Code != http.StatusBadGateway || !strings.HasPrefix(failed.Header().Get("Content-Type"), "text/html") ||
+		failed.Header().Get("X-Content-Type-Options") != "" || !strings.Contains(failed.Body.String(), "<h1>502 Bad Gateway</h1>") {
+		t.Errorf("upstream failures should get an html page, got %d %v %q", failed.Code, failed.Header(), failed.Body.String())
+	}
+
+	for _, template := range []string{"proxy://example.org", "proxy://ftp://example.org"} {
+		if _, err := camo.NewMirror(template); err == nil {
+			t.Errorf("%s should not be accepted", template)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	location := t.TempDir()
+	for _, name := range []string{"404.html", "500.html"} {
+		if err := os.WriteFile(filepath.Join(location, name), []byte("<h1>error</h1>"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages := camo.ErrorPages(location, map[int]string{500: "errors/oops.html", 502: "errors/oops.html"})
+	expected := map[int]string{404: "404.html", 500: "errors/oops.html", 502: "errors/oops.html"}
+	if fmt.Sprint(pages) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, pages)
+	}
+}
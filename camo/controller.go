@@ -4,45 +4,113 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"reflector/log"
 	"reflector/utils"
+	"slices"
 	"strings"
+	"time"
+)
+
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+
+	// file content one template may unpack to
+	DefaultMaxTemplateSize = 1 << 30
+
+	// absolute so the daemon and the cli share it wherever they run from
+	DefaultCamoDir = "/var/cache/reflector/camo/"
 )
 
 type CamoController struct {
 	camoDir               string
 	containerController   *utils.ContainerImageController
 	preparedCamoLocations map[string]string
+	// unused entries are pruned oldest first past it by EnforceMaxCacheSize,
+	// 0 is unlimited
+	maxCacheSize int64
+	// unpacking fails past it, 0 is unlimited
+	maxTemplateSize int64
+	// cosign keys and subdirs by template
+	unpackOptions map[string]utils.UnpackOptions
+	// templates of the config, in use before they are loaded
+	keepTemplates []string
 }
 
 func NewCamoController() *CamoController {
 	return &CamoController{
-		camoDir:               "/tmp/camo/",
+		camoDir:               DefaultCamoDir,
 		containerController:   utils.NewContainerImageController(),
 		preparedCamoLocations: make(map[string]string),
+		maxTemplateSize:       DefaultMaxTemplateSize,
+		unpackOptions:         make(map[string]utils.UnpackOptions),
+	}
+}
+
+func (cc *CamoController) SetCamoDir(dir string) {
+	cc.camoDir = dir
+}
+
+func (cc *CamoController) SetMaxCacheSize(size int64) {
+	cc.maxCacheSize = size
+}
+
+func (cc *CamoController) SetMaxTemplateSize(size int64) {
+	cc.maxTemplateSize = size
+}
+
+// Marks template as in use so the cache size limit never evicts it, the
+// config's camos are loaded one by one and an earlier one must not evict
+// a later one
+func (cc *CamoController) KeepTemplate(template string) {
+	if !slices.Contains(cc.keepTemplates, template) {
+		cc.keepTemplates = append(cc.keepTemplates, template)
 	}
 }
 
+// Requires a cosign signature made by publicKeyPEM whenever template is pulled
+func (cc *CamoController) SetVerificationKey(template string, publicKeyPEM []byte) {
+	options := cc.unpackOptions[template]
+	options.PublicKeyPEM = publicKeyPEM
+	cc.unpackOptions[template] = options
+}
+
+// Only unpacks subdir of the template, e.g. /srv/www of a web server image
+func (cc *CamoController) SetSubdir(template string, subdir string) {
+	options := cc.unpackOptions[template]
+	options.Subdir = subdir
+	cc.unpackOptions[template] = options
+}
+
 // template can be any of
 //   - `oci://docker.io/library/image:example`
+//   - `docker://docker.io/library/image@sha256:...`
+//   - `git+https://example.com/site.git#main:public`
+//   - `file:///site.tar.gz`, `https://example.com/site.zip`
+//   - `generate://blog?seed=...`
 //   - `./image`
 //   - `/image`
 //   - `image`
 func (cc *CamoController) camoInternalNameFromTemplate(template string) string {
-	untaggedName := template
-	if strings.Count(template, ":") > 0 {
-		// >...image< :example
-		spl := strings.Split(template, ":")
-		untaggedName = spl[len(spl)-2]
-	}
+	// >...image:example< @sha256:...
+	untaggedName, _, _ := strings.Cut(template, "@sha256:")
+	// >git+https://host/site.git< #ref:subdir
+	untaggedName, _, _ = strings.Cut(untaggedName, "#")
+	// >generate://blog< ?seed=...
+	untaggedName, _, _ = strings.Cut(untaggedName, "?")
 
 	internalName := untaggedName
 	if strings.Count(untaggedName, "/") > 0 {
-		// ...library/ >image<
+		// ...library/ >image:example<
 		spl := strings.Split(untaggedName, "/")
 		internalName = spl[len(spl)-1]
 	}
+	// >image< :example, registry ports are in the cut off part
+	internalName, _, _ = strings.Cut(internalName, ":")
 
 	// many templates can result in the same name, add the template hash
 	templateHashBytes := sha1.Sum([]byte(template))
@@ -59,18 +127,25 @@ func (cc *CamoController) camoFullPathForTemplate(template string) string {
 
 // Default camo loading, pull policy if not present
 func (cc *CamoController) PreLoadCamo(template string) error {
-	return cc.preLoadCamo(template, false)
+	return cc.preLoadCamo(template, PullIfNotPresent)
 }
 
-// Camo loading with controlled pull policy
-func (cc *CamoController) PreLoadCamoWithPullPolicy(template string, alwaysPull bool) error {
-	return cc.preLoadCamo(template, alwaysPull)
+// Camo loading with controlled pull policy, one of always, if-not-present, never
+func (cc *CamoController) PreLoadCamoWithPullPolicy(template string, pullPolicy string) error {
+	switch pullPolicy {
+	case PullAlways, PullIfNotPresent, PullNever:
+		return cc.preLoadCamo(template, pullPolicy)
+	case "":
+		return cc.preLoadCamo(template, PullIfNotPresent)
+	default:
+		return fmt.Errorf("unknown pull policy: %s", pullPolicy)
+	}
 }
 
-func (cc *CamoController) preLoadCamo(template string, alwaysPull bool) error {
+func (cc *CamoController) preLoadCamo(template string, pullPolicy string) error {
 	if existingLocation, exists := cc.preparedCamoLocations[template]; exists {
 		// already loaded and accounted
-		// ignore alwaysPull, it was respected when the accounting happened
+		// ignore the pull policy, it was respected when the accounting happened
 		log.GetDefaultLogger().
 			Info().
 			Update("template", template).
@@ -79,11 +154,27 @@ func (cc *CamoController) preLoadCamo(template string, alwaysPull bool) error {
 		return nil
 	}
 	camoLocation := cc.camoFullPathForTemplate(template)
+	options := cc.unpackOptions[template]
+	options.MaxSize = cc.maxTemplateSize
 
 	if stat, err := os.Stat(camoLocation); os.IsExist(err) || (stat != nil && stat.IsDir()) {
 		// already downloaded but not accounted
-		// repull if alwaysPull
-		if !alwaysPull {
+		// repull if always, if another subdir was unpacked or if it was not
+		// verified with the current key
+		entry := cc.cacheEntry(camoLocation)
+		keyChanged := entry.VerifiedKey != verifiedKey(options.PublicKeyPEM)
+		if keyChanged && options.PublicKeyPEM != nil && pullPolicy == PullNever {
+			return fmt.Errorf("camo %s was not verified with the cosign key and the pull policy is never", template)
+		}
+		subdirChanged := entry.Subdir != options.Subdir
+		if subdirChanged && pullPolicy == PullNever {
+			log.GetDefaultLogger().
+				Warning().
+				Update("template", template).
+				Update("subdir", options.Subdir).
+				Msg("camo was unpacked with another subdir and the pull policy is never")
+		}
+		if pullPolicy == PullNever || (pullPolicy != PullAlways && !subdirChanged && !keyChanged) {
 			cc.preparedCamoLocations[template] = camoLocation
 			log.GetDefaultLogger().
 				Info().
@@ -94,28 +185,103 @@ func (cc *CamoController) preLoadCamo(template string, alwaysPull bool) error {
 		}
 		log.GetDefaultLogger().
 			Debug().
-			Msg("camo dir already exists, cleaning and redownloading")
-		err := os.RemoveAll(camoLocation)
-		if err != nil {
-			return err
-		}
+			Msg("camo dir already exists, redownloading")
+	} else if pullPolicy == PullNever {
+		return fmt.Errorf("camo %s is not in %s and the pull policy is never", template, cc.camoDir)
 	}
-	err := cc.containerController.UnpackImage(template, camoLocation)
+	if err := os.MkdirAll(cc.camoDir, 0o755); err != nil {
+		return err
+	}
+	// unpacked next to the camo and swapped in once complete, a running caddy
+	// keeps serving the old camo and a partly unpacked camo never passes for
+	// a downloaded one
+	pullDir, err := os.MkdirTemp(cc.camoDir, ".pull-")
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(pullDir)
+	unpackLocation := filepath.Join(pullDir, "camo")
+	digest, err := cc.containerController.UnpackImageWithOptions(template, unpackLocation, options)
+	if err != nil {
+		return err
+	}
+	if err := replaceDir(unpackLocation, camoLocation, filepath.Join(pullDir, "previous")); err != nil {
+		return err
+	}
+	if utils.IsContainerImage(template) && !strings.Contains(template, "@") {
+		log.GetDefaultLogger().
+			Info().
+			Update("template", template).
+			Update("digest", digest).
+			Msg("camo template is a mutable tag, pin it with @digest")
+	}
 	cc.preparedCamoLocations[template] = camoLocation
+	entry := CacheEntry{
+		Name:        filepath.Base(camoLocation),
+		Template:    template,
+		Digest:      digest,
+		Subdir:      options.Subdir,
+		VerifiedKey: verifiedKey(options.PublicKeyPEM),
+		PulledAt:    time.Now().UTC(),
+	}
+	if entry.Size, err = utils.DirSize(camoLocation); err != nil {
+		return err
+	}
+	if err := cc.writeCacheEntry(entry); err != nil {
+		return err
+	}
 	log.GetDefaultLogger().
 		Info().
 		Update("template", template).
 		Update("location", camoLocation).
+		Update("digest", digest).
+		Update("verified", options.PublicKeyPEM != nil).
+		Update("size", utils.FormatSize(entry.Size)).
 		Msg("loaded camo")
 	return nil
 }
 
+// moves dir to location, an existing location is moved to previous first
+// and put back when dir can't be moved
+func replaceDir(dir string, location string, previous string) error {
+	err := os.Rename(location, previous)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	replaced := err == nil
+	if err := os.Rename(dir, location); err != nil {
+		if replaced {
+			os.Rename(previous, location)
+		}
+		return err
+	}
+	return nil
+}
+
 func (cc *CamoController) CamoLocation(template string) (string, error) {
 	if location, exists := cc.preparedCamoLocations[template]; exists {
 		return location, nil
 	}
 	return "", errors.New("this camo was never loaded")
 }
+
+// status codes a template answers with its own page when it has <code>.html
+var DefaultErrorPageCodes = []int{403, 404, 500}
+
+// configured pages, plus <code>.html of the template for codes without one
+func ErrorPages(location string, configured map[int]string) map[int]string {
+	pages := map[int]string{}
+	for code, page := range configured {
+		pages[code] = page
+	}
+	for _, code := range DefaultErrorPageCodes {
+		if _, exists := pages[code]; exists {
+			continue
+		}
+		page := fmt.Sprintf("%d.html", code)
+		if info, err := os.Stat(filepath.Join(location, page)); err == nil && info.Mode().IsRegular() {
+			pages[code] = page
+		}
+	}
+	return pages
+}
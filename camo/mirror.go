@@ -0,0 +1,333 @@
+package camo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ProxyTemplatePrefix = "proxy://"
+
+const (
+	// responses past it are streamed, neither rewritten nor cached
+	mirrorMaxBodySize     = 8 << 20
+	mirrorMaxCacheSize    = 64 << 20
+	mirrorDefaultCacheTTL = 5 * time.Minute
+)
+
+// upstream response headers reflector answers with itself, caddy hides them
+var MirrorHiddenHeaders = []string{"Alt-Svc", "Report-To", "NEL"}
+
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// headers caddy adds that would tell the upstream it is being mirrored
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded", "Via"}
+
+var cookieDomain = regexp.MustCompile(`(?i);\s*domain=[^;]*`)
+
+func IsProxyTemplate(template string) bool {
+	return strings.HasPrefix(template, ProxyTemplatePrefix)
+}
+
+type mirrorCacheEntry struct {
+	// key without the vary headers
+	base    string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// Reverse proxy of the real website of a proxy:// camo. Links to the upstream
+// are rewritten to the host that was asked for and public responses are
+// cached, so the decoy behaves like the site while the certificate is ours.
+// The official caddy release reflector runs can't rewrite response bodies or
+// cache them, replace-response and cache-handler are plugins, so caddy's
+// reverse_proxy only fronts the mirror and the mirror dials the upstream.
+type Mirror struct {
+	upstream  *url.URL
+	transport http.RoundTripper
+	cacheTTL  time.Duration
+
+	cacheLock  sync.Mutex
+	cache      map[string]*mirrorCacheEntry
+	cacheOrder []string
+	cacheSize  int64
+	// request headers the upstream varies the response of a url on
+	varies map[string][]string
+}
+
+// template is proxy://https://example.org
+func NewMirror(template string) (*Mirror, error) {
+	upstream, err := url.Parse(strings.TrimPrefix(template, ProxyTemplatePrefix))
+	if err != nil {
+		return nil, err
+	}
+	if (upstream.Scheme != "https" && upstream.Scheme != "http") || upstream.Host == "" {
+		return nil, fmt.Errorf("%s should be proxy://https://<host>", template)
+	}
+	return &Mirror{
+		upstream: upstream,
+		transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: upstream.Hostname(),
+				MinVersion: tls.VersionTLS12,
+			},
+			ForceAttemptHTTP2:     true,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		cacheTTL: mirrorDefaultCacheTTL,
+		cache:    make(map[string]*mirrorCacheEntry),
+		varies:   make(map[string][]string),
+	}, nil
+}
+
+func (m *Mirror) Upstream() *url.URL {
+	return m.upstream
+}
+
+// links to the upstream become links to host
+func (m *Mirror) linkReplacer(host string) *strings.Replacer {
+	upstreamHost := m.upstream.Host
+	return strings.NewReplacer(
+		"https://"+upstreamHost, "https://"+host,
+		"http://"+upstreamHost, "https://"+host,
+		`https:\/\/`+upstreamHost, `https:\/\/`+host,
+		`http:\/\/`+upstreamHost, `https:\/\/`+host,
+		"//"+upstreamHost, "//"+host,
+	)
+}
+
+func isTextContent(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "javascript") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml")
+}
+
+// how long a response may be cached, 0 if it may not
+func (m *Mirror) cacheDuration(req *http.Request, resp *http.Response) time.Duration {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return 0
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 || resp.Header.Get("Vary") == "*" {
+		return 0
+	}
+	ttl := m.cacheTTL
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age", "s-maxage":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				ttl = min(ttl, time.Duration(seconds)*time.Second)
+			}
+		}
+	}
+	return ttl
+}
+
+// Vary names of resp, Accept-Encoding is left out, the upstream request
+// never carries it
+func varyHeaders(resp *http.Response) []string {
+	names := []string{}
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && name != "Accept-Encoding" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// base plus the values of the vary headers of the request
+func varyKey(base string, names []string, r *http.Request) string {
+	key := base
+	for _, name := range names {
+		key += "\n" + name + ": " + strings.Join(r.Header.Values(name), ", ")
+	}
+	return key
+}
+
+func (m *Mirror) cached(base string, r *http.Request) *mirrorCacheEntry {
+	m.cacheLock.Lock()
+	defer m.cacheLock.Unlock()
+	entry, exists := m.cache[varyKey(base, m.varies[base], r)]
+	if !exists || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (m *Mirror) store(r *http.Request, names []string, entry *mirrorCacheEntry) {
+	m.cacheLock.Lock()
+	defer m.cacheLock.Unlock()
+	m.varies[entry.base] = names
+	key := varyKey(entry.base, names, r)
+	if old, exists := m.cache[key]; exists {
+		m.cacheSize -= int64(len(old.body))
+	} else {
+		m.cacheOrder = append(m.cacheOrder, key)
+	}
+	m.cache[key] = entry
+	m.cacheSize += int64(len(entry.body))
+	// oldest first
+	for m.cacheSize > mirrorMaxCacheSize && len(m.cacheOrder) > 0 {
+		oldest := m.cacheOrder[0]
+		m.cacheOrder = m.cacheOrder[1:]
+		base := m.cache[oldest].base
+		m.cacheSize -= int64(len(m.cache[oldest].body))
+		delete(m.cache, oldest)
+		// other variants of the url are still cached under these names
+		if !slices.ContainsFunc(m.cacheOrder, func(key string) bool { return m.cache[key].base == base }) {
+			delete(m.varies, base)
+		}
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, header http.Header, body []byte) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// failures of the mirror itself, a page like a web server answers with
+// instead of the text/plain body of http.Error
+func writeErrorPage(w http.ResponseWriter, status int) {
+	text := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	body := "<!DOCTYPE html>\n<html>\n<head><title>" + text + "</title></head>\n" +
+		"<body>\n<h1>" + text + "</h1>\n</body>\n</html>\n"
+	writeResponse(w, status, header, []byte(body))
+}
+
+func (m *Mirror) upstreamRequest(r *http.Request) (*http.Request, error) {
+	target := *m.upstream
+	target.Path = r.URL.Path
+	target.RawPath = r.URL.RawPath
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = r.Header.Clone()
+	for _, name := range append(hopByHopHeaders, forwardingHeaders...) {
+		req.Header.Del(name)
+	}
+	// the transport asks for gzip and decodes it, bodies can be rewritten
+	req.Header.Del("Accept-Encoding")
+	ourOrigin := "https://" + r.Host
+	upstreamOrigin := m.upstream.Scheme + "://" + m.upstream.Host
+	for _, name := range []string{"Origin", "Referer"} {
+		if value := req.Header.Get(name); value != "" {
+			req.Header.Set(name, strings.Replace(value, ourOrigin, upstreamOrigin, 1))
+		}
+	}
+	req.Host = m.upstream.Host
+	return req, nil
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := r.Host + r.URL.RequestURI()
+	if r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == "" {
+		if entry := m.cached(base, r); entry != nil {
+			writeResponse(w, entry.status, entry.header, entry.body)
+			return
+		}
+	}
+
+	req, err := m.upstreamRequest(r)
+	if err != nil {
+		writeErrorPage(w, http.StatusBadRequest)
+		return
+	}
+	resp, err := m.transport.RoundTrip(req)
+	if err != nil {
+		writeErrorPage(w, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	replacer := m.linkReplacer(r.Host)
+	header := resp.Header.Clone()
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	for _, name := range []string{"Location", "Content-Location", "Refresh", "Link"} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, replacer.Replace(value))
+		}
+	}
+	cookies := header.Values("Set-Cookie")
+	header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		header.Add("Set-Cookie", cookieDomain.ReplaceAllString(cookie, ""))
+	}
+	if r.Method == http.MethodHead {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, mirrorMaxBodySize+1))
+	if err != nil {
+		writeErrorPage(w, http.StatusBadGateway)
+		return
+	}
+	if len(body) > mirrorMaxBodySize {
+		// too large to hold, passed through as it is
+		header.Del("Content-Length")
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.MultiReader(bytes.NewReader(body), resp.Body))
+		return
+	}
+	if isTextContent(header.Get("Content-Type")) {
+		body = []byte(replacer.Replace(string(body)))
+		// the length of the rewritten body is set when writing
+		header.Del("Content-Length")
+		header.Del("Etag")
+	}
+	if ttl := m.cacheDuration(r, resp); ttl > 0 {
+		m.store(r, varyHeaders(resp), &mirrorCacheEntry{
+			base:    base,
+			status:  resp.StatusCode,
+			header:  header,
+			body:    body,
+			expires: time.Now().Add(ttl),
+		})
+	}
+	writeResponse(w, resp.StatusCode, header, body)
+}
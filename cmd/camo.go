@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"reflector/log"
+	"reflector/utils"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var camoPruneAll *bool
+
+// camoCmd represents the camo command
+var camoCmd = &cobra.Command{
+	Use:   "camo",
+	Short: "Manage unpacked camo templates",
+}
+
+var camoLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List unpacked camo templates",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		cc, err := cf.CamoController()
+		exitOnError(err, "failed to set up the camo cache")
+		templates, err := cf.CamoTemplates()
+		exitOnError(err, "failed to read camos")
+		entries, err := cc.CacheEntries()
+		exitOnError(err, "failed to list the camo cache")
+
+		var total int64
+		fmt.Printf("%-48s %-48s %-20s %-20s %-9s %s\n", "NAME", "TEMPLATE", "DIGEST", "PULLED", "SIZE", "USED")
+		for _, entry := range entries {
+			used := false
+			for _, template := range templates {
+				used = used || template == entry.Template
+			}
+			digest := entry.Digest
+			if len(digest) > 19 {
+				digest = digest[:19]
+			}
+			pulled := ""
+			if !entry.PulledAt.IsZero() {
+				pulled = entry.PulledAt.Local().Format(time.DateTime)
+			}
+			total += entry.Size
+			fmt.Printf("%-48s %-48s %-20s %-20s %-9s %s\n",
+				entry.Name, orDash(entry.Template), orDash(digest), orDash(pulled),
+				utils.FormatSize(entry.Size), yesNo(used))
+		}
+		fmt.Printf("%d entries, %s\n", len(entries), utils.FormatSize(total))
+	},
+}
+
+var camoPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove unpacked templates the config no longer uses",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		cc, err := cf.CamoController()
+		exitOnError(err, "failed to set up the camo cache")
+		keep := []string{}
+		if !*camoPruneAll {
+			templates, err := cf.CamoTemplates()
+			exitOnError(err, "failed to read camos")
+			for _, template := range templates {
+				keep = append(keep, template)
+			}
+		}
+		removed, err := cc.Prune(keep)
+		for _, entry := range removed {
+			log.GetDefaultLogger().Info().
+				Update("name", entry.Name).
+				Update("template", entry.Template).
+				Update("size", utils.FormatSize(entry.Size)).
+				Msg("removed camo")
+		}
+		exitOnError(err, "failed to prune the camo cache")
+	},
+}
+
+var camoPullCmd = &cobra.Command{
+	Use:   "pull [camo...]",
+	Short: "Download camo templates again, all of them by default",
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		cc, err := cf.CamoController()
+		exitOnError(err, "failed to set up the camo cache")
+		templates, err := cf.CamoTemplates()
+		exitOnError(err, "failed to read camos")
+		names := args
+		if len(names) == 0 {
+			for name := range templates {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		// a running reflector may serve any of them
+		for _, template := range templates {
+			cc.KeepTemplate(template)
+		}
+		pulled := []string{}
+		for _, name := range names {
+			template, exists := templates[name]
+			if !exists {
+				exitOnError(fmt.Errorf("undefined camo or no template: %s", name), "failed to pull camo")
+			}
+			// camos can share a template
+			if slices.Contains(pulled, template) {
+				continue
+			}
+			exitOnError(cc.Pull(template), "failed to pull camo")
+			pulled = append(pulled, template)
+		}
+		if len(pulled) == 0 {
+			exitOnError(errors.New("no wtls camos with a template"), "nothing to pull")
+		}
+		exitOnError(cc.EnforceMaxCacheSize(), "failed to enforce the camo cache size limit")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(camoCmd)
+	camoCmd.AddCommand(camoLsCmd)
+	camoCmd.AddCommand(camoPruneCmd)
+	camoCmd.AddCommand(camoPullCmd)
+	camoPruneAll = camoPruneCmd.Flags().Bool("all", false, "Remove every unpacked template")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflector/log"
+	"reflector/xray"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var exportFormat *string
+var exportUser *string
+var exportInbound *string
+var exportOutput *string
+
+var exportFormats = map[string]func([]*xray.XrayLink) ([]byte, error){
+	"singbox":     xray.ExportSingBox,
+	"clash":       xray.ExportClash,
+	"xray-client": xray.ExportXrayClient,
+}
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a client config for a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		export, exists := exportFormats[*exportFormat]
+		if !exists {
+			exitOnError(fmt.Errorf("unknown format %s", *exportFormat), "format should be one of: singbox, clash, xray-client")
+		}
+		if *exportUser == "" {
+			exitOnError(fmt.Errorf("--user is required"), "failed to export")
+		}
+		linksByInbound, err := loadConfigFileOrExit().UserLinks(*exportInbound, *exportUser)
+		exitOnError(err, "failed to build client links")
+		inbounds := []string{}
+		for inb := range linksByInbound {
+			inbounds = append(inbounds, inb)
+		}
+		sort.Strings(inbounds)
+		links := []*xray.XrayLink{}
+		for _, inb := range inbounds {
+			link := linksByInbound[inb]
+			link.LinkName = inb
+			links = append(links, link)
+		}
+
+		config, err := export(links)
+		exitOnError(err, "failed to export")
+		if *exportOutput == "" {
+			os.Stdout.Write(config)
+			return
+		}
+		exitOnError(os.WriteFile(*exportOutput, config, 0o600), "failed to write export")
+		log.GetDefaultLogger().Info().
+			Update("path", *exportOutput).
+			Update("format", *exportFormat).
+			Msg("client config written")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportFormat = exportCmd.Flags().StringP("format", "f", "xray-client", "singbox, clash or xray-client")
+	exportUser = exportCmd.Flags().StringP("user", "u", "", "User to export")
+	exportInbound = exportCmd.Flags().StringP("inbound", "i", "", "Only export this inbound")
+	exportOutput = exportCmd.Flags().StringP("output", "o", "", "Write to a file instead of stdout")
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"reflector/log"
+	"reflector/xray"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// linkCmd represents the link command
+var linkCmd = &cobra.Command{
+	Use:   "link",
+	Short: "Work with client share links",
+}
+
+func printLinkField(name string, value string) {
+	if value != "" {
+		fmt.Printf("%-12s %s\n", name+":", value)
+	}
+}
+
+var linkInspectCmd = &cobra.Command{
+	Use:   "inspect <link>",
+	Short: "Explain a share link and check it against the config",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		xl, err := xray.ParseXrayLink(args[0])
+		exitOnError(err, "failed to parse link")
+		p := xl.Parameters
+
+		printLinkField("name", xl.LinkName)
+		printLinkField("protocol", xl.Protocol)
+		printLinkField("server", net.JoinHostPort(xl.Host, strconv.Itoa(xl.Port)))
+		printLinkField("user id", xl.User)
+		printLinkField("flow", p.Flow)
+		printLinkField("security", p.Security)
+		printLinkField("sni", p.SNI)
+		printLinkField("fingerprint", p.Fingerprint)
+		printLinkField("alpn", p.ALPN)
+		printLinkField("public key", p.PublicKey)
+		printLinkField("short id", p.ShortID)
+		printLinkField("spider x", p.SpiderX)
+		printLinkField("transport", p.Type)
+		printLinkField("path", p.Path)
+		printLinkField("host", p.Host)
+		printLinkField("mode", p.Mode)
+		printLinkField("service", p.ServiceName)
+		printLinkField("extra", p.Extra)
+		fmt.Println()
+
+		inbound, user, mismatches, err := loadConfigFileOrExit().CheckLink(xl)
+		if err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("err", err.Error()).
+				Msg("link does not match the config")
+			return
+		}
+		fmt.Printf("belongs to user %s on inbound %s\n", user, inbound)
+		if len(mismatches) == 0 {
+			fmt.Println("link matches the config")
+			return
+		}
+		fmt.Println("differs from the config:")
+		for _, mismatch := range mismatches {
+			fmt.Println("  " + mismatch)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(linkCmd)
+	linkCmd.AddCommand(linkInspectCmd)
+}
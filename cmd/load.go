@@ -37,7 +37,7 @@ var loadXrayCmd = &cobra.Command{
 	Use:   "xray",
 	Short: "Load xray",
 	Run: func(cmd *cobra.Command, args []string) {
-		xray.NewPortableXray("v25.9.11")
+		xray.NewPortableXray(xrayVersion)
 	},
 }
 
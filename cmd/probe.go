@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflector/log"
+	"reflector/logic"
+	"reflector/probe"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var probeAddress *string
+var probeInsecure *bool
+var probeTimeout *time.Duration
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe <fqdn>",
+	Short: "Probe a deployed camo the way a censor would",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fqdn := args[0]
+		targets := []probe.Target{}
+		cf, err := logic.LoadConfigFile(*reflectorConfigLocation)
+		if err == nil {
+			targets, err = cf.ProbeTargets(fqdn, *probeAddress)
+		}
+		if err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("err", err.Error()).
+				Msg("probing as a plain website on port 443")
+			address := ""
+			if *probeAddress != "" {
+				address = net.JoinHostPort(*probeAddress, "443")
+			}
+			targets = []probe.Target{{FQDN: fqdn, Address: address}}
+		}
+
+		failed := 0
+		for _, target := range targets {
+			target.Insecure = *probeInsecure
+			target.Timeout = *probeTimeout
+			fmt.Printf("%s (%s)\n", target.Address, fqdn)
+			for _, finding := range probe.Probe(context.Background(), target) {
+				if finding.Severity == probe.FindingFail {
+					failed += 1
+				}
+				fmt.Printf("  [%-4s] %-18s %s\n", finding.Severity, finding.Check, finding.Detail)
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+	probeAddress = probeCmd.Flags().String("address", "", "Server address to connect to instead of the fqdn")
+	probeInsecure = probeCmd.Flags().Bool("insecure", false, "Skip certificate verification, for locally issued ones")
+	probeTimeout = probeCmd.Flags().Duration("timeout", 10*time.Second, "Timeout of every connection")
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflector/probe"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var realityScanFile *string
+var realityScanCIDR *string
+var realityScanPort *int
+var realityScanTimeout *time.Duration
+var realityScanWorkers *int
+
+// realityCmd represents the reality command
+var realityCmd = &cobra.Command{
+	Use:   "reality",
+	Short: "Helpers for reality camos",
+}
+
+// one fqdn per line, '#' starts a comment
+func readCandidateFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, scanner.Err()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+var realityScanCmd = &cobra.Command{
+	Use:   "scan [fqdn...]",
+	Short: "Rank candidates for a reality fqdn by TLS support and latency",
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := probe.RealityScanOptions{Timeout: *realityScanTimeout, Workers: *realityScanWorkers}
+		names := args
+		if *realityScanFile != "" {
+			fromFile, err := readCandidateFile(*realityScanFile)
+			exitOnError(err, "failed to read candidates")
+			names = append(names, fromFile...)
+		}
+		candidates := []*probe.RealityCandidate{}
+		for _, name := range names {
+			candidates = append(candidates, &probe.RealityCandidate{
+				FQDN:    name,
+				Address: net.JoinHostPort(name, strconv.Itoa(*realityScanPort)),
+			})
+		}
+		if *realityScanCIDR != "" {
+			fromCIDR, err := probe.CIDRRealityCandidates(context.Background(), *realityScanCIDR, *realityScanPort, opts)
+			exitOnError(err, "failed to scan the range")
+			candidates = append(candidates, fromCIDR...)
+		}
+		if len(candidates) == 0 {
+			exitOnError(errors.New("no candidates"), "pass fqdns, --file or --cidr")
+		}
+
+		ranked := probe.ScanRealityCandidates(context.Background(), candidates, opts)
+		fmt.Printf("%-4s %-32s %-24s %-6s %-6s %-3s %-4s %-20s %s\n",
+			"RANK", "FQDN", "ADDRESS", "TLS1.3", "X25519", "H2", "OCSP", "REDIRECT", "LATENCY")
+		for i, rc := range ranked {
+			if rc.Err != nil {
+				fmt.Printf("%-4d %-32s %-24s error: %s\n", i+1, rc.FQDN, rc.Address, rc.Err)
+				continue
+			}
+			rank := strconv.Itoa(i + 1)
+			if !rc.Suitable() {
+				rank = "-"
+			}
+			fmt.Printf("%-4s %-32s %-24s %-6s %-6s %-3s %-4s %-20s %s\n",
+				rank, rc.FQDN, rc.Address,
+				yesNo(rc.TLS13), yesNo(rc.X25519), yesNo(rc.H2), yesNo(rc.OCSPStapling),
+				orDash(rc.RedirectHost), rc.Latency.Round(time.Millisecond))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(realityCmd)
+	realityCmd.AddCommand(realityScanCmd)
+	realityScanFile = realityScanCmd.Flags().StringP("file", "f", "", "File with one candidate fqdn per line")
+	realityScanCIDR = realityScanCmd.Flags().String("cidr", "", "Scan a range, at most 256 addresses, names come from the certificates")
+	realityScanPort = realityScanCmd.Flags().IntP("port", "p", 443, "Port of the candidates")
+	realityScanTimeout = realityScanCmd.Flags().Duration("timeout", 5*time.Second, "Timeout of every connection")
+	realityScanWorkers = realityScanCmd.Flags().Int("workers", 16, "Candidates scanned at once")
+}
@@ -8,18 +8,26 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// versions of the binaries reflector runs, the other commands use the same
+const (
+	caddyVersion = "v2.9.0"
+	xrayVersion  = "v25.9.11"
+)
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Start the reflector",
 	Run: func(cmd *cobra.Command, args []string) {
 		r := logic.NewReflector(
-			"v2.9.0",
-			"v25.9.11",
+			caddyVersion,
+			xrayVersion,
 		)
-		config, err := os.Open("config.yaml")
+		config, err := os.Open(*reflectorConfigLocation)
 		if err != nil {
-			log.GetDefaultLogger().Error().Msg("failed to open config.yaml")
+			log.GetDefaultLogger().Error().
+				Update("path", *reflectorConfigLocation).
+				Msg("failed to open config")
 			os.Exit(1)
 		}
 		err = r.ParseReflectorConfigV1(config)
@@ -30,7 +38,8 @@ var runCmd = &cobra.Command{
 				Msg("failed to parse config")
 			os.Exit(1)
 		}
-		r.RunWithSignalHandling()
+		config.Close()
+		r.RunWithSignalHandling(*reflectorConfigLocation)
 	},
 }
 
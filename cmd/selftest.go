@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflector/log"
+	"reflector/logic"
+	"reflector/utils"
+	"reflector/xray"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var selftestURL *string
+var selftestInsecure *bool
+var selftestTimeout *time.Duration
+var selftestPID *int
+
+// reflector run processes started from the same binary
+func runningReflectorPIDs() []int {
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	pids := []int{}
+	for _, p := range *utils.PS() {
+		if p.PID == os.Getpid() || filepath.Base(p.Cmdline[0]) != filepath.Base(self) {
+			continue
+		}
+		if slices.Contains(p.Cmdline[1:], "run") {
+			pids = append(pids, p.PID)
+		}
+	}
+	return pids
+}
+
+func reloadReflector(pid int) error {
+	if pid == 0 {
+		pids := runningReflectorPIDs()
+		if len(pids) != 1 {
+			return fmt.Errorf("found %d running reflectors, pass --pid", len(pids))
+		}
+		pid = pids[0]
+	}
+	log.GetDefaultLogger().Debug().
+		Update("pid", pid).
+		Msg("sending SIGHUP to reflector")
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+// takes the throwaway user out of the config and the running reflector
+func removeSelftestUser(name string) {
+	cf, err := logic.LoadConfigFile(*reflectorConfigLocation)
+	if err == nil {
+		_, err = cf.RemoveUser("", name)
+	}
+	if err == nil {
+		err = cf.Save()
+	}
+	if err == nil {
+		err = reloadReflector(*selftestPID)
+	}
+	if err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Update("user", name).
+			Msg("failed to remove the selftest user, remove it with 'reflector user rm'")
+	}
+}
+
+// selftestCmd represents the selftest command
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Connect through every inbound of a running reflector like a client would",
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		inbounds, err := cf.ClientInbounds()
+		exitOnError(err, "failed to read inbounds")
+		if len(inbounds) == 0 {
+			exitOnError(errors.New("no vless or vmess inbounds"), "nothing to test")
+		}
+		name := "selftest-" + utils.RandomHex(4)
+		for _, inb := range inbounds {
+			// a new short id would restart xray and drop every connection
+			exitOnError(cf.AddUserSharingShortID(inb, name, ""), "failed to add the selftest user")
+		}
+		exitOnError(cf.Save(), "failed to save config")
+		if err := reloadReflector(*selftestPID); err != nil {
+			removeSelftestUser(name)
+			exitOnError(err, "failed to reload reflector")
+		}
+
+		xr := xray.NewPortableXray(xrayVersion)
+		results, err := cf.SelfTest(context.Background(), name, logic.SelfTestOptions{
+			XrayBinary: xr.BinaryLocation(),
+			URL:        *selftestURL,
+			Insecure:   *selftestInsecure,
+			Timeout:    *selftestTimeout,
+			Attempts:   5,
+		})
+		removeSelftestUser(name)
+		exitOnError(err, "failed to run selftest")
+
+		failed := 0
+		fmt.Printf("%-16s %-6s %-18s %s\n", "INBOUND", "CHECK", "TRANSPORT", "RESULT")
+		for _, result := range results {
+			outcome := "pass " + result.Detail
+			if result.Err != nil {
+				failed += 1
+				outcome = "FAIL " + result.Err.Error()
+			}
+			fmt.Printf("%-16s %-6s %-18s %s\n", result.Inbound, result.Check, result.Transport, outcome)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestURL = selftestCmd.Flags().String("url", "https://www.gstatic.com/generate_204", "URL fetched through every inbound")
+	selftestInsecure = selftestCmd.Flags().Bool("insecure", false, "Accept any certificate, for locally issued ones")
+	selftestTimeout = selftestCmd.Flags().Duration("timeout", 10*time.Second, "Timeout of every request")
+	selftestPID = selftestCmd.Flags().Int("pid", 0, "Reflector to reload, found automatically when only one runs")
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflector/log"
+	"reflector/logic"
+	"reflector/utils"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var userInbound *string
+var userFlow *string
+var userLinkQR *bool
+var userLinkPNG *string
+var userLinkSVG *string
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage users in the reflector config",
+}
+
+func loadConfigFileOrExit() *logic.ConfigFile {
+	cf, err := logic.LoadConfigFile(*reflectorConfigLocation)
+	if err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Update("path", *reflectorConfigLocation).
+			Msg("failed to load config")
+		os.Exit(1)
+	}
+	return cf
+}
+
+func saveConfigFileOrExit(cf *logic.ConfigFile) {
+	if err := cf.Save(); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Update("path", *reflectorConfigLocation).
+			Msg("failed to save config")
+		os.Exit(1)
+	}
+	log.GetDefaultLogger().Info().
+		Update("path", *reflectorConfigLocation).
+		Msg("config saved, send SIGHUP to a running reflector to apply")
+}
+
+func exitOnError(err error, msg string) {
+	if err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Msg(msg)
+		os.Exit(1)
+	}
+}
+
+func printUserLinks(cf *logic.ConfigFile, inbound string, name string) {
+	links, err := cf.UserLinks(inbound, name)
+	exitOnError(err, "failed to build client links")
+	inbounds := []string{}
+	for inb := range links {
+		inbounds = append(inbounds, inb)
+	}
+	sort.Strings(inbounds)
+	for _, inb := range inbounds {
+		fmt.Println(links[inb].MarshalLink())
+	}
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Add a user with a generated uuid and short id to a vless or vmess inbound",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if *userInbound == "" {
+			exitOnError(fmt.Errorf("--inbound is required"), "failed to add user")
+		}
+		cf := loadConfigFileOrExit()
+		exitOnError(cf.AddUser(*userInbound, args[0], *userFlow), "failed to add user")
+		saveConfigFileOrExit(cf)
+		printUserLinks(cf, *userInbound, args[0])
+	},
+}
+
+var userRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a user, from every inbound unless --inbound is set",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		removed, err := cf.RemoveUser(*userInbound, args[0])
+		exitOnError(err, "failed to remove user")
+		saveConfigFileOrExit(cf)
+		log.GetDefaultLogger().Info().
+			Update("user", args[0]).
+			Update("removed", removed).
+			Msg("user removed")
+	},
+}
+
+var userLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List users, with traffic when metrics are enabled",
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		users, err := cf.Users()
+		exitOnError(err, "failed to list users")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		traffic, err := cf.UserTraffic(ctx)
+		if err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("err", err.Error()).
+				Msg("failed to get traffic, is reflector running?")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "INBOUND\tNAME\tUUID\tSHORT ID\tQUOTA\tEXPIRES\tTRAFFIC")
+		for _, user := range users {
+			if *userInbound != "" && user.Inbound != *userInbound {
+				continue
+			}
+			usage := "-"
+			if userTraffic, exists := traffic[user.Name]; exists {
+				usage = fmt.Sprintf(
+					"%s up, %s down",
+					utils.FormatSize(userTraffic.Uplink),
+					utils.FormatSize(userTraffic.Downlink))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				user.Inbound, user.Name, user.UUID, orDash(user.ShortID),
+				orDash(user.Quota), orDash(user.Expires), usage)
+		}
+		w.Flush()
+	},
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var userRotateCmd = &cobra.Command{
+	Use:   "rotate <name>",
+	Short: "Generate a new uuid for a user, old links stop working",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cf := loadConfigFileOrExit()
+		_, err := cf.RotateUser(*userInbound, args[0])
+		exitOnError(err, "failed to rotate user")
+		saveConfigFileOrExit(cf)
+		printUserLinks(cf, *userInbound, args[0])
+	},
+}
+
+// 'bob.png' -> 'bob-vless-in.png' when a user has links on several inbounds
+func qrFilePath(path string, inbound string, multiple bool) string {
+	if !multiple {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + inbound + ext
+}
+
+var userLinkCmd = &cobra.Command{
+	Use:   "link <name>",
+	Short: "Print client share links of a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		links, err := loadConfigFileOrExit().UserLinks(*userInbound, args[0])
+		exitOnError(err, "failed to build client links")
+		inbounds := []string{}
+		for inb := range links {
+			inbounds = append(inbounds, inb)
+		}
+		sort.Strings(inbounds)
+		for _, inb := range inbounds {
+			link := links[inb].MarshalLink()
+			fmt.Println(link)
+			if *userLinkQR {
+				qr, err := utils.QRTerminal(link)
+				exitOnError(err, "failed to render qr code")
+				fmt.Print(qr)
+			}
+			if *userLinkPNG != "" {
+				path := qrFilePath(*userLinkPNG, inb, len(links) > 1)
+				exitOnError(utils.WriteQRPNG(link, path, 512), "failed to write png")
+				log.GetDefaultLogger().Info().Update("path", path).Msg("qr code written")
+			}
+			if *userLinkSVG != "" {
+				path := qrFilePath(*userLinkSVG, inb, len(links) > 1)
+				exitOnError(utils.WriteQRSVG(link, path), "failed to write svg")
+				log.GetDefaultLogger().Info().Update("path", path).Msg("qr code written")
+			}
+		}
+		if url, err := loadConfigFileOrExit().UserSubscriptionURL(args[0]); err == nil {
+			fmt.Println(url)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userRmCmd)
+	userCmd.AddCommand(userLsCmd)
+	userCmd.AddCommand(userRotateCmd)
+	userCmd.AddCommand(userLinkCmd)
+
+	userInbound = userCmd.PersistentFlags().StringP("inbound", "i", "", "Inbound name")
+	userFlow = userAddCmd.Flags().String("flow", "", "vless flow, e.g. xtls-rprx-vision")
+	userLinkQR = userLinkCmd.Flags().Bool("qr", false, "Print qr codes to the terminal")
+	userLinkPNG = userLinkCmd.Flags().String("png", "", "Write qr codes as png to this path")
+	userLinkSVG = userLinkCmd.Flags().String("svg", "", "Write qr codes as svg to this path")
+}
@@ -0,0 +1,265 @@
+package decoy
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var (
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/*.html.tmpl"))
+	cssTemplate   = texttemplate.Must(texttemplate.ParseFS(templateFS, "templates/style.css.tmpl"))
+)
+
+const (
+	KindBlog      = "blog"
+	KindCompany   = "company"
+	KindFileshare = "fileshare"
+)
+
+var Kinds = []string{KindBlog, KindCompany, KindFileshare}
+
+type colors struct {
+	Primary    string
+	Accent     string
+	Background string
+	Text       string
+}
+
+type link struct {
+	Title string
+	Href  string
+}
+
+type post struct {
+	Title      string
+	Slug       string
+	Date       string
+	Paragraphs []string
+}
+
+type service struct {
+	Name        string
+	Description string
+}
+
+type site struct {
+	Kind    string
+	Name    string
+	Tagline string
+	Author  string
+	City    string
+	Year    int
+	Colors  colors
+	Font    string
+	Nav     []link
+	// about text
+	Paragraphs []string
+	Posts      []post
+	Services   []service
+}
+
+type page struct {
+	Site  *site
+	Title string
+	Post  *post
+}
+
+// generate://<kind>?seed=<seed>
+func ParseTemplate(template string) (string, string, error) {
+	parsed, err := url.Parse(template)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed.Scheme != "generate" {
+		return "", "", fmt.Errorf("%s is not a generate:// template", template)
+	}
+	kind := parsed.Host
+	if !slices.Contains(Kinds, kind) {
+		return "", "", fmt.Errorf("unknown site kind %q, one of: %s", kind, strings.Join(Kinds, ", "))
+	}
+	seed := parsed.Query().Get("seed")
+	if seed == "" {
+		suggestion := make([]byte, 8)
+		rand.Read(suggestion)
+		return "", "", fmt.Errorf(
+			"%s has no seed, sites without one would look the same everywhere, e.g. generate://%s?seed=%s",
+			template, kind, hex.EncodeToString(suggestion))
+	}
+	return kind, seed, nil
+}
+
+// Renders the site of a generate:// template into dest, the same template
+// always renders the same files
+func Generate(template string, dest string) error {
+	kind, seed, err := ParseTemplate(template)
+	if err != nil {
+		return err
+	}
+	return newSite(kind, seed).render(dest)
+}
+
+func slug(s string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, s), "-")
+}
+
+func title(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+func paragraphs(r *seededRand, sentences []string, count int) []string {
+	result := []string{}
+	for range count {
+		result = append(result, strings.Join(r.pickN(sentences, r.between(3, 5)), " "))
+	}
+	return result
+}
+
+func newSite(kind string, seed string) *site {
+	// the kind is part of the seed, one seed gives unrelated sites per kind
+	r := newSeededRand(kind + "\x00" + seed)
+	hue := r.intn(360)
+	s := &site{
+		Kind:   kind,
+		Author: r.pick(firstNames) + " " + r.pick(lastNames),
+		City:   r.pick(cities),
+		Colors: colors{
+			Primary:    fmt.Sprintf("hsl(%d, %d%%, %d%%)", hue, r.between(40, 70), r.between(28, 42)),
+			Accent:     fmt.Sprintf("hsl(%d, %d%%, %d%%)", (hue+r.between(150, 210))%360, r.between(50, 80), r.between(45, 60)),
+			Background: fmt.Sprintf("hsl(%d, %d%%, %d%%)", hue, r.between(10, 30), r.between(96, 99)),
+			Text:       r.pick([]string{"#1f2328", "#222", "#2d2d2d", "#333"}),
+		},
+		Font: r.pick(fonts),
+	}
+
+	switch kind {
+	case KindBlog:
+		s.Name = title(r.pick(adjectives) + " " + r.pick(nouns))
+		topics := r.pickN(blogTopics, r.between(1, 3))
+		s.Tagline = "Notes on " + topics[0]
+		if len(topics) > 1 {
+			s.Tagline = "Notes on " + strings.Join(topics[:len(topics)-1], ", ") + " and " + topics[len(topics)-1]
+		}
+		s.Paragraphs = paragraphs(r, blogSentences, r.between(1, 2))
+		// dates come from the seed as well, not from the clock
+		date := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, r.between(0, 1000))
+		for range r.between(3, 9) {
+			postTitle := fmt.Sprintf(r.pick(blogTitlePatterns), r.pick(topics))
+			postTitle = strings.ToUpper(postTitle[:1]) + postTitle[1:]
+			s.Posts = append(s.Posts, post{
+				Title:      postTitle,
+				Slug:       fmt.Sprintf("%s-%s", date.Format("2006-01-02"), slug(postTitle)),
+				Date:       date.Format("January 2, 2006"),
+				Paragraphs: paragraphs(r, blogSentences, r.between(2, 5)),
+			})
+			s.Year = date.Year()
+			date = date.AddDate(0, 0, r.between(6, 60))
+		}
+		// newest first
+		slices.Reverse(s.Posts)
+		s.Nav = []link{{"Home", "/"}, {"About", "/about.html"}}
+	case KindCompany:
+		s.Name = title(r.pick(nouns)) + " " + r.pick(companySuffixes)
+		s.Tagline = r.pick(companySentences)
+		s.Paragraphs = paragraphs(r, companySentences, r.between(2, 3))
+		for _, name := range r.pickN(companyServices, r.between(3, 6)) {
+			s.Services = append(s.Services, service{
+				Name:        name,
+				Description: strings.Join(r.pickN(companySentences, 2), " "),
+			})
+		}
+		s.Year = 2022 + r.intn(4)
+		s.Nav = []link{{"Home", "/"}, {"Services", "/services.html"}, {"About", "/about.html"}, {"Contact", "/contact.html"}}
+	case KindFileshare:
+		s.Name = title(r.pick(adjectives)) + " " + r.pick(fileshareProducts)
+		s.Tagline = "Sign in to access your files"
+		s.Year = 2022 + r.intn(4)
+	}
+	return s
+}
+
+func writeTemplate(dest string, name string, execute func(io.Writer) error) error {
+	target := filepath.Join(dest, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return execute(f)
+}
+
+func (s *site) render(dest string) error {
+	pages := map[string]page{
+		"404.html": {Site: s, Title: "Page not found"},
+	}
+	templates := map[string]string{
+		"404.html": "404.html.tmpl",
+	}
+	robots := "User-agent: *\nDisallow:\n"
+	switch s.Kind {
+	case KindBlog:
+		pages["index.html"], templates["index.html"] = page{Site: s}, "blog_index.html.tmpl"
+		pages["about.html"], templates["about.html"] = page{Site: s, Title: "About"}, "about.html.tmpl"
+		for i := range s.Posts {
+			name := "posts/" + s.Posts[i].Slug + ".html"
+			pages[name], templates[name] = page{Site: s, Title: s.Posts[i].Title, Post: &s.Posts[i]}, "blog_post.html.tmpl"
+		}
+	case KindCompany:
+		pages["index.html"], templates["index.html"] = page{Site: s}, "company_index.html.tmpl"
+		pages["services.html"], templates["services.html"] = page{Site: s, Title: "Services"}, "company_services.html.tmpl"
+		pages["about.html"], templates["about.html"] = page{Site: s, Title: "About"}, "about.html.tmpl"
+		pages["contact.html"], templates["contact.html"] = page{Site: s, Title: "Contact"}, "contact.html.tmpl"
+	case KindFileshare:
+		pages["index.html"], templates["index.html"] = page{Site: s, Title: "Sign in"}, "fileshare_index.html.tmpl"
+		pages["reset.html"], templates["reset.html"] = page{Site: s, Title: "Reset password"}, "fileshare_reset.html.tmpl"
+		robots = "User-agent: *\nDisallow: /\n"
+	default:
+		return errors.New("unknown site kind " + s.Kind)
+	}
+
+	for name, p := range pages {
+		err := writeTemplate(dest, name, func(w io.Writer) error {
+			return htmlTemplates.ExecuteTemplate(w, templates[name], p)
+		})
+		if err != nil {
+			return fmt.Errorf("rendering %s: %w", name, err)
+		}
+	}
+	err := writeTemplate(dest, "style.css", func(w io.Writer) error {
+		return cssTemplate.Execute(w, s)
+	})
+	if err != nil {
+		return fmt.Errorf("rendering style.css: %w", err)
+	}
+	return os.WriteFile(filepath.Join(dest, "robots.txt"), []byte(robots), 0o644)
+}
@@ -0,0 +1,73 @@
+package decoy_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflector/decoy"
+	"strings"
+	"testing"
+)
+
+// relative path to content of every file under dir
+func readTree(t *testing.T, dir string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		tree[rel] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestGenerate(t *testing.T) {
+	for _, kind := range decoy.Kinds {
+		first, again, other := t.TempDir(), t.TempDir(), t.TempDir()
+		for dest, seed := range map[string]string{first: "alpha", again: "alpha", other: "beta"} {
+			if err := decoy.Generate("generate://"+kind+"?seed="+seed, dest); err != nil {
+				t.Fatalf("%s: %v", kind, err)
+			}
+		}
+		firstTree, againTree, otherTree := readTree(t, first), readTree(t, again), readTree(t, other)
+		for _, name := range []string{"index.html", "404.html", "style.css", "robots.txt"} {
+			if _, exists := firstTree[name]; !exists {
+				t.Errorf("%s: no %s", kind, name)
+			}
+		}
+		if len(firstTree) != len(againTree) {
+			t.Fatalf("%s: same seed rendered %d and %d files", kind, len(firstTree), len(againTree))
+		}
+		for name, content := range firstTree {
+			if againTree[name] != content {
+				t.Errorf("%s: %s differs for the same seed", kind, name)
+			}
+		}
+		if firstTree["index.html"] == otherTree["index.html"] || firstTree["style.css"] == otherTree["style.css"] {
+			t.Errorf("%s: different seeds rendered the same site", kind)
+		}
+		if strings.Contains(firstTree["index.html"], "<no value>") {
+			t.Errorf("%s: index.html has unset fields", kind)
+		}
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	kind, seed, err := decoy.ParseTemplate("generate://blog?seed=abc")
+	if err != nil || kind != "blog" || seed != "abc" {
+		t.Errorf("got %q %q %v", kind, seed, err)
+	}
+	for _, template := range []string{"generate://blog", "generate://forum?seed=abc", "docker://blog?seed=abc"} {
+		if _, _, err := decoy.ParseTemplate(template); err == nil {
+			t.Errorf("%s should not parse", template)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package decoy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Deterministic numbers from a seed, counter mode sha256 so sites stay the
+// same across go releases, which math/rand does not promise
+type seededRand struct {
+	seed    [32]byte
+	counter uint64
+}
+
+func newSeededRand(seed string) *seededRand {
+	return &seededRand{seed: sha256.Sum256([]byte(seed))}
+}
+
+func (r *seededRand) uint64() uint64 {
+	block := make([]byte, 40)
+	copy(block, r.seed[:])
+	binary.BigEndian.PutUint64(block[32:], r.counter)
+	r.counter++
+	sum := sha256.Sum256(block)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// in [0, n)
+func (r *seededRand) intn(n int) int {
+	return int(r.uint64() % uint64(n))
+}
+
+// in [min, max]
+func (r *seededRand) between(min, max int) int {
+	return min + r.intn(max-min+1)
+}
+
+func (r *seededRand) pick(words []string) string {
+	return words[r.intn(len(words))]
+}
+
+// n distinct words, n is capped at len(words)
+func (r *seededRand) pickN(words []string, n int) []string {
+	shuffled := append([]string{}, words...)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j := r.intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled[:min(n, len(shuffled))]
+}
@@ -0,0 +1,103 @@
+package decoy
+
+var firstNames = []string{
+	"Anna", "Ben", "Clara", "Daniel", "Elena", "Felix", "Grace", "Henrik",
+	"Iris", "Jonas", "Katrin", "Leo", "Maya", "Nils", "Olivia", "Paul",
+	"Rosa", "Simon", "Tara", "Victor", "Wren", "Yusuf", "Lena", "Marco",
+	"Nora", "Oskar", "Priya", "Ruben", "Sofia", "Tomas", "Ada", "Elias",
+}
+
+var lastNames = []string{
+	"Adler", "Berg", "Castell", "Dumont", "Ellis", "Fischer", "Garner", "Holm",
+	"Ivers", "Jansen", "Keller", "Lindqvist", "Moreau", "Novak", "Olsen", "Price",
+	"Quinn", "Reyes", "Sauer", "Turner", "Varga", "Walsh", "Young", "Brandt",
+	"Costa", "Dahl", "Ferreira", "Hale", "Kowalski", "Marsh", "Pereira", "Strand",
+}
+
+var adjectives = []string{
+	"quiet", "northern", "bright", "hidden", "slow", "little", "open", "green",
+	"steady", "blue", "silver", "early", "amber", "hollow", "clear", "wild",
+	"second", "simple", "distant", "warm", "honest", "copper", "lucky", "paper",
+}
+
+var nouns = []string{
+	"harbor", "field", "lantern", "river", "orchard", "signal", "compass", "garden",
+	"workshop", "atlas", "meadow", "bridge", "circuit", "anchor", "summit", "canvas",
+	"pine", "ledger", "studio", "harvest", "beacon", "island", "forge", "window",
+}
+
+var companySuffixes = []string{
+	"Labs", "Systems", "Partners", "Consulting", "Works", "Group", "Digital", "Solutions",
+}
+
+var cities = []string{
+	"Rotterdam", "Tallinn", "Porto", "Leipzig", "Gothenburg", "Lyon", "Krakow", "Ghent",
+	"Aarhus", "Bologna", "Brno", "Tampere", "Graz", "Bilbao", "Utrecht", "Vilnius",
+}
+
+var blogTopics = []string{
+	"gardening", "bread baking", "film photography", "trail running", "home coffee",
+	"woodworking", "birdwatching", "vintage radios", "city cycling", "sourdough",
+	"bookbinding", "houseplants", "chess openings", "mechanical keyboards", "hiking",
+}
+
+var blogTitlePatterns = []string{
+	"What I learned from a year of %s",
+	"A beginner's notes on %s",
+	"Why I keep coming back to %s",
+	"Small mistakes in %s and how to avoid them",
+	"%s on a budget",
+	"The tools I actually use for %s",
+	"Ten quiet weeks of %s",
+	"Notes from a rainy weekend of %s",
+}
+
+var blogSentences = []string{
+	"I started with very little equipment and a lot of patience.",
+	"Most of the advice I found online turned out to be more complicated than it needed to be.",
+	"The first attempts were not great, but they taught me what to pay attention to.",
+	"It took a few weeks before the routine felt natural.",
+	"A friend suggested keeping a notebook, and that changed how I work.",
+	"Looking back, the biggest improvement came from slowing down.",
+	"I still make the same mistake every now and then.",
+	"There is something satisfying about doing this by hand.",
+	"The weather made everything harder than planned.",
+	"I am curious how others approach this, so feel free to write to me.",
+	"Next month I want to try a different approach and compare the results.",
+	"Cheap tools are fine at the start, you learn what you really need later.",
+	"Most of the time went into preparation rather than the actual work.",
+	"I ended up rewriting my checklist three times.",
+	"It is easy to overthink this, the basics matter most.",
+}
+
+var companyServices = []string{
+	"Cloud migration", "Data engineering", "Security audits", "Product design",
+	"Managed hosting", "Mobile development", "Process automation", "IT support",
+	"Analytics dashboards", "Network planning", "Technical training", "Software maintenance",
+}
+
+var companySentences = []string{
+	"We work with small and medium sized teams across Europe.",
+	"Our engineers have been building reliable systems for more than a decade.",
+	"Every project starts with a short workshop to understand your goals.",
+	"We prefer simple, maintainable solutions over fashionable ones.",
+	"Clients stay with us because we answer the phone.",
+	"We document everything we build and hand it over to your team.",
+	"Our support team is available on working days from 8 to 18.",
+	"We believe good infrastructure should be boring.",
+	"Most engagements start small and grow with the results.",
+	"We are independent and not tied to any single vendor.",
+}
+
+var fileshareProducts = []string{
+	"Drive", "Files", "Share", "Vault", "Box", "Cloud", "Docs", "Storage",
+}
+
+var fonts = []string{
+	"Georgia, serif",
+	"'Helvetica Neue', Arial, sans-serif",
+	"Verdana, Geneva, sans-serif",
+	"'Trebuchet MS', sans-serif",
+	"system-ui, sans-serif",
+	"Palatino, 'Book Antiqua', serif",
+}
@@ -0,0 +1,474 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflector/camo"
+	"reflector/utils"
+	"reflector/xray"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Reflector config with its yaml tree kept around, edits go through the tree
+// so that comments and key order survive writing it back
+type ConfigFile struct {
+	path string
+	root yaml.Node
+}
+
+type UserEntry struct {
+	Inbound string
+	Name    string
+	UUID    string
+	ShortID string
+	Quota   string
+	Expires string
+}
+
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ConfigFile{path: path}
+	if err := yaml.Unmarshal(configBytes, &cf.root); err != nil {
+		return nil, err
+	}
+	if len(cf.root.Content) == 0 {
+		return nil, errors.New("config is empty")
+	}
+	return cf, nil
+}
+
+func (cf *ConfigFile) Save() error {
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&cf.root); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(cf.path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cf.path, buf.Bytes(), info.Mode().Perm())
+}
+
+func (cf *ConfigFile) spec() (*reflectorConfigV1Spec, error) {
+	rc := &reflectorConfigV1{}
+	if err := cf.root.Decode(rc); err != nil {
+		return nil, err
+	}
+	return &rc.Spec, nil
+}
+
+// value node of key in a mapping node, nil when missing
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	if existing := mappingValue(node, key); existing != nil {
+		*existing = *value
+		return
+	}
+	node.Content = append(node.Content, scalarNode(key), value)
+}
+
+func (cf *ConfigFile) inboundNodes() ([]*yaml.Node, error) {
+	inbounds := mappingValue(mappingValue(cf.root.Content[0], "spec"), "inbounds")
+	if inbounds == nil || inbounds.Kind != yaml.SequenceNode {
+		return nil, errors.New("config has no spec.inbounds")
+	}
+	return inbounds.Content, nil
+}
+
+func (cf *ConfigFile) inboundNode(name string) (*yaml.Node, error) {
+	inbounds, err := cf.inboundNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, inb := range inbounds {
+		if nameNode := mappingValue(inb, "name"); nameNode != nil && nameNode.Value == name {
+			return inb, nil
+		}
+	}
+	return nil, fmt.Errorf("undefined inbound: %s", name)
+}
+
+// users of the inbound, or of every inbound when inbound is empty
+func (cf *ConfigFile) userNodes(inbound string, name string) ([]*yaml.Node, error) {
+	inbounds, err := cf.inboundNodes()
+	if err != nil {
+		return nil, err
+	}
+	found := []*yaml.Node{}
+	for _, inb := range inbounds {
+		if inbNameNode := mappingValue(inb, "name"); inbound != "" && (inbNameNode == nil || inbNameNode.Value != inbound) {
+			continue
+		}
+		users := mappingValue(inb, "users")
+		if users == nil {
+			continue
+		}
+		for _, user := range users.Content {
+			if nameNode := mappingValue(user, "name"); nameNode != nil && nameNode.Value == name {
+				found = append(found, user)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("user %s not found", name)
+	}
+	return found, nil
+}
+
+// Adds a user with a fresh uuid and short id, only vless and vmess inbounds
+// have those
+func (cf *ConfigFile) AddUser(inbound string, name string, flow string) error {
+	return cf.addUser(inbound, name, flow, false)
+}
+
+// Like AddUser but takes the short id of the inbound's first user, a new
+// short id changes a reality inbound and the reload restarts xray
+func (cf *ConfigFile) AddUserSharingShortID(inbound string, name string, flow string) error {
+	return cf.addUser(inbound, name, flow, true)
+}
+
+func (cf *ConfigFile) addUser(inbound string, name string, flow string, shareShortID bool) error {
+	inb, err := cf.inboundNode(inbound)
+	if err != nil {
+		return err
+	}
+	if typeNode := mappingValue(inb, "type"); typeNode == nil || (typeNode.Value != "vless" && typeNode.Value != "vmess") {
+		return fmt.Errorf("users can only be added to vless and vmess inbounds, %s users need a password set in the config", inbound)
+	}
+	if _, err := cf.userNodes(inbound, name); err == nil {
+		return fmt.Errorf("user %s already exists in %s", name, inbound)
+	}
+	users := mappingValue(inb, "users")
+	if users == nil || users.Kind != yaml.SequenceNode {
+		users = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(inb, "users", users)
+	}
+	user := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(user, "name", scalarNode(name))
+	setMappingValue(user, "uuid", scalarNode(uuid.NewString()))
+	if flow != "" {
+		setMappingValue(user, "flow", scalarNode(flow))
+	}
+	shortID := utils.RandomHex(4)
+	if shareShortID && len(users.Content) > 0 {
+		// users without one share the empty short id
+		shortID = ""
+		if shortIDNode := mappingValue(users.Content[0], "short_id"); shortIDNode != nil {
+			shortID = shortIDNode.Value
+		}
+	}
+	if shortID != "" {
+		setMappingValue(user, "short_id", scalarNode(shortID))
+	}
+	users.Content = append(users.Content, user)
+	return nil
+}
+
+// Returns how many users were removed, inbound may be empty to match all
+func (cf *ConfigFile) RemoveUser(inbound string, name string) (int, error) {
+	found, err := cf.userNodes(inbound, name)
+	if err != nil {
+		return 0, err
+	}
+	inbounds, _ := cf.inboundNodes()
+	for _, inb := range inbounds {
+		users := mappingValue(inb, "users")
+		if users == nil {
+			continue
+		}
+		kept := []*yaml.Node{}
+		for _, user := range users.Content {
+			if !containsNode(found, user) {
+				kept = append(kept, user)
+			}
+		}
+		users.Content = kept
+	}
+	return len(found), nil
+}
+
+func containsNode(nodes []*yaml.Node, node *yaml.Node) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// New uuid for the user, old client links stop working
+func (cf *ConfigFile) RotateUser(inbound string, name string) (int, error) {
+	found, err := cf.userNodes(inbound, name)
+	if err != nil {
+		return 0, err
+	}
+	for _, user := range found {
+		setMappingValue(user, "uuid", scalarNode(uuid.NewString()))
+	}
+	return len(found), nil
+}
+
+func (cf *ConfigFile) Users() ([]UserEntry, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	entries := []UserEntry{}
+	for _, inb := range spec.Inbounds {
+		for _, user := range inb.Users {
+			entries = append(entries, UserEntry{
+				Inbound: inb.Name,
+				Name:    user.Name,
+				UUID:    user.UUID,
+				ShortID: user.ShortID,
+				Quota:   user.Quota,
+				Expires: user.Expires,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// Share links of the user per inbound, inbound may be empty to match all
+func (cf *ConfigFile) UserLinks(inbound string, name string) (map[string]*xray.XrayLink, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	links := map[string]*xray.XrayLink{}
+	for _, inb := range spec.Inbounds {
+		if inbound != "" && inb.Name != inbound {
+			continue
+		}
+		for _, user := range inb.Users {
+			if user.Name != name {
+				continue
+			}
+			link, err := spec.inboundUserLink(&inb, &user)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inb.Name, err)
+			}
+			links[inb.Name] = link
+		}
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("user %s not found", name)
+	}
+	return links, nil
+}
+
+// Finds the inbound and user the link belongs to and lists every parameter
+// that differs from the link the config would produce
+func (cf *ConfigFile) CheckLink(xl *xray.XrayLink) (inbound string, user string, mismatches []string, err error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, inb := range spec.Inbounds {
+		if inb.ListenPort != xl.Port {
+			continue
+		}
+		for _, u := range inb.Users {
+			if u.UUID != xl.User {
+				continue
+			}
+			expected, err := spec.inboundUserLink(&inb, &u)
+			if err != nil {
+				return inb.Name, u.Name, nil, err
+			}
+			if expected.Protocol != xl.Protocol {
+				mismatches = append(mismatches, fmt.Sprintf("protocol: link has %q, config has %q", xl.Protocol, expected.Protocol))
+			}
+			if expected.Host != xl.Host {
+				mismatches = append(mismatches, fmt.Sprintf("host: link has %q, config has %q", xl.Host, expected.Host))
+			}
+			got, want := xl.Values(), expected.Values()
+			keys := []string{}
+			for key := range got {
+				keys = append(keys, key)
+			}
+			for key := range want {
+				if _, exists := got[key]; !exists {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if got.Get(key) != want.Get(key) {
+					mismatches = append(mismatches, fmt.Sprintf("%s: link has %q, config has %q", key, got.Get(key), want.Get(key)))
+				}
+			}
+			return inb.Name, u.Name, mismatches, nil
+		}
+	}
+	return "", "", nil, fmt.Errorf("no user with id %s on port %d", xl.User, xl.Port)
+}
+
+// Camo controller with the cache settings of the config
+func (cf *ConfigFile) CamoController() (*camo.CamoController, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	cc := camo.NewCamoController()
+	if spec.CamoCache.Dir != "" {
+		cc.SetCamoDir(spec.CamoCache.Dir)
+	}
+	if spec.CamoCache.MaxSize != "" {
+		maxSize, err := utils.ParseSize(spec.CamoCache.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		cc.SetMaxCacheSize(maxSize)
+	}
+	if spec.CamoCache.MaxTemplateSize != "" {
+		maxTemplateSize, err := utils.ParseSize(spec.CamoCache.MaxTemplateSize)
+		if err != nil {
+			return nil, err
+		}
+		cc.SetMaxTemplateSize(maxTemplateSize)
+	}
+	for _, camoSpec := range spec.Camos {
+		cc.SetSubdir(camoSpec.Template, camoSpec.Subdir)
+		if camoSpec.CosignKey == "" {
+			continue
+		}
+		publicKeyPEM, err := os.ReadFile(camoSpec.CosignKey)
+		if err != nil {
+			return nil, err
+		}
+		cc.SetVerificationKey(camoSpec.Template, publicKeyPEM)
+	}
+	return cc, nil
+}
+
+// Templates of the wtls camos by camo name, proxy:// camos have nothing to unpack
+func (cf *ConfigFile) CamoTemplates() (map[string]string, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]string{}
+	for name, camoSpec := range spec.Camos {
+		if camoSpec.Security == "wtls" && camoSpec.Template != "" && !camo.IsProxyTemplate(camoSpec.Template) {
+			templates[name] = camoSpec.Template
+		}
+	}
+	return templates, nil
+}
+
+func (cf *ConfigFile) UserSubscriptionURL(name string) (string, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return "", err
+	}
+	return spec.subscriptionURL(name)
+}
+
+// Per user traffic from the metrics endpoint of a running reflector, nil
+// when metrics are off
+func (cf *ConfigFile) UserTraffic(ctx context.Context) (map[string]userUsage, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	if spec.Metrics.Port == 0 {
+		return nil, nil
+	}
+	host := spec.Metrics.Listen
+	if ip := net.ParseIP(utils.ListenHost(host)); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet,
+		"http://"+utils.ListenAddress(host, spec.Metrics.Port)+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+	return parseUserTrafficMetrics(bufio.NewScanner(resp.Body))
+}
+
+// reads reflector_user_traffic_bytes_total samples as rendered by metricsExporter
+func parseUserTrafficMetrics(scanner *bufio.Scanner) (map[string]userUsage, error) {
+	prefix := "reflector_user_traffic_bytes_total{"
+	traffic := map[string]userUsage{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		labels, value, found := strings.Cut(strings.TrimPrefix(line, prefix), "} ")
+		if !found {
+			continue
+		}
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		name, direction := "", ""
+		for _, pair := range strings.Split(labels, ",") {
+			key, quoted, _ := strings.Cut(pair, "=")
+			unquoted, err := strconv.Unquote(quoted)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "user":
+				name = unquoted
+			case "direction":
+				direction = unquoted
+			}
+		}
+		usage := traffic[name]
+		switch direction {
+		case "uplink":
+			usage.Uplink += bytes
+		case "downlink":
+			usage.Downlink += bytes
+		}
+		traffic[name] = usage
+	}
+	return traffic, scanner.Err()
+}
@@ -0,0 +1,133 @@
+package logic
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflector/xray"
+	"strings"
+	"testing"
+)
+
+func writeTestConfigFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := strings.Replace(testConfig, "  inbounds:\n", "  # keep me\n  inbounds:\n", 1)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileUsers(t *testing.T) {
+	path := writeTestConfigFile(t)
+	cf, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddUser("reality-in", "carol", "xtls-rprx-vision"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddUser("reality-in", "carol", ""); err == nil {
+		t.Fatal("duplicate users should not be added")
+	}
+	if err := cf.AddUserSharingShortID("reality-in", "selftest", ""); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := cf.Users(); len(users) != 4 || users[3].Name != "selftest" || users[3].ShortID != "b0b01d" {
+		t.Fatalf("expected the selftest user to share bob's short id, got %+v", users)
+	}
+	if _, err := cf.RemoveUser("reality-in", "selftest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddUser("lan-socks", "dave", ""); err == nil {
+		t.Fatal("socks users need a password, they can't be added")
+	}
+	if err := cf.AddUser("missing-in", "dave", ""); err == nil {
+		t.Fatal("users can't be added to undefined inbounds")
+	}
+	if removed, err := cf.RemoveUser("", "bob"); err != nil || removed != 2 {
+		t.Fatalf("expected bob removed from 2 inbounds, got %d, %v", removed, err)
+	}
+	if err := cf.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "# keep me") {
+		t.Fatal("comments should survive saving")
+	}
+	cf, err = LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := cf.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "carol" || users[0].Inbound != "reality-in" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+	carol := users[0]
+	if len(carol.UUID) != 36 || len(carol.ShortID) != 8 {
+		t.Fatalf("expected generated uuid and short id, got %+v", carol)
+	}
+
+	if _, err := cf.RotateUser("reality-in", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	links, err := cf.UserLinks("", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := links["reality-in"].MarshalLink()
+	if strings.Contains(link, carol.UUID) || !strings.Contains(link, "flow=xtls-rprx-vision") {
+		t.Fatalf("expected a rotated uuid and the flow in %s", link)
+	}
+}
+
+func TestParseUserTrafficMetrics(t *testing.T) {
+	metrics := `# TYPE reflector_user_traffic_bytes_total counter
+reflector_user_traffic_bytes_total{user="bob",direction="downlink"} 2048
+reflector_user_traffic_bytes_total{user="bob",direction="uplink"} 1024
+reflector_inbound_traffic_bytes_total{inbound="vless-in",direction="uplink"} 1
+`
+	traffic, err := parseUserTrafficMetrics(bufio.NewScanner(strings.NewReader(metrics)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffic) != 1 || traffic["bob"].Uplink != 1024 || traffic["bob"].Downlink != 2048 {
+		t.Fatalf("unexpected traffic %+v", traffic)
+	}
+}
+
+func TestConfigFileCheckLink(t *testing.T) {
+	cf, err := LoadConfigFile(writeTestConfigFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := cf.UserLinks("reality-in", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xl, err := xray.ParseXrayLink(links["reality-in"].MarshalLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound, user, mismatches, err := cf.CheckLink(xl)
+	if err != nil || inbound != "reality-in" || user != "bob" || len(mismatches) != 0 {
+		t.Fatalf("expected an exact match, got %s %s %v %v", inbound, user, mismatches, err)
+	}
+
+	xl.Parameters.ShortID = "deadbeef"
+	if _, _, mismatches, _ := cf.CheckLink(xl); len(mismatches) != 1 || !strings.HasPrefix(mismatches[0], "sid:") {
+		t.Fatalf("expected a short id mismatch, got %v", mismatches)
+	}
+	xl.Port = 1
+	if _, _, _, err := cf.CheckLink(xl); err == nil {
+		t.Fatal("links to unknown ports should not match")
+	}
+}
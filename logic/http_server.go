@@ -9,8 +9,16 @@ import (
 type HTTPServer interface {
 	Start()
 	Reload()
-	AddRootStaticLocation(domain string, httpsPort int, staticDir string)
-	AddProxyLocation(domain string, httpsPort int, url string, proxyTarget string)
+	AddRootStaticLocation(domain string, listen string, httpsPort int, staticDir string)
+	AddProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string)
+	AddDecoyProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string)
+	AddMatchedProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string, match caddy.ProxyMatch)
+	AddGRPCProxyLocation(domain string, listen string, httpsPort int, url string, proxyTarget string)
+	AddRootProxyLocation(domain string, listen string, httpsPort int, proxyTarget string, hide []string)
+	AddTryFiles(domain string, listen string, httpsPort int, staticDir string, tryFiles []string)
+	SetResponseHeaders(domain string, listen string, httpsPort int, set map[string]string, remove []string)
+	AddErrorPages(domain string, listen string, httpsPort int, staticDir string, pages map[int]string)
+	SetProtocols(domain string, listen string, httpsPort int, protocols []string)
 	Stop()
 }
 
@@ -0,0 +1,130 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflector/utils"
+	"reflector/xray"
+	"slices"
+	"strings"
+)
+
+// Client links are built from the spec alone, this way they are available
+// without a running xray, reality inbounds require the private_key to be set
+func (spec *reflectorConfigV1Spec) inboundUserLink(
+	inb *reflectorConfigV1SpecInbound,
+	user *reflectorConfigV1SpecInboundUser,
+) (*xray.XrayLink, error) {
+	if inb.Type != "vless" && inb.Type != "vmess" {
+		return nil, fmt.Errorf("client links are not available for %s inbounds", inb.Type)
+	}
+	host := utils.ListenHost(inb.Listen)
+	camoSpec, hasCamo := spec.Camos[inb.Camo]
+	if inb.Camo != "" && !hasCamo {
+		return nil, fmt.Errorf("undefined camo: %s", inb.Camo)
+	}
+	if hasCamo {
+		host = camoSpec.FQDN
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil, errors.New("inbound has no public address, set a camo or a listen address")
+	}
+
+	xl := xray.NewXrayLink(inb.Type, user.UUID, host, inb.ListenPort, user.Name)
+	if inb.Type == "vless" {
+		xl.Parameters.Flow = user.Flow
+	}
+
+	// security
+	if hasCamo {
+		xl.Parameters.SNI = camoSpec.FQDN
+		xl.Parameters.Fingerprint = "chrome"
+		switch camoSpec.Security {
+		case "reality":
+			if inb.PrivateKey == "" {
+				return nil, errors.New("reality inbound has no private_key")
+			}
+			pubkey, err := xray.DeriveRealityX25519PublicKey(inb.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			xl.Parameters.Security = "reality"
+			xl.Parameters.PublicKey = pubkey
+			xl.Parameters.ShortID = user.ShortID
+		case "wtls":
+			xl.Parameters.Security = "tls"
+		}
+	} else {
+		xl.Parameters.Security = "none"
+	}
+
+	// transport
+	xl.Parameters.Type = inb.Transport
+	switch inb.Transport {
+	case "xhttp":
+		xl.Parameters.Path = inb.XHTTPPath
+		xl.Parameters.Mode = inb.XHTTP.Mode
+		if xl.Parameters.Mode == "" {
+			xl.Parameters.Mode = "packet-up"
+		}
+		xl.Parameters.Host = inb.XHTTP.Host
+		extra := &xray.XHTTPExtra{
+			Headers:       inb.XHTTP.Headers,
+			XPaddingBytes: inb.XHTTP.Padding,
+		}
+		if !inb.Match.isEmpty() && inb.matchApplies(spec) {
+			extra.Headers = matchHeaders(inb.XHTTP.Headers, inb.Match)
+			if len(inb.Match.Query) > 0 {
+				query := url.Values{}
+				for name, value := range inb.Match.Query {
+					query.Set(name, value)
+				}
+				// xray sends the query of the path with every request
+				xl.Parameters.Path += "?" + query.Encode()
+			}
+		}
+		if x := inb.XHTTP.Xmux; x != nil {
+			extra.Xmux = &xray.XHTTPXmux{
+				MaxConcurrency:   x.MaxConcurrency,
+				MaxConnections:   x.MaxConnections,
+				CMaxReuseTimes:   x.CMaxReuseTimes,
+				HMaxRequestTimes: x.HMaxRequestTimes,
+				HMaxReusableSecs: x.HMaxReusableSecs,
+				HKeepAlivePeriod: x.HKeepAlivePeriod,
+			}
+		}
+		xl.Parameters.Extra = extra.Marshal()
+	case "ws", "httpupgrade":
+		xl.Parameters.Path = inb.Path
+	case "grpc":
+		xl.Parameters.ServiceName = inb.ServiceName
+	}
+	if xl.Parameters.Host == "" && hasCamo && camoSpec.Security == "wtls" &&
+		inb.Transport != "tcp" && inb.Transport != "grpc" {
+		xl.Parameters.Host = camoSpec.FQDN
+	}
+	return xl, nil
+}
+
+// xhttp headers plus the ones a match requires, cookies go in one Cookie
+// header
+func matchHeaders(headers map[string]string, match reflectorConfigV1SpecInboundMatch) map[string]string {
+	merged := map[string]string{}
+	for name, value := range headers {
+		merged[name] = value
+	}
+	for name, value := range match.Headers {
+		merged[name] = value
+	}
+	cookies := []string{}
+	for name, value := range match.Cookies {
+		cookies = append(cookies, name+"="+value)
+	}
+	if len(cookies) > 0 {
+		slices.Sort(cookies)
+		merged["Cookie"] = strings.Join(cookies, "; ")
+	}
+	return merged
+}
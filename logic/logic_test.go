@@ -0,0 +1,180 @@
+package logic
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testConfig = `
+apiVersion: v1
+kind: Reflector
+spec:
+  camos:
+    web:
+      security: wtls
+      template: ./camo
+      fqdn: example.com
+    stolen:
+      security: reality
+      fqdn: google.com
+  inbounds:
+    - name: xhttp-in
+      type: vless
+      camo: web
+      listen_port: 443
+      transport: xhttp
+      xhttpPath: /secondsbeforedawn
+      xhttp:
+        mode: stream-one
+        headers:
+          X-Example: value
+        xmux:
+          max_concurrency: 16-32
+      users:
+        - name: bob
+          uuid: bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb
+    - name: reality-in
+      type: vless
+      camo: stolen
+      listen_port: 8443
+      transport: tcp
+      private_key: KMDYAHPo2W2ycEGSEhRV7KWDgKcL6vjvgw57iPdsF0g
+      users:
+        - name: bob
+          uuid: bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb
+          flow: xtls-rprx-vision
+          short_id: b0b01d
+    - name: lan-socks
+      type: socks
+      listen_port: 1080
+`
+
+func loadTestConfig(t *testing.T) *reflectorConfigV1 {
+	t.Helper()
+	rc := &reflectorConfigV1{}
+	if err := yaml.Unmarshal([]byte(testConfig), rc); err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func TestInboundUserLinkXHTTP(t *testing.T) {
+	rc := loadTestConfig(t)
+	inb := &rc.Spec.Inbounds[0]
+	link, err := rc.Spec.inboundUserLink(inb, &inb.Users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link.MarshalLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	expected := map[string]string{
+		"security": "tls",
+		"sni":      "example.com",
+		"type":     "xhttp",
+		"path":     "/secondsbeforedawn",
+		"mode":     "stream-one",
+		"host":     "example.com",
+	}
+	for key, value := range expected {
+		if q.Get(key) != value {
+			t.Fatalf("expected %s=%s, got %s", key, value, q.Get(key))
+		}
+	}
+	if !strings.Contains(q.Get("extra"), `"maxConcurrency":"16-32"`) ||
+		!strings.Contains(q.Get("extra"), `"X-Example":"value"`) {
+		t.Fatalf("extra is missing xmux or headers: %s", q.Get("extra"))
+	}
+}
+
+func TestInboundUserLinkMatch(t *testing.T) {
+	rc := loadTestConfig(t)
+	inb := &rc.Spec.Inbounds[0]
+	inb.Match = reflectorConfigV1SpecInboundMatch{
+		Headers:   map[string]string{"X-Token": "t0k3n"},
+		Cookies:   map[string]string{"sid": "abc", "lang": "en"},
+		Query:     map[string]string{"v": "2"},
+		ClientIPs: []string{"10.0.0.0/8"},
+	}
+	link, err := rc.Spec.inboundUserLink(inb, &inb.Users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Parameters.Path != "/secondsbeforedawn?v=2" {
+		t.Fatalf("query should be part of the path, got %s", link.Parameters.Path)
+	}
+	for _, header := range []string{`"X-Example":"value"`, `"X-Token":"t0k3n"`, `"Cookie":"lang=en; sid=abc"`} {
+		if !strings.Contains(link.Parameters.Extra, header) {
+			t.Fatalf("extra is missing %s: %s", header, link.Parameters.Extra)
+		}
+	}
+	if inb.XHTTP.Headers["X-Token"] != "" {
+		t.Fatal("match headers should not change the xhttp headers")
+	}
+}
+
+func TestInboundUserLinkReality(t *testing.T) {
+	rc := loadTestConfig(t)
+	inb := &rc.Spec.Inbounds[1]
+	link, err := rc.Spec.inboundUserLink(inb, &inb.Users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Parameters.PublicKey == "" ||
+		link.Parameters.ShortID != "b0b01d" ||
+		link.Parameters.Flow != "xtls-rprx-vision" {
+		t.Fatalf("unexpected reality parameters: %+v", link.Parameters)
+	}
+	if link.Host != "google.com" || link.Port != 8443 {
+		t.Fatalf("unexpected link address %s:%d", link.Host, link.Port)
+	}
+}
+
+func TestInboundUserLinkUnsupported(t *testing.T) {
+	rc := loadTestConfig(t)
+	inb := &rc.Spec.Inbounds[2]
+	if _, err := rc.Spec.inboundUserLink(inb, &reflectorConfigV1SpecInboundUser{}); err == nil {
+		t.Fatalf("socks inbounds should not produce links")
+	}
+}
+
+func TestValidateOutboundChain(t *testing.T) {
+	outbounds := map[string]reflectorConfigV1SpecOutbound{
+		"direct": {Name: "direct", Type: "direct"},
+		"hop":    {Name: "hop", Type: "socks", Via: "exit"},
+		"exit":   {Name: "exit", Type: "link"},
+		"a":      {Name: "a", Type: "socks", Via: "b"},
+		"b":      {Name: "b", Type: "socks", Via: "a"},
+		"lost":   {Name: "lost", Type: "socks", Via: "missing"},
+	}
+	for name, valid := range map[string]bool{"direct": true, "hop": true, "a": false, "lost": false} {
+		if err := validateOutboundChain(outbounds[name], outbounds); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", name, valid, err)
+		}
+	}
+}
+
+func TestInboundUserLinkListen(t *testing.T) {
+	rc := loadTestConfig(t)
+	inb := &rc.Spec.Inbounds[0]
+	inb.Camo = ""
+	inb.Listen = "[2001:db8::1]"
+	link, err := rc.Spec.inboundUserLink(inb, &inb.Users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "2001:db8::1" {
+		t.Fatalf("link host should not keep the brackets, got %s", link.Host)
+	}
+	for _, listen := range []string{"", "::", "[::]"} {
+		inb.Listen = listen
+		if _, err := rc.Spec.inboundUserLink(inb, &inb.Users[0]); err == nil {
+			t.Fatalf("listen %q has no public address", listen)
+		}
+	}
+}
@@ -1,19 +1,37 @@
 package logic
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"os/signal"
 	"reflector/caddy"
 	"reflector/camo"
 	"reflector/log"
 	"reflector/xray"
+	"sync"
 	"syscall"
 )
 
 type reflector struct {
-	Caddy          *caddy.PortableCaddy
-	XrayCore       *xray.PortableXray
-	CamoController *camo.CamoController
+	Caddy              *caddy.PortableCaddy
+	XrayCore           *xray.PortableXray
+	CamoController     *camo.CamoController
+	xrayAPI            *xray.XrayAPIClient
+	xrayAPIPort        int
+	metricsServer      *http.Server
+	quota              *quotaEnforcer
+	quotaCancel        context.CancelFunc
+	subscription       *subscriptionHandler
+	subscriptionServer *http.Server
+	// proxy:// camo mirrors by template
+	mirrorServers map[string]*http.Server
+	// inbound clients per user name, to take them out and back on quota changes
+	userClients map[string][]userClientRef
+	configLock  sync.Mutex
+	// reality dest check results by dest and server names, the handshakes
+	// are only made once
+	realityDests map[string]error
 }
 
 func NewReflector(caddyVersion, xrayVersion string) *reflector {
@@ -21,6 +39,9 @@ func NewReflector(caddyVersion, xrayVersion string) *reflector {
 		Caddy:          caddy.NewPortableCaddy(caddyVersion),
 		XrayCore:       xray.NewPortableXray(xrayVersion),
 		CamoController: camo.NewCamoController(),
+		userClients:    make(map[string][]userClientRef),
+		mirrorServers:  make(map[string]*http.Server),
+		realityDests:   make(map[string]error),
 	}
 }
 
@@ -28,18 +49,48 @@ func (r *reflector) Start() {
 	r.XrayCore.Start()
 	r.Caddy.Start()
 	r.Caddy.Reload()
+	r.startMetrics()
+	r.startQuota()
+	r.startSubscription()
+	r.startMirrors()
 	log.GetDefaultLogger().Info().Msg("reflector started")
 }
 
 func (r *reflector) Stop() {
+	r.stopMetrics()
+	r.stopSubscription()
+	r.stopMirrors()
+	r.stopQuota()
 	r.Caddy.Stop()
 	r.XrayCore.Stop()
+	if r.xrayAPI != nil {
+		r.xrayAPI.Close()
+	}
 }
 
-func (r *reflector) RunWithSignalHandling() {
+// SIGHUP reloads users from configPath, SIGINT and SIGTERM stop reflector
+func (r *reflector) RunWithSignalHandling(configPath string) {
 	r.Start()
 	defer r.Stop()
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			return
+		}
+		config, err := os.Open(configPath)
+		if err != nil {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Update("path", configPath).
+				Msg("failed to open config for reload")
+			continue
+		}
+		if err := r.ReloadUsers(config); err != nil {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Msg("failed to reload users")
+		}
+		config.Close()
+	}
 }
@@ -0,0 +1,208 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflector/log"
+	"reflector/utils"
+	"reflector/xray"
+	"sort"
+	"strings"
+	"time"
+)
+
+type statsQuerier interface {
+	QueryStats(ctx context.Context, pattern string, reset bool) (map[string]int64, error)
+}
+
+type processState interface {
+	IsRunning() bool
+	Restarts() int
+}
+
+// Prometheus text format exporter over xray stats and process states
+type metricsExporter struct {
+	stats     statsQuerier
+	processes map[string]processState
+}
+
+func newMetricsExporter(stats statsQuerier, processes map[string]processState) *metricsExporter {
+	return &metricsExporter{stats: stats, processes: processes}
+}
+
+type metricsFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (mf *metricsFamily) add(value int64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabelValue(labels[i+1])))
+	}
+	if len(pairs) == 0 {
+		mf.samples = append(mf.samples, fmt.Sprintf("%s %d", mf.name, value))
+		return
+	}
+	mf.samples = append(mf.samples, fmt.Sprintf("%s{%s} %d", mf.name, strings.Join(pairs, ","), value))
+}
+
+func (mf *metricsFamily) writeTo(buf *bytes.Buffer) {
+	if len(mf.samples) == 0 {
+		return
+	}
+	sort.Strings(mf.samples)
+	fmt.Fprintf(buf, "# HELP %s %s\n", mf.name, mf.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", mf.name, mf.typ)
+	for _, sample := range mf.samples {
+		buf.WriteString(sample + "\n")
+	}
+}
+
+func (me *metricsExporter) render(ctx context.Context) []byte {
+	processUp := &metricsFamily{
+		name: "reflector_process_up",
+		help: "Whether the managed process is running.",
+		typ:  "gauge",
+	}
+	processRestarts := &metricsFamily{
+		name: "reflector_process_restarts_total",
+		help: "Restarts of the managed process performed by reflector.",
+		typ:  "counter",
+	}
+	statsUp := &metricsFamily{
+		name: "reflector_xray_stats_up",
+		help: "Whether the last xray stats query succeeded.",
+		typ:  "gauge",
+	}
+	traffic := map[string]*metricsFamily{}
+	for _, kind := range []string{"user", "inbound", "outbound"} {
+		traffic[kind] = &metricsFamily{
+			name: fmt.Sprintf("reflector_%s_traffic_bytes_total", kind),
+			help: fmt.Sprintf("Traffic per %s as counted by xray.", kind),
+			typ:  "counter",
+		}
+	}
+
+	for name, process := range me.processes {
+		up := int64(0)
+		if process.IsRunning() {
+			up = 1
+		}
+		processUp.add(up, "process", name)
+		processRestarts.add(int64(process.Restarts()), "process", name)
+	}
+
+	stats, err := me.stats.QueryStats(ctx, "", false)
+	if err != nil {
+		log.GetDefaultLogger().Debug().
+			Update("err", err.Error()).
+			Msg("failed to query xray stats")
+		statsUp.add(0)
+	} else {
+		statsUp.add(1)
+	}
+	for statName, value := range stats {
+		kind, tag, direction, ok := xray.ParseStatName(statName)
+		family, known := traffic[kind]
+		if !ok || !known || (kind == "inbound" && tag == xray.APIInboundTag) {
+			continue
+		}
+		family.add(value, kind, tag, "direction", direction)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, family := range []*metricsFamily{
+		processUp, processRestarts, statsUp,
+		traffic["user"], traffic["inbound"], traffic["outbound"],
+	} {
+		family.writeTo(buf)
+	}
+	return buf.Bytes()
+}
+
+func (me *metricsExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(me.render(ctx))
+}
+
+// Loopback xray API, shared by everything that needs to talk to a running xray
+func (r *reflector) ensureXrayAPI(services ...string) error {
+	if r.xrayAPI == nil {
+		ports, err := utils.FindFreePorts(1)
+		if err != nil {
+			return err
+		}
+		r.xrayAPIPort = ports[0]
+		client, err := xray.NewXrayAPIClient(fmt.Sprintf("127.0.0.1:%d", r.xrayAPIPort))
+		if err != nil {
+			return err
+		}
+		r.xrayAPI = client
+	}
+	r.XrayCore.XrayConfig.EnableAPI("127.0.0.1", r.xrayAPIPort, services...)
+	return nil
+}
+
+func (r *reflector) setupMetrics(spec reflectorConfigV1SpecMetrics) error {
+	if spec.Port == 0 {
+		return nil
+	}
+	if err := r.ensureXrayAPI(xray.StatsServiceName); err != nil {
+		return err
+	}
+	r.XrayCore.XrayConfig.EnableStats()
+
+	// usernames are exposed, keep metrics private unless asked otherwise
+	listen := spec.Listen
+	if listen == "" {
+		listen = "127.0.0.1"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsExporter(r.xrayAPI, map[string]processState{
+		"xray":  r.XrayCore,
+		"caddy": r.Caddy,
+	}))
+	r.metricsServer = &http.Server{
+		Addr:    utils.ListenAddress(listen, spec.Port),
+		Handler: mux,
+	}
+	return nil
+}
+
+func (r *reflector) startMetrics() {
+	if r.metricsServer == nil {
+		return
+	}
+	go func() {
+		err := r.metricsServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Update("address", r.metricsServer.Addr).
+				Msg("metrics server failed")
+		}
+	}()
+	log.GetDefaultLogger().Info().
+		Update("address", r.metricsServer.Addr).
+		Msg("serving metrics")
+}
+
+func (r *reflector) stopMetrics() {
+	if r.metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.metricsServer.Shutdown(ctx)
+}
@@ -0,0 +1,107 @@
+package logic
+
+import (
+	"context"
+	"net"
+	"reflector/xray"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// xray StatsService stand-in, only QueryStats is implemented
+type fakeStatsServer struct {
+	stats map[string]int64
+}
+
+func startFakeStatsServer(t *testing.T, stats map[string]int64) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(xray.APICodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: xray.StatsServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "QueryStats",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				req := &xray.QueryStatsRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				resp := &xray.QueryStatsResponse{}
+				for name, value := range srv.(*fakeStatsServer).stats {
+					if strings.Contains(name, req.Pattern) {
+						resp.Stat = append(resp.Stat, &xray.Stat{Name: name, Value: value})
+					}
+				}
+				return resp, nil
+			},
+		}},
+	}, &fakeStatsServer{stats: stats})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+type fakeProcess struct {
+	running  bool
+	restarts int
+}
+
+func (fp *fakeProcess) IsRunning() bool { return fp.running }
+func (fp *fakeProcess) Restarts() int   { return fp.restarts }
+
+func TestMetricsExporter(t *testing.T) {
+	address := startFakeStatsServer(t, map[string]int64{
+		"user>>>bob>>>traffic>>>uplink":         100,
+		"user>>>bob>>>traffic>>>downlink":       2000,
+		"inbound>>>vless-in>>>traffic>>>uplink": 150,
+		"inbound>>>api>>>traffic>>>uplink":      10,
+	})
+	client, err := xray.NewXrayAPIClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	exporter := newMetricsExporter(client, map[string]processState{
+		"xray": &fakeProcess{running: true, restarts: 2},
+	})
+	metrics := string(exporter.render(context.Background()))
+	t.Log(metrics)
+	for _, expected := range []string{
+		`reflector_process_up{process="xray"} 1`,
+		`reflector_process_restarts_total{process="xray"} 2`,
+		`reflector_xray_stats_up 1`,
+		`reflector_user_traffic_bytes_total{user="bob",direction="uplink"} 100`,
+		`reflector_user_traffic_bytes_total{user="bob",direction="downlink"} 2000`,
+		`reflector_inbound_traffic_bytes_total{inbound="vless-in",direction="uplink"} 150`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("missing %s", expected)
+		}
+	}
+	if strings.Contains(metrics, `inbound="api"`) {
+		t.Fatalf("api inbound should not be exported")
+	}
+}
+
+func TestMetricsExporterStatsDown(t *testing.T) {
+	client, err := xray.NewXrayAPIClient("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exporter := newMetricsExporter(client, map[string]processState{
+		"xray": &fakeProcess{running: false},
+	})
+	metrics := string(exporter.render(context.Background()))
+	if !strings.Contains(metrics, "reflector_xray_stats_up 0") ||
+		!strings.Contains(metrics, `reflector_process_up{process="xray"} 0`) {
+		t.Fatalf("unexpected metrics:\n%s", metrics)
+	}
+}
@@ -0,0 +1,58 @@
+package logic
+
+import (
+	"context"
+	"net/http"
+	"reflector/camo"
+	"reflector/log"
+	"reflector/utils"
+	"time"
+)
+
+// Address of the in-process mirror of a proxy:// template, camos sharing a
+// template share the mirror and its cache. Caddy proxies to it over loopback
+// since a stock caddy has no handler to rewrite the upstream's links.
+func (r *reflector) mirrorAddress(template string) (string, error) {
+	if server, exists := r.mirrorServers[template]; exists {
+		return server.Addr, nil
+	}
+	mirror, err := camo.NewMirror(template)
+	if err != nil {
+		return "", err
+	}
+	ports, err := utils.FindFreePorts(1)
+	if err != nil {
+		return "", err
+	}
+	r.mirrorServers[template] = &http.Server{
+		Addr:    utils.ListenAddress("127.0.0.1", ports[0]),
+		Handler: mirror,
+	}
+	log.GetDefaultLogger().Info().
+		Update("upstream", mirror.Upstream().String()).
+		Update("address", r.mirrorServers[template].Addr).
+		Msg("mirroring camo upstream")
+	return r.mirrorServers[template].Addr, nil
+}
+
+func (r *reflector) startMirrors() {
+	for template, server := range r.mirrorServers {
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.GetDefaultLogger().Error().
+					Update("err", err.Error()).
+					Update("template", template).
+					Msg("mirror server failed")
+			}
+		}()
+	}
+}
+
+func (r *reflector) stopMirrors() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range r.mirrorServers {
+		server.Shutdown(ctx)
+	}
+}
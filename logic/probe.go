@@ -0,0 +1,95 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflector/log"
+	"reflector/probe"
+	"strconv"
+	"strings"
+)
+
+// Probe targets of every listen port that serves a camo with fqdn, address
+// replaces the host that is dialed and is required for reality inbounds that
+// listen on every interface
+func (cf *ConfigFile) ProbeTargets(fqdn string, address string) ([]probe.Target, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	targets := []probe.Target{}
+	targetByPort := map[int]int{}
+	for _, inb := range spec.Inbounds {
+		camoSpec, exists := spec.Camos[inb.Camo]
+		if !exists || camoSpec.FQDN != fqdn {
+			continue
+		}
+		prefix := ""
+		switch inb.Transport {
+		case "xhttp":
+			prefix = inb.XHTTPPath
+		case "ws", "httpupgrade":
+			prefix = inb.Path
+		case "grpc":
+			prefix = "/" + inb.ServiceName + "/"
+		}
+		if i, exists := targetByPort[inb.ListenPort]; exists {
+			if prefix != "" {
+				targets[i].PathPrefixes = append(targets[i].PathPrefixes, prefix)
+			}
+			continue
+		}
+
+		host := address
+		if host == "" {
+			switch {
+			case camoSpec.Security == "wtls":
+				host = fqdn
+			case net.ParseIP(inb.Listen) != nil && !net.ParseIP(inb.Listen).IsUnspecified():
+				host = inb.Listen
+			default:
+				return nil, fmt.Errorf("%s listens on every address, pass the address of the server", inb.Name)
+			}
+		}
+		target := probe.Target{
+			FQDN:    fqdn,
+			Address: net.JoinHostPort(host, strconv.Itoa(inb.ListenPort)),
+			Reality: camoSpec.Security == "reality",
+			// the certificate to compare with comes from the dest
+			RealAddress: camoSpec.Dest,
+		}
+		if prefix != "" {
+			target.PathPrefixes = []string{prefix}
+		}
+		targetByPort[inb.ListenPort] = len(targets)
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no inbound uses a camo with fqdn %s", fqdn)
+	}
+	return targets, nil
+}
+
+// Live handshakes against dest with every server name, a dest that was
+// already checked returns the earlier result
+func (r *reflector) checkRealityDest(camoName string, dest string, serverNames []string) error {
+	key := dest + " " + strings.Join(serverNames, ",")
+	if err, checked := r.realityDests[key]; checked {
+		return err
+	}
+	handshakes, err := probe.CheckRealityDest(context.Background(), dest, serverNames, probe.RealityScanOptions{})
+	r.realityDests[key] = err
+	for _, handshake := range handshakes {
+		log.GetDefaultLogger().
+			Info().
+			Update("camo_name", camoName).
+			Update("dest", dest).
+			Update("server_name", handshake.ServerName).
+			Update("version", handshake.Version).
+			Update("curve", handshake.Curve).
+			Update("sans", handshake.SANs).
+			Msg("reality dest handshake")
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package logic
+
+import (
+	"errors"
+	"reflector/camo"
+	"reflector/xray"
+	"strings"
+	"testing"
+)
+
+func TestProbeTargets(t *testing.T) {
+	cf, err := LoadConfigFile(writeTestConfigFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := cf.ProbeTargets("example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Address != "example.com:443" || targets[0].Reality ||
+		len(targets[0].PathPrefixes) != 1 || targets[0].PathPrefixes[0] != "/secondsbeforedawn" {
+		t.Fatalf("unexpected wtls targets %+v", targets)
+	}
+
+	if _, err := cf.ProbeTargets("google.com", ""); err == nil {
+		t.Fatal("reality inbounds on every address need an explicit address")
+	}
+	targets, err = cf.ProbeTargets("google.com", "203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Address != "203.0.113.7:8443" || !targets[0].Reality {
+		t.Fatalf("unexpected reality targets %+v", targets)
+	}
+	if _, err := cf.ProbeTargets("missing.example", ""); err == nil {
+		t.Fatal("unknown fqdns should not produce targets")
+	}
+}
+
+func TestRealityDestFailureSkipsCamo(t *testing.T) {
+	// no binaries are needed to build the xray config
+	r := &reflector{
+		XrayCore:       &xray.PortableXray{XrayConfig: xray.NewXrayConfig()},
+		CamoController: camo.NewCamoController(),
+		realityDests:   map[string]error{"localhost:443 localhost": errors.New("no tls 1.3")},
+	}
+	config := `apiVersion: v1
+kind: Reflector
+spec:
+  camos:
+    stolen:
+      security: reality
+      fqdn: localhost
+  inbounds:
+    - name: reality-in
+      type: vless
+      camo: stolen
+      listen_port: 8443
+      transport: tcp
+      private_key: KMDYAHPo2W2ycEGSEhRV7KWDgKcL6vjvgw57iPdsF0g
+      users:
+        - name: bob
+          uuid: bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb
+          short_id: b0b01d
+    - name: lan-socks
+      type: socks
+      listen_port: 1080
+`
+	if err := r.ParseReflectorConfigV1(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := r.XrayCore.XrayConfig.Inbound("reality-in"); exists {
+		t.Fatal("inbounds of a camo with a failing dest should be skipped")
+	}
+}
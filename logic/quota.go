@@ -0,0 +1,462 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflector/log"
+	"reflector/utils"
+	"reflector/xray"
+	"slices"
+	"sync"
+	"time"
+)
+
+const quotaPollInterval = 30 * time.Second
+
+// Start of the current quota period, zero time when quotas never reset.
+// weekly reset_day is a weekday from 0 (sunday), monthly is a day of month
+// capped at 28 so that every month has it
+func quotaPeriodStart(now time.Time, reset string, resetDay int) time.Time {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	switch reset {
+	case "daily":
+		return today
+	case "weekly":
+		resetDay = ((resetDay % 7) + 7) % 7
+		return today.AddDate(0, 0, -((int(today.Weekday()) - resetDay + 7) % 7))
+	case "monthly":
+		resetDay = min(max(resetDay, 1), 28)
+		start := time.Date(y, m, resetDay, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	default:
+		return time.Time{}
+	}
+}
+
+// '2026-12-31' is valid through the whole day, RFC3339 is taken as is
+func parseExpiry(expires string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, expires); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, expires, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry should be YYYY-MM-DD or RFC3339: %w", err)
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+type userUsage struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+}
+
+func (uu userUsage) Total() int64 {
+	return uu.Uplink + uu.Downlink
+}
+
+type usageState struct {
+	PeriodStart time.Time             `json:"period_start"`
+	Users       map[string]*userUsage `json:"users"`
+}
+
+type quotaUser struct {
+	quota   int64
+	expires time.Time
+	blocked bool
+	// limits that don't parse block the user for good
+	invalid bool
+}
+
+// Tracks per user traffic from xray counters and blocks users that ran out
+// of quota or expired, totals are persisted to survive restarts
+type quotaEnforcer struct {
+	stats     statsQuerier
+	statePath string
+	reset     string
+	resetDay  int
+	users     map[string]*quotaUser
+	state     usageState
+	// xray counters restart with xray, deltas are taken against these
+	lastSeen map[string]int64
+	lock     sync.Mutex
+	block    func(name string)
+	unblock  func(name string)
+}
+
+func newQuotaEnforcer(
+	stats statsQuerier,
+	spec reflectorConfigV1SpecQuota,
+) *quotaEnforcer {
+	statePath := spec.StateFile
+	if statePath == "" {
+		statePath = "./reflector-usage.json"
+	}
+	qe := &quotaEnforcer{
+		stats:     stats,
+		statePath: statePath,
+		reset:     spec.Reset,
+		resetDay:  spec.ResetDay,
+		users:     make(map[string]*quotaUser),
+		state:     usageState{Users: make(map[string]*userUsage)},
+		lastSeen:  make(map[string]int64),
+		block:     func(string) {},
+		unblock:   func(string) {},
+	}
+	stateBytes, err := os.ReadFile(statePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Update("path", statePath).
+				Msg("failed to read usage state, starting from zero")
+		}
+		qe.state.PeriodStart = quotaPeriodStart(time.Now(), qe.reset, qe.resetDay)
+		return qe
+	}
+	if err := json.Unmarshal(stateBytes, &qe.state); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Update("path", statePath).
+			Msg("failed to parse usage state, starting from zero")
+	}
+	if qe.state.Users == nil {
+		qe.state.Users = make(map[string]*userUsage)
+	}
+	qe.rollPeriod(time.Now())
+	return qe
+}
+
+// quota 0 and zero expiry mean unlimited
+func (qe *quotaEnforcer) addUser(name string, quota int64, expires time.Time) {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	qu := &quotaUser{quota: quota, expires: expires}
+	qu.blocked = !qe.allowedLocked(name, qu, time.Now())
+	qe.users[name] = qu
+}
+
+// users whose limits are invalid stay blocked until the config is fixed
+func (qe *quotaEnforcer) rejectUser(name string) {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	qe.users[name] = &quotaUser{invalid: true, blocked: true}
+}
+
+// forgets every user not in names, they are no longer limited
+func (qe *quotaEnforcer) retainUsers(names []string) {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	for name := range qe.users {
+		if !slices.Contains(names, name) {
+			delete(qe.users, name)
+		}
+	}
+}
+
+func (qe *quotaEnforcer) allowedLocked(name string, qu *quotaUser, now time.Time) bool {
+	if qu.invalid {
+		return false
+	}
+	if !qu.expires.IsZero() && !now.Before(qu.expires) {
+		return false
+	}
+	if usage, exists := qe.state.Users[name]; qu.quota > 0 && exists && usage.Total() >= qu.quota {
+		return false
+	}
+	return true
+}
+
+func (qe *quotaEnforcer) isBlocked(name string) bool {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	qu, exists := qe.users[name]
+	return exists && qu.blocked
+}
+
+func (qe *quotaEnforcer) usage(name string) userUsage {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	if usage, exists := qe.state.Users[name]; exists {
+		return *usage
+	}
+	return userUsage{}
+}
+
+func (qe *quotaEnforcer) limits(name string) (quota int64, expires time.Time) {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	if qu, exists := qe.users[name]; exists {
+		return qu.quota, qu.expires
+	}
+	return 0, time.Time{}
+}
+
+func (qe *quotaEnforcer) rollPeriod(now time.Time) {
+	periodStart := quotaPeriodStart(now, qe.reset, qe.resetDay)
+	if !periodStart.After(qe.state.PeriodStart) {
+		return
+	}
+	log.GetDefaultLogger().Info().
+		Update("period_start", periodStart).
+		Msg("new quota period, resetting usage")
+	qe.state.PeriodStart = periodStart
+	qe.state.Users = make(map[string]*userUsage)
+}
+
+// counts the traffic since the last poll and blocks or restores users
+// whose limits changed
+func (qe *quotaEnforcer) poll(ctx context.Context, now time.Time) error {
+	if err := qe.collect(ctx, now); err != nil {
+		return err
+	}
+	qe.enforce(now)
+	return nil
+}
+
+// adds the xray counters to the totals and saves them, without blocking
+// anyone, xray restarts and shutdowns use it to keep the last traffic
+func (qe *quotaEnforcer) collect(ctx context.Context, now time.Time) error {
+	stats, err := qe.stats.QueryStats(ctx, "user>>>", false)
+	if err != nil {
+		return err
+	}
+
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	qe.rollPeriod(now)
+	for statName, value := range stats {
+		kind, name, direction, ok := xray.ParseStatName(statName)
+		if !ok || kind != "user" {
+			continue
+		}
+		delta := value - qe.lastSeen[statName]
+		if value < qe.lastSeen[statName] {
+			delta = value
+		}
+		qe.lastSeen[statName] = value
+		usage, exists := qe.state.Users[name]
+		if !exists {
+			usage = &userUsage{}
+			qe.state.Users[name] = usage
+		}
+		switch direction {
+		case "uplink":
+			usage.Uplink += delta
+		case "downlink":
+			usage.Downlink += delta
+		}
+	}
+	return qe.saveLocked()
+}
+
+func (qe *quotaEnforcer) enforce(now time.Time) {
+	qe.lock.Lock()
+	toBlock, toUnblock := []string{}, []string{}
+	for name, qu := range qe.users {
+		allowed := qe.allowedLocked(name, qu, now)
+		if !allowed && !qu.blocked {
+			qu.blocked = true
+			toBlock = append(toBlock, name)
+		}
+		if allowed && qu.blocked {
+			qu.blocked = false
+			toUnblock = append(toUnblock, name)
+		}
+	}
+	qe.lock.Unlock()
+
+	for _, name := range toBlock {
+		log.GetDefaultLogger().Info().
+			Update("user", name).
+			Msg("user ran out of quota or expired, removing")
+		qe.block(name)
+	}
+	for _, name := range toUnblock {
+		log.GetDefaultLogger().Info().
+			Update("user", name).
+			Msg("user quota was renewed, restoring")
+		qe.unblock(name)
+	}
+}
+
+func (qe *quotaEnforcer) saveLocked() error {
+	stateBytes, err := json.MarshalIndent(qe.state, "", "    ")
+	if err != nil {
+		return err
+	}
+	// write and rename, a crash mid-write must not lose the totals
+	tmpPath := filepath.Join(filepath.Dir(qe.statePath), "."+filepath.Base(qe.statePath)+".tmp")
+	if err := os.WriteFile(tmpPath, stateBytes, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, qe.statePath)
+}
+
+func (qe *quotaEnforcer) run(ctx context.Context) {
+	ticker := time.NewTicker(quotaPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := qe.poll(pollCtx, time.Now())
+			cancel()
+			if err != nil {
+				log.GetDefaultLogger().Warning().
+					Update("err", err.Error()).
+					Msg("quota poll failed")
+			}
+		}
+	}
+}
+
+type userClientRef struct {
+	inboundTag string
+	id         string
+	flow       string
+}
+
+func (r *reflector) setupQuota(spec *reflectorConfigV1Spec) error {
+	enabled := false
+	for _, inb := range spec.Inbounds {
+		for _, user := range inb.Users {
+			if user.Quota != "" || user.Expires != "" {
+				enabled = true
+			}
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	if err := r.ensureXrayAPI(xray.StatsServiceName, xray.HandlerServiceName); err != nil {
+		return err
+	}
+	r.XrayCore.XrayConfig.EnableStats()
+	r.quota = newQuotaEnforcer(r.xrayAPI, spec.Quota)
+	r.quota.block = r.removeUserClients
+	r.quota.unblock = r.restoreUserClients
+
+	seen := map[string]bool{}
+	for _, inb := range spec.Inbounds {
+		for _, user := range inb.Users {
+			if seen[user.Name] || (user.Quota == "" && user.Expires == "") {
+				continue
+			}
+			if inb.Type == "socks" || inb.Type == "http" {
+				log.GetDefaultLogger().Warning().
+					Update("inbound", inb.Name).
+					Update("user", user.Name).
+					Msg("quotas and expiry are not enforced on local proxy inbounds")
+				continue
+			}
+			seen[user.Name] = true
+			r.addQuotaUser(&user)
+		}
+	}
+	return nil
+}
+
+func userLimits(user *reflectorConfigV1SpecInboundUser) (quota int64, expires time.Time, err error) {
+	if user.Quota != "" {
+		if quota, err = utils.ParseSize(user.Quota); err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid quota: %w", err)
+		}
+	}
+	if user.Expires != "" {
+		if expires, err = parseExpiry(user.Expires); err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid expiry: %w", err)
+		}
+	}
+	return quota, expires, nil
+}
+
+// users with limits that don't parse are rejected rather than let through
+// without limits
+func (r *reflector) addQuotaUser(user *reflectorConfigV1SpecInboundUser) {
+	quota, expires, err := userLimits(user)
+	if err != nil {
+		log.GetDefaultLogger().Error().
+			Update("user", user.Name).
+			Update("err", err.Error()).
+			Msg("user has invalid limits, the user is not loaded")
+		r.quota.rejectUser(user.Name)
+		return
+	}
+	r.quota.addUser(user.Name, quota, expires)
+}
+
+func (r *reflector) removeUserClients(name string) {
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	for _, ref := range r.userClients[name] {
+		if inb, exists := r.XrayCore.XrayConfig.Inbound(ref.inboundTag); exists {
+			inb.RemoveClient(ref.id)
+		}
+	}
+	r.applyXrayClientChanges()
+}
+
+func (r *reflector) restoreUserClients(name string) {
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	for _, ref := range r.userClients[name] {
+		if inb, exists := r.XrayCore.XrayConfig.Inbound(ref.inboundTag); exists {
+			inb.EnsureClient(ref.id, ref.flow, name)
+		}
+	}
+	r.applyXrayClientChanges()
+}
+
+// client list changes are applied live when the api is on, restart otherwise
+func (r *reflector) applyXrayClientChanges() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// a restart zeroes the counters, the traffic since the last poll is
+	// counted first
+	if r.quota != nil {
+		if err := r.quota.collect(ctx, time.Now()); err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("err", err.Error()).
+				Msg("quota poll before applying client changes failed, recent usage may be lost")
+		}
+	}
+	if r.xrayAPI == nil {
+		r.XrayCore.Apply(ctx, nil)
+		return
+	}
+	r.XrayCore.Apply(ctx, r.xrayAPI)
+}
+
+func (r *reflector) startQuota() {
+	if r.quota == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.quotaCancel = cancel
+	go r.quota.run(ctx)
+}
+
+func (r *reflector) stopQuota() {
+	if r.quota == nil {
+		return
+	}
+	r.quotaCancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// counted only, blocking users now would restart xray while it stops
+	if err := r.quota.collect(ctx, time.Now()); err != nil {
+		log.GetDefaultLogger().Warning().
+			Update("err", err.Error()).
+			Msg("final quota poll failed, the last usage may be lost")
+	}
+}
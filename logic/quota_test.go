@@ -0,0 +1,189 @@
+package logic
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeStatsQuerier map[string]int64
+
+func (fsq fakeStatsQuerier) QueryStats(ctx context.Context, pattern string, reset bool) (map[string]int64, error) {
+	return fsq, nil
+}
+
+func TestQuotaPeriodStart(t *testing.T) {
+	// wednesday
+	now := time.Date(2026, 3, 11, 15, 30, 0, 0, time.UTC)
+	cases := []struct {
+		reset    string
+		resetDay int
+		expected time.Time
+	}{
+		{"never", 0, time.Time{}},
+		{"daily", 0, time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"weekly", 1, time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{"weekly", 3, time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"weekly", 4, time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"monthly", 0, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", 15, time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"monthly", 31, time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got := quotaPeriodStart(now, c.reset, c.resetDay)
+		if !got.Equal(c.expected) {
+			t.Errorf("%s/%d: expected %s, got %s", c.reset, c.resetDay, c.expected, got)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	expires, err := parseExpiry("2026-12-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastMoment := time.Date(2026, 12, 31, 23, 59, 59, 0, time.Local)
+	if !lastMoment.Before(expires) {
+		t.Errorf("expected the whole day to be valid, expires at %s", expires)
+	}
+	if _, err := parseExpiry("2026-12-31T12:00:00Z"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseExpiry("next week"); err == nil {
+		t.Error("expected an error for a malformed expiry")
+	}
+}
+
+func TestQuotaEnforcer(t *testing.T) {
+	stats := fakeStatsQuerier{}
+	qe := newQuotaEnforcer(stats, reflectorConfigV1SpecQuota{
+		Reset:     "daily",
+		StateFile: filepath.Join(t.TempDir(), "usage.json"),
+	})
+	blocked := map[string]bool{}
+	qe.block = func(name string) { blocked[name] = true }
+	qe.unblock = func(name string) { delete(blocked, name) }
+	qe.addUser("bob", 1000, time.Time{})
+	qe.addUser("alice", 0, time.Now().Add(-time.Hour))
+	if !qe.isBlocked("alice") || qe.isBlocked("bob") {
+		t.Fatal("expected only the expired user to start blocked")
+	}
+
+	now := time.Now()
+	stats["user>>>bob>>>traffic>>>uplink"] = 300
+	stats["user>>>bob>>>traffic>>>downlink"] = 400
+	if err := qe.poll(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if blocked["bob"] {
+		t.Fatal("bob is under quota")
+	}
+
+	// xray restarted, counters start over
+	stats["user>>>bob>>>traffic>>>uplink"] = 100
+	stats["user>>>bob>>>traffic>>>downlink"] = 200
+	if err := qe.poll(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if usage := qe.usage("bob"); usage.Total() != 1000 {
+		t.Fatalf("expected 1000 bytes used, got %d", usage.Total())
+	}
+	if !blocked["bob"] {
+		t.Fatal("bob should be blocked at quota")
+	}
+
+	// usage survives a restart of reflector
+	reloaded := newQuotaEnforcer(stats, reflectorConfigV1SpecQuota{
+		Reset:     "daily",
+		StateFile: qe.statePath,
+	})
+	reloaded.addUser("bob", 1000, time.Time{})
+	if !reloaded.isBlocked("bob") {
+		t.Fatal("expected persisted usage to keep bob blocked")
+	}
+
+	if err := qe.poll(context.Background(), now.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if blocked["bob"] {
+		t.Fatal("bob should be restored in the next period")
+	}
+}
+
+func TestQuotaEnforcerFailsClosed(t *testing.T) {
+	stats := fakeStatsQuerier{}
+	qe := newQuotaEnforcer(stats, reflectorConfigV1SpecQuota{
+		Reset:     "never",
+		StateFile: filepath.Join(t.TempDir(), "usage.json"),
+	})
+	r := &reflector{quota: qe}
+	r.addQuotaUser(&reflectorConfigV1SpecInboundUser{Name: "carol", Quota: "lots"})
+	r.addQuotaUser(&reflectorConfigV1SpecInboundUser{Name: "dave", Expires: "next week"})
+	if !qe.isBlocked("carol") || !qe.isBlocked("dave") {
+		t.Fatal("users with invalid limits should be blocked")
+	}
+
+	blocked := map[string]bool{}
+	qe.block = func(name string) { blocked[name] = true }
+	qe.addUser("bob", 100, time.Time{})
+	stats["user>>>bob>>>traffic>>>uplink"] = 200
+	// shutdowns and restarts only count
+	if err := qe.collect(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if blocked["bob"] || qe.usage("bob").Total() != 200 {
+		t.Fatalf("collect should count without blocking, usage %d", qe.usage("bob").Total())
+	}
+	qe.enforce(time.Now())
+	if !blocked["bob"] {
+		t.Fatal("bob should be blocked once enforced")
+	}
+}
+
+func TestReloadQuotaUsers(t *testing.T) {
+	stats := fakeStatsQuerier{}
+	qe := newQuotaEnforcer(stats, reflectorConfigV1SpecQuota{
+		Reset:     "never",
+		StateFile: filepath.Join(t.TempDir(), "usage.json"),
+	})
+	r := &reflector{quota: qe}
+	inbounds := []reflectorConfigV1SpecInbound{{
+		Name: "main",
+		Type: "vless",
+		Users: []reflectorConfigV1SpecInboundUser{
+			{Name: "bob", Quota: "100"},
+			{Name: "carol", Expires: "2000-01-01"},
+			{Name: "dave", Quota: "lots"},
+		},
+	}}
+	r.reloadQuotaUsers(inbounds)
+	stats["user>>>bob>>>traffic>>>uplink"] = 200
+	if err := qe.collect(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	qe.enforce(time.Now())
+	for _, name := range []string{"bob", "carol", "dave"} {
+		if !qe.isBlocked(name) {
+			t.Fatalf("%s should be blocked", name)
+		}
+	}
+
+	// bob's quota is removed, dave's fixed and carol is gone, then SIGHUP
+	inbounds[0].Users = []reflectorConfigV1SpecInboundUser{
+		{Name: "bob"},
+		{Name: "dave", Quota: "1GiB"},
+	}
+	r.reloadQuotaUsers(inbounds)
+	for _, name := range []string{"bob", "carol", "dave"} {
+		if qe.isBlocked(name) {
+			t.Fatalf("%s should no longer be blocked", name)
+		}
+	}
+	if _, exists := qe.users["carol"]; exists {
+		t.Fatal("removed users should be forgotten")
+	}
+	if quota, _ := qe.limits("bob"); quota != 0 {
+		t.Fatalf("bob should be unlimited, got quota %d", quota)
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"reflector/caddy"
+	"reflector/camo"
 	"reflector/log"
 	"reflector/utils"
+	"reflector/xray"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -52,6 +58,10 @@ type reflectorConfigV1Spec struct {
 	Outbounds []reflectorConfigV1SpecOutbound             `yaml:"outbounds,omitempty"`
 	Routes    []reflectorConfigV1SpecRoute                `yaml:"routes,omitempty"`
 	Metrics   reflectorConfigV1SpecMetrics                `yaml:"metrics,omitempty"`
+	Quota     reflectorConfigV1SpecQuota                  `yaml:"quota,omitempty"`
+	// per user subscription urls served on a wtls camo
+	Subscription reflectorConfigV1SpecSubscription `yaml:"subscription,omitempty"`
+	CamoCache    reflectorConfigV1SpecCamoCache    `yaml:"camo_cache,omitempty"`
 }
 
 // BEGIN INBOUND
@@ -64,14 +74,72 @@ type reflectorConfigV1SpecInbound struct {
 	Users      []reflectorConfigV1SpecInboundUser `yaml:"users"`
 	PrivateKey string                             `yaml:"private_key,omitempty"`
 	XHTTPPath  string                             `yaml:"xhttpPath,omitempty"`
-	Camo       string                             `yaml:"camo,omitempty"`
+	// ws/httpupgrade path
+	Path string `yaml:"path,omitempty"`
+	// grpc service name
+	ServiceName string                            `yaml:"service_name,omitempty"`
+	XHTTP       reflectorConfigV1SpecInboundXHTTP `yaml:"xhttp,omitempty"`
+	Camo        string                            `yaml:"camo,omitempty"`
+	// extra conditions on the xhttp path of a wtls camo, requests failing
+	// them get the decoy
+	Match reflectorConfigV1SpecInboundMatch `yaml:"match,omitempty"`
+	// outbound the traffic of the inbound leaves through, the first outbound
+	// by default
+	Outbound string `yaml:"outbound,omitempty"`
+}
+
+// headers, cookies and query are sent by clients through their links
+type reflectorConfigV1SpecInboundMatch struct {
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Cookies map[string]string `yaml:"cookies,omitempty"`
+	Query   map[string]string `yaml:"query,omitempty"`
+	// cidrs or addresses clients connect from
+	ClientIPs []string `yaml:"client_ips,omitempty"`
+}
+
+func (m reflectorConfigV1SpecInboundMatch) isEmpty() bool {
+	return len(m.Headers) == 0 && len(m.Cookies) == 0 && len(m.Query) == 0 && len(m.ClientIPs) == 0
+}
+
+// caddy checks the match, it only fronts xhttp of wtls camos
+func (inb *reflectorConfigV1SpecInbound) matchApplies(spec *reflectorConfigV1Spec) bool {
+	camoSpec, exists := spec.Camos[inb.Camo]
+	return inb.Transport == "xhttp" && exists && camoSpec.Security == "wtls"
+}
+
+// xhttp tuning, unset fields fall back to xray.TransportXHTTPAutoParams
+type reflectorConfigV1SpecInboundXHTTP struct {
+	Mode                 string                                 `yaml:"mode,omitempty"`
+	Padding              string                                 `yaml:"padding,omitempty"`
+	NoSSEHeader          bool                                   `yaml:"no_sse_header,omitempty"`
+	SCMaxBufferedPosts   int                                    `yaml:"sc_max_buffered_posts,omitempty"`
+	SCMaxEachPostBytes   string                                 `yaml:"sc_max_each_post_bytes,omitempty"`
+	SCStreamUpServerSecs string                                 `yaml:"sc_stream_up_server_secs,omitempty"`
+	Host                 string                                 `yaml:"host,omitempty"`
+	Headers              map[string]string                      `yaml:"headers,omitempty"`
+	Xmux                 *reflectorConfigV1SpecInboundXHTTPXmux `yaml:"xmux,omitempty"`
+}
+
+// client side connection multiplexing, only delivered through share links
+type reflectorConfigV1SpecInboundXHTTPXmux struct {
+	MaxConcurrency   string `yaml:"max_concurrency,omitempty"`
+	MaxConnections   string `yaml:"max_connections,omitempty"`
+	CMaxReuseTimes   string `yaml:"c_max_reuse_times,omitempty"`
+	HMaxRequestTimes string `yaml:"h_max_request_times,omitempty"`
+	HMaxReusableSecs string `yaml:"h_max_reusable_secs,omitempty"`
+	HKeepAlivePeriod int    `yaml:"h_keep_alive_period,omitempty"`
 }
 
 type reflectorConfigV1SpecInboundUser struct {
-	Name    string `yaml:"name"`
-	UUID    string `yaml:"uuid"`
-	Flow    string `yaml:"flow"`
-	ShortID string `yaml:"short_id"`
+	Name     string `yaml:"name"`
+	UUID     string `yaml:"uuid"`
+	Flow     string `yaml:"flow"`
+	ShortID  string `yaml:"short_id"`
+	Password string `yaml:"password,omitempty"`
+	// traffic limit per quota period, '50GiB', '500MB'
+	Quota string `yaml:"quota,omitempty"`
+	// last valid day, '2026-12-31', or an RFC3339 timestamp
+	Expires string `yaml:"expires,omitempty"`
 }
 
 // END INBOUND
@@ -80,11 +148,44 @@ type reflectorConfigV1SpecInboundCamo struct {
 	Security string `yaml:"security"`
 	Template string `yaml:"template,omitempty"`
 	FQDN     string `yaml:"fqdn"`
+	// wtls http versions, h1, h2, h3, caddy defaults to all of them
+	Protocols []string `yaml:"protocols,omitempty"`
+	// always, if-not-present (default), never
+	PullPolicy string `yaml:"pull_policy,omitempty"`
+	// PEM cosign public key, the template image must be signed with it
+	CosignKey string `yaml:"cosign_key,omitempty"`
+	// directory of the template that is served, e.g. /srv/www, all of it by default
+	Subdir string `yaml:"subdir,omitempty"`
+	// wtls response headers, e.g. remove: [Server]
+	Headers reflectorConfigV1SpecCamoHeaders `yaml:"headers,omitempty"`
+	// wtls status code to page of the template, <code>.html when it exists
+	ErrorPages map[int]string `yaml:"error_pages,omitempty"`
+	// wtls files tried in order, e.g. ['{path}', /index.html] for single page apps
+	TryFiles []string `yaml:"try_files,omitempty"`
+	// reality host:port handshakes are forwarded to, fqdn:443 by default
+	Dest string `yaml:"dest,omitempty"`
+	// reality snis clients may use, the fqdn is always one of them
+	ServerNames []string `yaml:"server_names,omitempty"`
+}
+
+type reflectorConfigV1SpecCamoHeaders struct {
+	Set    map[string]string `yaml:"set,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
 }
 
 type reflectorConfigV1SpecOutbound struct {
 	Name string `yaml:"name,omitempty"`
+	// direct, socks, http or link
 	Type string `yaml:"type,omitempty"`
+	// socks/http upstream proxy
+	Address  string `yaml:"address,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// vless:// or vmess:// client link, e.g. of another reflector
+	Link string `yaml:"link,omitempty"`
+	// outbound this one connects through, chains proxies
+	Via string `yaml:"via,omitempty"`
 }
 
 type reflectorConfigV1SpecRoute struct {
@@ -97,6 +198,33 @@ type reflectorConfigV1SpecMetrics struct {
 	Listen string `yaml:"listen,omitempty"`
 }
 
+type reflectorConfigV1SpecSubscription struct {
+	Camo string `yaml:"camo,omitempty"`
+	// url prefix, '/sub' by default
+	Path string `yaml:"path,omitempty"`
+	// tokens are derived from it, changing it revokes every subscription url
+	Secret string `yaml:"secret,omitempty"`
+	// hours between client refreshes, 12 by default
+	UpdateInterval int `yaml:"update_interval,omitempty"`
+}
+
+type reflectorConfigV1SpecCamoCache struct {
+	// unpacked templates, '/var/cache/reflector/camo' by default
+	Dir string `yaml:"dir,omitempty"`
+	// unused templates are pruned oldest first past it, '1GiB', unlimited if unset
+	MaxSize string `yaml:"max_size,omitempty"`
+	// unpacking a single template fails past it, '1GiB' by default
+	MaxTemplateSize string `yaml:"max_template_size,omitempty"`
+}
+
+type reflectorConfigV1SpecQuota struct {
+	// never, daily, weekly, monthly
+	Reset string `yaml:"reset,omitempty"`
+	// weekday for weekly (0 is sunday), day of month for monthly
+	ResetDay  int    `yaml:"reset_day,omitempty"`
+	StateFile string `yaml:"state_file,omitempty"`
+}
+
 func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 	rc := &reflectorConfigV1{}
 	configBytes, err := io.ReadAll(config)
@@ -119,10 +247,97 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 	for secOpt, _ := range possibleSecurityOptions {
 		possibleSecurityOptionsSlice = append(possibleSecurityOptionsSlice, secOpt)
 	}
+	possibleTransportOptions := map[string]bool{
+		"tcp":         true,
+		"xhttp":       true,
+		"ws":          true,
+		"httpupgrade": true,
+		"grpc":        true,
+	}
+	// reality can't carry transports that rely on http/1.1 upgrades
+	realityTransportOptions := map[string]bool{
+		"tcp":   true,
+		"xhttp": true,
+		"grpc":  true,
+	}
+	possibleTransportOptionsSlice := []string{}
+	for trOpt, _ := range possibleTransportOptions {
+		possibleTransportOptionsSlice = append(possibleTransportOptionsSlice, trOpt)
+	}
+	possibleXHTTPModeOptions := map[string]bool{
+		"auto":       true,
+		"packet-up":  true,
+		"stream-up":  true,
+		"stream-one": true,
+	}
+	possibleXHTTPModeOptionsSlice := []string{}
+	for modeOpt, _ := range possibleXHTTPModeOptions {
+		possibleXHTTPModeOptionsSlice = append(possibleXHTTPModeOptionsSlice, modeOpt)
+	}
+	possibleProtocolOptions := map[string]bool{
+		"h1": true,
+		"h2": true,
+		"h3": true,
+	}
+	possibleProtocolOptionsSlice := []string{}
+	for protoOpt, _ := range possibleProtocolOptions {
+		possibleProtocolOptionsSlice = append(possibleProtocolOptionsSlice, protoOpt)
+	}
+	possiblePullPolicyOptions := map[string]bool{
+		"always":         true,
+		"if-not-present": true,
+		"never":          true,
+	}
+	possiblePullPolicyOptionsSlice := []string{}
+	for pullOpt, _ := range possiblePullPolicyOptions {
+		possiblePullPolicyOptionsSlice = append(possiblePullPolicyOptionsSlice, pullOpt)
+	}
+	possibleQuotaResetOptions := map[string]bool{
+		"never":   true,
+		"daily":   true,
+		"weekly":  true,
+		"monthly": true,
+	}
+	possibleQuotaResetOptionsSlice := []string{}
+	for resetOpt, _ := range possibleQuotaResetOptions {
+		possibleQuotaResetOptionsSlice = append(possibleQuotaResetOptionsSlice, resetOpt)
+	}
+
+	if rc.Spec.CamoCache.Dir != "" {
+		r.CamoController.SetCamoDir(rc.Spec.CamoCache.Dir)
+	}
+	if rc.Spec.CamoCache.MaxSize != "" {
+		maxSize, err := utils.ParseSize(rc.Spec.CamoCache.MaxSize)
+		if err != nil {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Update("max_size", rc.Spec.CamoCache.MaxSize).
+				Msg("invalid camo cache size, the cache is not limited")
+		}
+		r.CamoController.SetMaxCacheSize(maxSize)
+	}
+	if rc.Spec.CamoCache.MaxTemplateSize != "" {
+		maxTemplateSize, err := utils.ParseSize(rc.Spec.CamoCache.MaxTemplateSize)
+		if err != nil {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Update("max_template_size", rc.Spec.CamoCache.MaxTemplateSize).
+				Msg("invalid camo template size, using the default")
+		} else {
+			r.CamoController.SetMaxTemplateSize(maxTemplateSize)
+		}
+	}
+
+	// every template of the config is in use before it is loaded
+	for _, camoSpec := range rc.Spec.Camos {
+		if camoSpec.Template != "" {
+			r.CamoController.KeepTemplate(camoSpec.Template)
+		}
+	}
 
 	// check and load all camo
-	for camoName, camo := range rc.Spec.Camos {
-		if _, exists := possibleSecurityOptions[camo.Security]; !exists {
+	for camoName, camoSpec := range rc.Spec.Camos {
+		if _, exists := possibleSecurityOptions[camoSpec.Security]; !exists {
 			log.GetDefaultLogger().
 				Error().
 				Msgf(
@@ -130,14 +345,42 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 					strings.Join(possibleSecurityOptionsSlice, ", "))
 			continue
 		}
+		validProtocols := []string{}
+		for _, protocol := range camoSpec.Protocols {
+			if _, exists := possibleProtocolOptions[protocol]; !exists {
+				log.GetDefaultLogger().
+					Error().
+					Update("camo_name", camoName).
+					Update("protocol", protocol).
+					Msgf(
+						"camo protocols should be any of: %s, dropping protocol",
+						strings.Join(possibleProtocolOptionsSlice, ", "))
+				continue
+			}
+			validProtocols = append(validProtocols, protocol)
+		}
+		if len(camoSpec.Protocols) > 0 && camoSpec.Security != localSecurityOption {
+			log.GetDefaultLogger().Warning().
+				Update("camo_name", camoName).
+				Msgf("protocols only apply to %s camos, ignoring", localSecurityOption)
+		}
+		if len(camoSpec.Protocols) > 0 && len(validProtocols) == 0 {
+			log.GetDefaultLogger().
+				Error().
+				Update("camo_name", camoName).
+				Msg("camo has no valid protocols, skipping camo")
+			continue
+		}
+		camoSpec.Protocols = validProtocols
+		rc.Spec.Camos[camoName] = camoSpec
 
-		addresses, err := utils.NSLookup(camo.FQDN)
+		addresses, err := utils.NSLookup(camoSpec.FQDN)
 		if err != nil {
 			log.GetDefaultLogger().
 				Error().
 				Update("err", err.Error()).
 				Update("camo_name", camoName).
-				Update("fqdn", camo.FQDN).
+				Update("fqdn", camoSpec.FQDN).
 				Msg("failed to lookup the camo fqdn, skipping camo")
 			continue
 		}
@@ -145,31 +388,107 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 			log.GetDefaultLogger().
 				Error().
 				Update("camo_name", camoName).
-				Update("fqdn", camo.FQDN).
+				Update("fqdn", camoSpec.FQDN).
 				Msg("fqdn resolves to 0 IPs, skipping camo")
 			continue
 		}
-		if !utils.IsDomainPointingToThisHost(camo.FQDN) {
+		if camoSpec.Security == "reality" {
+			if camoSpec.Dest == "" {
+				camoSpec.Dest = net.JoinHostPort(camoSpec.FQDN, "443")
+			}
+			if !slices.Contains(camoSpec.ServerNames, camoSpec.FQDN) {
+				camoSpec.ServerNames = append([]string{camoSpec.FQDN}, camoSpec.ServerNames...)
+			}
+			// xray starts fine with a bad dest, every client fails afterwards
+			if err := r.checkRealityDest(camoName, camoSpec.Dest, camoSpec.ServerNames); err != nil {
+				log.GetDefaultLogger().
+					Error().
+					Update("err", err.Error()).
+					Update("camo_name", camoName).
+					Update("dest", camoSpec.Dest).
+					Msg("reality dest can't be used, skipping camo")
+				delete(rc.Spec.Camos, camoName)
+				continue
+			}
+			rc.Spec.Camos[camoName] = camoSpec
+		}
+		if camoSpec.Security == localSecurityOption && !utils.IsDomainPointingToThisHost(camoSpec.FQDN) {
+			v4, v6 := utils.SplitIPFamilies(addresses)
 			log.GetDefaultLogger().Warning().
 				Update("camo_name", camoName).
-				Update("addresses", addresses).
-				Update("fqdn", camo.FQDN).
-				Msg("the fqdn does not point to this host")
+				Update("a", v4).
+				Update("aaaa", v6).
+				Update("fqdn", camoSpec.FQDN).
+				Msg("neither A nor AAAA records of the fqdn point to this host")
+		}
+		for code := range camoSpec.ErrorPages {
+			if code < 400 || code > 599 {
+				log.GetDefaultLogger().
+					Warning().
+					Update("camo_name", camoName).
+					Update("code", code).
+					Msg("error pages are for 4xx and 5xx status codes, dropping page")
+				delete(camoSpec.ErrorPages, code)
+			}
+		}
+		if camo.IsProxyTemplate(camoSpec.Template) && (len(camoSpec.ErrorPages) > 0 || len(camoSpec.TryFiles) > 0) {
+			log.GetDefaultLogger().
+				Warning().
+				Update("camo_name", camoName).
+				Msg("error_pages and try_files only apply to static camos, the mirrored website answers with its own")
 		}
-		if camo.Security == localSecurityOption {
-			if camo.Template == "" {
+		if camoSpec.Security == localSecurityOption && camo.IsProxyTemplate(camoSpec.Template) {
+			// nothing to download, the mirror is set up with the inbounds
+			if _, err := camo.NewMirror(camoSpec.Template); err != nil {
+				log.GetDefaultLogger().
+					Error().
+					Update("camo_name", camoName).
+					Update("err", err.Error()).
+					Msg("invalid proxy camo")
+			}
+			continue
+		}
+		if camoSpec.Security == localSecurityOption {
+			if camoSpec.Template == "" {
 				log.GetDefaultLogger().
 					Error().
 					Msgf(
 						"%s security requires a template",
-						camo.Security)
+						camoSpec.Security)
+			}
+			if camoSpec.PullPolicy == "" {
+				camoSpec.PullPolicy = "if-not-present"
+			}
+			if _, exists := possiblePullPolicyOptions[camoSpec.PullPolicy]; !exists {
+				log.GetDefaultLogger().
+					Error().
+					Update("camo_name", camoName).
+					Update("pull_policy", camoSpec.PullPolicy).
+					Msgf(
+						"camo pull_policy should be one of: %s, using if-not-present",
+						strings.Join(possiblePullPolicyOptionsSlice, ", "))
+				camoSpec.PullPolicy = "if-not-present"
 			}
 			log.GetDefaultLogger().
 				Info().
 				Update("camo_name", camoName).
-				Update("template", camo.Template).
+				Update("template", camoSpec.Template).
+				Update("pull_policy", camoSpec.PullPolicy).
 				Msg("loading camo")
-			err := r.CamoController.PreLoadCamo(camo.Template)
+			if camoSpec.CosignKey != "" {
+				publicKeyPEM, err := os.ReadFile(camoSpec.CosignKey)
+				if err != nil {
+					log.GetDefaultLogger().
+						Error().
+						Update("camo_name", camoName).
+						Update("err", err.Error()).
+						Msg("failed to read the cosign key, camo is not loaded")
+					continue
+				}
+				r.CamoController.SetVerificationKey(camoSpec.Template, publicKeyPEM)
+			}
+			r.CamoController.SetSubdir(camoSpec.Template, camoSpec.Subdir)
+			err := r.CamoController.PreLoadCamoWithPullPolicy(camoSpec.Template, camoSpec.PullPolicy)
 			if err != nil {
 				log.GetDefaultLogger().
 					Error().
@@ -180,40 +499,193 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 			continue
 		}
 	}
+	if err := r.CamoController.EnforceMaxCacheSize(); err != nil {
+		log.GetDefaultLogger().
+			Error().
+			Update("err", err.Error()).
+			Msg("failed to enforce the camo cache size limit")
+	}
+
+	// quotas, blocked users are left out of xray until their quota renews
+	if rc.Spec.Quota.Reset == "" {
+		rc.Spec.Quota.Reset = "never"
+	}
+	if _, exists := possibleQuotaResetOptions[rc.Spec.Quota.Reset]; !exists {
+		log.GetDefaultLogger().
+			Error().
+			Update("reset", rc.Spec.Quota.Reset).
+			Msgf(
+				"quota reset should be one of: %s, quotas will never reset",
+				strings.Join(possibleQuotaResetOptionsSlice, ", "))
+		rc.Spec.Quota.Reset = "never"
+	}
+	if err := r.setupQuota(&rc.Spec); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Msg("failed to set up quotas, users are not limited")
+	}
 
 	// check and load all inbounds
 	successfullInbounds := 0
-	for _, inb := range rc.Spec.Inbounds {
-		if !utils.IsPortBindable(inb.ListenPort) {
+	for inbID, inb := range rc.Spec.Inbounds {
+		if !utils.IsPortBindable(inb.Listen, inb.ListenPort) {
 			log.GetDefaultLogger().
 				Error().
 				Update("inbound", inb.Name).
+				Update("listen", inb.Listen).
 				Update("port", inb.ListenPort).
-				Msg("specified port is not bindable. missing root/bind capabilities?")
+				Msg("specified address is not bindable. missing root/bind capabilities or a local address?")
 			continue
 		}
-		// reality
-		// 	- caddy:443 -> xray:xrayPort -> caddy:caddyPort/ext:443
-		// xhttptls
-		// 	- caddy:443 -> xray:xrayPort
-		if inb.Type == "vless" {
-			// default to direct binding on the specified port
-			// in case the configuration is not known
-			xinb := r.XrayCore.XrayConfig.EnsureInboundVless(
+		// socks/http
+		// 	- lan:listen_port -> xray:listen_port, plain proxy without camo
+		if inb.Type == "socks" || inb.Type == "http" {
+			xinb, _ := r.XrayCore.XrayConfig.EnsureInboundProtocol(
+				inb.Type,
 				inb.Name,
-				"0.0.0.0",
+				utils.ListenHost(inb.Listen),
 				inb.ListenPort,
 			)
-
 			if inb.Camo != "" {
-				camoSpec, exists := rc.Spec.Camos[inb.Camo]
-				if !exists {
-					log.GetDefaultLogger().Error().
-						Update("camo_name", inb.Camo).
-						Msg("undefined camo, skipping inbound")
+				log.GetDefaultLogger().Warning().
+					Update("inbound", inb.Name).
+					Update("type", inb.Type).
+					Msg("local proxy inbounds can't use camo, ignoring camo")
+			}
+			for _, user := range inb.Users {
+				if user.Name == "" || user.Password == "" {
+					log.GetDefaultLogger().Warning().
+						Update("inbound", inb.Name).
+						Update("user", user.Name).
+						Msg("user requires both name and password, skipping user")
 					continue
 				}
+				xinb.EnsureAccount(user.Name, user.Password)
+			}
+			successfullInbounds += 1
+			continue
+		}
 
+		if _, exists := possibleTransportOptions[inb.Transport]; !exists {
+			log.GetDefaultLogger().
+				Error().
+				Update("inbound", inb.Name).
+				Update("transport", inb.Transport).
+				Msgf(
+					"inbound transport should be one of: %s, skipping inbound",
+					strings.Join(possibleTransportOptionsSlice, ", "))
+			continue
+		}
+		if (inb.Transport == "ws" || inb.Transport == "httpupgrade") && inb.Path == "" {
+			log.GetDefaultLogger().
+				Error().
+				Update("inbound", inb.Name).
+				Update("transport", inb.Transport).
+				Msg("transport requires a path, skipping inbound")
+			continue
+		}
+		if inb.Transport == "grpc" && inb.ServiceName == "" {
+			log.GetDefaultLogger().
+				Error().
+				Update("inbound", inb.Name).
+				Msg("grpc transport requires a service_name, skipping inbound")
+			continue
+		}
+		if inb.Transport == "xhttp" && inb.XHTTP.Mode == "" {
+			inb.XHTTP.Mode = "packet-up"
+		}
+		if _, exists := possibleXHTTPModeOptions[inb.XHTTP.Mode]; inb.Transport == "xhttp" && !exists {
+			log.GetDefaultLogger().
+				Error().
+				Update("inbound", inb.Name).
+				Update("mode", inb.XHTTP.Mode).
+				Msgf(
+					"xhttp mode should be one of: %s, skipping inbound",
+					strings.Join(possibleXHTTPModeOptionsSlice, ", "))
+			continue
+		}
+
+		if !inb.Match.isEmpty() && !inb.matchApplies(&rc.Spec) {
+			log.GetDefaultLogger().Warning().
+				Update("inbound", inb.Name).
+				Update("transport", inb.Transport).
+				Msgf("match only applies to xhttp inbounds of %s camos, ignoring match", localSecurityOption)
+			inb.Match = reflectorConfigV1SpecInboundMatch{}
+		}
+		validClientIPs := []string{}
+		for _, clientIP := range inb.Match.ClientIPs {
+			_, _, cidrErr := net.ParseCIDR(clientIP)
+			if cidrErr != nil && net.ParseIP(clientIP) == nil {
+				log.GetDefaultLogger().Error().
+					Update("inbound", inb.Name).
+					Update("client_ip", clientIP).
+					Msg("match client_ips should be cidrs or addresses, dropping client_ip")
+				continue
+			}
+			validClientIPs = append(validClientIPs, clientIP)
+		}
+		if len(inb.Match.ClientIPs) > 0 && len(validClientIPs) == 0 {
+			log.GetDefaultLogger().Error().
+				Update("inbound", inb.Name).
+				Msg("match has no valid client_ips, skipping inbound")
+			continue
+		}
+		inb.Match.ClientIPs = validClientIPs
+
+		// camos with an unusable reality dest were dropped, their inbounds must not
+		// come up without the camo
+		camoSpec, exists := rc.Spec.Camos[inb.Camo]
+		if inb.Camo != "" && !exists {
+			log.GetDefaultLogger().Error().
+				Update("camo_name", inb.Camo).
+				Msg("undefined camo, skipping inbound")
+			continue
+		}
+		if _, supported := realityTransportOptions[inb.Transport]; camoSpec.Security == "reality" && !supported {
+			log.GetDefaultLogger().Error().
+				Update("camo_name", inb.Camo).
+				Update("transport", inb.Transport).
+				Msg("transport is not supported by reality, skipping inbound")
+			continue
+		}
+
+		// default to direct binding on the specified address
+		// in case the configuration is not known
+		xinb, err := r.XrayCore.XrayConfig.EnsureInboundProtocol(
+			inb.Type,
+			inb.Name,
+			utils.ListenHost(inb.Listen),
+			inb.ListenPort,
+		)
+		if err != nil {
+			log.GetDefaultLogger().
+				Error().
+				Update("type", inb.Type).
+				Msg("unrecognized/unimplemented inbound type")
+			continue
+		}
+
+		// reality
+		// 	- xray:listen:listen_port directly, reality forwards probes to the fqdn
+		// wtls
+		// 	- caddy:listen:listen_port -> xray:127.0.0.1:xrayPort
+		if inb.Camo != "" {
+			if camoSpec.Security == "reality" {
+				xinb.StreamSettings.RealitySettings.PrivateKey = inb.PrivateKey
+				xinb.SecurityReality(camoSpec.FQDN, []string{})
+				xinb.RealityDest(camoSpec.Dest, camoSpec.ServerNames)
+				if inb.PrivateKey == "" {
+					log.GetDefaultLogger().Warning().
+						Update("inbound", inb.Name).
+						Msg("no private_key set, generated a new one, client links will change on restart")
+					inb.PrivateKey = xinb.StreamSettings.RealitySettings.PrivateKey
+				}
+				for _, user := range inb.Users {
+					xinb.EnsureShortID(user.ShortID)
+				}
+			}
+
+			if camoSpec.Security == localSecurityOption {
 				// prepare everything web server
 				xrayPorts, err := utils.FindFreePorts(1)
 				if err != nil {
@@ -221,67 +693,162 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 						Error().
 						Update("err", err.Error()).
 						Msg("failed to get free ports for xrayPort")
+					r.XrayCore.XrayConfig.RemoveInbound(inb.Name)
 					continue
 				}
 				xrayPort := xrayPorts[0]
-				xrayPath := "/"
-				if inb.Transport == "xhttp" {
-					xrayPath = inb.XHTTPPath
+				xrayPath := "/*"
+				switch inb.Transport {
+				case "xhttp":
+					xrayPath = inb.XHTTPPath + "*"
+				case "ws", "httpupgrade":
+					xrayPath = inb.Path
+				case "grpc":
+					xrayPath = "/" + inb.ServiceName + "/*"
 				}
-				r.Caddy.AddProxyLocation(
-					camoSpec.FQDN,
-					inb.ListenPort,
-					xrayPath+"*",
-					fmt.Sprintf("127.0.0.1:%d", xrayPort),
-				)
-				if camoSpec.Security == localSecurityOption {
+				if !inb.Match.isEmpty() {
+					r.Caddy.AddMatchedProxyLocation(
+						camoSpec.FQDN,
+						inb.Listen,
+						inb.ListenPort,
+						xrayPath,
+						fmt.Sprintf("127.0.0.1:%d", xrayPort),
+						caddy.ProxyMatch{
+							Headers:   inb.Match.Headers,
+							Cookies:   inb.Match.Cookies,
+							Query:     inb.Match.Query,
+							ClientIPs: inb.Match.ClientIPs,
+						},
+					)
+				} else if inb.Transport == "grpc" {
+					r.Caddy.AddGRPCProxyLocation(
+						camoSpec.FQDN,
+						inb.Listen,
+						inb.ListenPort,
+						xrayPath,
+						fmt.Sprintf("127.0.0.1:%d", xrayPort),
+					)
+				} else {
+					r.Caddy.AddProxyLocation(
+						camoSpec.FQDN,
+						inb.Listen,
+						inb.ListenPort,
+						xrayPath,
+						fmt.Sprintf("127.0.0.1:%d", xrayPort),
+					)
+				}
+				if camo.IsProxyTemplate(camoSpec.Template) {
+					mirrorAddress, err := r.mirrorAddress(camoSpec.Template)
+					if err != nil {
+						log.GetDefaultLogger().Error().
+							Update("camo_name", inb.Camo).
+							Update("err", err.Error()).
+							Msg("failed to set up the camo mirror")
+					} else {
+						r.Caddy.AddRootProxyLocation(camoSpec.FQDN, inb.Listen, inb.ListenPort, mirrorAddress, camo.MirrorHiddenHeaders)
+					}
+				} else {
 					camoLocation, err := r.CamoController.CamoLocation(camoSpec.Template)
 					if err != nil {
 						log.GetDefaultLogger().Error().
 							Update("camo_name", inb.Camo).
 							Msg("failed to load camo")
 					}
-					r.Caddy.AddRootStaticLocation(camoSpec.FQDN, inb.ListenPort, camoLocation)
+					// without a location the files would be looked up in the working dir
+					if err == nil {
+						if len(camoSpec.TryFiles) > 0 {
+							r.Caddy.AddTryFiles(camoSpec.FQDN, inb.Listen, inb.ListenPort, camoLocation, camoSpec.TryFiles)
+						}
+						if errorPages := camo.ErrorPages(camoLocation, camoSpec.ErrorPages); len(errorPages) > 0 {
+							r.Caddy.AddErrorPages(camoSpec.FQDN, inb.Listen, inb.ListenPort, camoLocation, errorPages)
+						}
+					}
+					r.Caddy.AddRootStaticLocation(camoSpec.FQDN, inb.Listen, inb.ListenPort, camoLocation)
+				}
+				if len(camoSpec.Headers.Set) > 0 || len(camoSpec.Headers.Remove) > 0 {
+					r.Caddy.SetResponseHeaders(camoSpec.FQDN, inb.Listen, inb.ListenPort, camoSpec.Headers.Set, camoSpec.Headers.Remove)
+				}
+				if len(camoSpec.Protocols) > 0 {
+					r.Caddy.SetProtocols(camoSpec.FQDN, inb.Listen, inb.ListenPort, camoSpec.Protocols)
+				}
+				// real websites advertise h3 over Alt-Svc, a decoy that advertises it
+				// without answering QUIC stands out to active probing
+				advertisesH3 := len(camoSpec.Protocols) == 0 || slices.Contains(camoSpec.Protocols, "h3")
+				if advertisesH3 && !utils.IsUDPPortBindable(inb.Listen, inb.ListenPort) {
+					log.GetDefaultLogger().Warning().
+						Update("inbound", inb.Name).
+						Update("camo_name", inb.Camo).
+						Update("listen", inb.Listen).
+						Update("port", inb.ListenPort).
+						Msg("camo advertises h3 but the udp port is not bindable, free it or set protocols without h3")
 				}
 
 				// prepare everything xray
 				xinb.Listen = "127.0.0.1"
 				xinb.Port = xrayPort
-				if camoSpec.Security == "reality" {
-					xinb.SecurityReality(camoSpec.FQDN, []string{})
-					for _, user := range inb.Users {
-						xinb.EnsureShortID(user.ShortID)
-					}
-				}
-				if camoSpec.Security == localSecurityOption {
-					// security is provided by caddy
-					xinb.SecurityNone()
-				}
+				// security is provided by caddy
+				xinb.SecurityNone()
 			}
+		}
 
-			// transports
-			if inb.Transport == "xhttp" {
-				xinb.TransportXHTTPAutoParams(inb.XHTTPPath, "packet-up")
+		// transports
+		switch inb.Transport {
+		case "xhttp":
+			xinb.TransportXHTTPAutoParams(inb.XHTTPPath, inb.XHTTP.Mode)
+			xinb.StreamSettings.XHTTPSettings.Host = inb.XHTTP.Host
+			xinb.StreamSettings.XHTTPSettings.NoSSEHeader = inb.XHTTP.NoSSEHeader
+			if inb.XHTTP.Padding != "" {
+				xinb.StreamSettings.XHTTPSettings.XPaddingBytes = inb.XHTTP.Padding
+			}
+			if inb.XHTTP.SCMaxBufferedPosts != 0 {
+				xinb.StreamSettings.XHTTPSettings.SCMaxBufferedPosts = inb.XHTTP.SCMaxBufferedPosts
+			}
+			if inb.XHTTP.SCMaxEachPostBytes != "" {
+				xinb.StreamSettings.XHTTPSettings.SCMaxEachPostBytes = inb.XHTTP.SCMaxEachPostBytes
 			}
-			if inb.Transport == "tcp" {
-				xinb.TransportTCP()
+			if inb.XHTTP.SCStreamUpServerSecs != "" {
+				xinb.StreamSettings.XHTTPSettings.SCStreamUpServerSecs = inb.XHTTP.SCStreamUpServerSecs
 			}
+		case "tcp":
+			xinb.TransportTCP()
+		case "ws":
+			xinb.TransportWS(inb.Path, "")
+		case "httpupgrade":
+			xinb.TransportHTTPUpgrade(inb.Path, "")
+		case "grpc":
+			xinb.TransportGRPC(inb.ServiceName)
+		}
 
-			// users
-			for _, user := range inb.Users {
-				_ = user
-				// clientLink := xinb.EnsureClientReturnClientLink(
-				// 	user.UUID,
-				// 	user.Flow,
-				// 	user.Name)
-				// _ = clientLink
+		// users
+		rc.Spec.Inbounds[inbID] = inb
+		for _, user := range inb.Users {
+			r.userClients[user.Name] = append(r.userClients[user.Name], userClientRef{
+				inboundTag: inb.Name,
+				id:         user.UUID,
+				flow:       user.Flow,
+			})
+			if r.quota != nil && r.quota.isBlocked(user.Name) {
+				log.GetDefaultLogger().Warning().
+					Update("inbound", inb.Name).
+					Update("user", user.Name).
+					Msg("user is out of quota or expired, not adding")
+			} else {
+				xinb.EnsureClient(user.UUID, user.Flow, user.Name)
 			}
-		} else {
-			log.GetDefaultLogger().
-				Error().
-				Update("type", inb.Type).
-				Msg("unrecognized/unimplemented inbound type")
-			continue
+			link, err := rc.Spec.inboundUserLink(&inb, &user)
+			if err != nil {
+				log.GetDefaultLogger().Warning().
+					Update("inbound", inb.Name).
+					Update("user", user.Name).
+					Update("err", err.Error()).
+					Msg("can't build client link")
+				continue
+			}
+			log.GetDefaultLogger().Info().
+				Update("inbound", inb.Name).
+				Update("user", user.Name).
+				Update("link", link.MarshalLink()).
+				Msg("client link")
 		}
 		successfullInbounds += 1
 	}
@@ -292,21 +859,113 @@ func (r *reflector) ParseReflectorConfigV1(config io.Reader) error {
 		return errors.New("0 inbounds loaded successfully")
 	}
 
+	if err := r.setupSubscription(&rc.Spec); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Msg("failed to set up subscriptions, continuing without them")
+	}
+
+	// user changes at runtime go through the api instead of restarts
+	if err := r.ensureXrayAPI(xray.HandlerServiceName); err != nil {
+		log.GetDefaultLogger().Warning().
+			Update("err", err.Error()).
+			Msg("failed to enable the xray api, user changes will restart xray")
+	}
+
+	if err := r.setupMetrics(rc.Spec.Metrics); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Msg("failed to set up metrics, continuing without them")
+	}
+
+	outboundsByName := map[string]reflectorConfigV1SpecOutbound{}
 	for _, ob := range rc.Spec.Outbounds {
+		outboundsByName[ob.Name] = ob
+	}
+	// broken outbounds become blackholes, traffic meant for a chain must not
+	// leave directly
+	for _, ob := range rc.Spec.Outbounds {
+		xob := r.XrayCore.XrayConfig.EnsureOutbound(ob.Name)
+		if err := validateOutboundChain(ob, outboundsByName); err != nil {
+			log.GetDefaultLogger().
+				Error().
+				Update("outbound", ob.Name).
+				Update("err", err.Error()).
+				Msg("invalid outbound chain, dropping its traffic")
+			xob.Blackhole()
+			continue
+		}
 		switch ob.Type {
 		case "direct":
-			{
-				ob := r.XrayCore.XrayConfig.EnsureOutbound(ob.Name)
-				ob.Protocol = "freedom"
-			}
-		default:
-			{
+			xob.Direct()
+		case "socks", "http":
+			if ob.Address == "" || ob.Port == 0 {
 				log.GetDefaultLogger().
 					Error().
+					Update("outbound", ob.Name).
 					Update("type", ob.Type).
-					Msg("unrecognized/unimplemented outbound type")
+					Msg("outbound requires an address and a port, dropping its traffic")
+				xob.Blackhole()
+				continue
+			}
+			xob.Upstream(ob.Type, ob.Address, ob.Port, ob.User, ob.Password)
+		case "link":
+			xl, err := xray.ParseXrayLink(ob.Link)
+			if err == nil {
+				_, err = xob.Link(xl)
 			}
+			if err != nil {
+				log.GetDefaultLogger().
+					Error().
+					Update("outbound", ob.Name).
+					Update("err", err.Error()).
+					Msg("invalid outbound link, dropping its traffic")
+				xob.Blackhole()
+				continue
+			}
+		default:
+			log.GetDefaultLogger().
+				Error().
+				Update("outbound", ob.Name).
+				Update("type", ob.Type).
+				Msg("unrecognized/unimplemented outbound type, dropping its traffic")
+			xob.Blackhole()
+			continue
+		}
+		if ob.Via != "" {
+			xob.Via(ob.Via)
+		}
+	}
+	for _, inb := range rc.Spec.Inbounds {
+		if inb.Outbound == "" {
+			continue
+		}
+		if _, exists := outboundsByName[inb.Outbound]; !exists {
+			log.GetDefaultLogger().
+				Error().
+				Update("inbound", inb.Name).
+				Update("outbound", inb.Outbound).
+				Msg("undefined outbound, dropping the traffic of the inbound")
+			r.XrayCore.XrayConfig.EnsureOutbound(inb.Outbound).Blackhole()
+		}
+		r.XrayCore.XrayConfig.EnsureRoutingRule(inb.Name, inb.Outbound, "")
+	}
+	return nil
+}
+
+// via has to name another outbound and chains must not loop
+func validateOutboundChain(ob reflectorConfigV1SpecOutbound, outboundsByName map[string]reflectorConfigV1SpecOutbound) error {
+	seen := map[string]bool{ob.Name: true}
+	for ob.Via != "" {
+		next, exists := outboundsByName[ob.Via]
+		if !exists {
+			return fmt.Errorf("via names undefined outbound %s", ob.Via)
+		}
+		if seen[next.Name] {
+			return fmt.Errorf("outbound chain loops at %s", next.Name)
 		}
+		seen[next.Name] = true
+		ob = next
 	}
 	return nil
 }
@@ -0,0 +1,104 @@
+package logic
+
+import (
+	"io"
+	"reflector/log"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Re-reads users of the already loaded inbounds and applies them to the
+// running xray, other config changes need a restart of reflector
+func (r *reflector) ReloadUsers(config io.Reader) error {
+	rc := &reflectorConfigV1{}
+	configBytes, err := io.ReadAll(config)
+	if err != nil {
+		log.GetDefaultLogger().Error().Msg("failed to read config bytes")
+		return err
+	}
+	err = yaml.Unmarshal(configBytes, rc)
+	if err != nil {
+		log.GetDefaultLogger().Error().Msg("failed to unmarshal config")
+		return err
+	}
+
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	r.reloadQuotaUsers(rc.Spec.Inbounds)
+	userClients := map[string][]userClientRef{}
+	for _, inb := range rc.Spec.Inbounds {
+		xinb, exists := r.XrayCore.XrayConfig.Inbound(inb.Name)
+		if !exists {
+			log.GetDefaultLogger().Warning().
+				Update("inbound", inb.Name).
+				Msg("new inbounds are only loaded on start, skipping inbound")
+			continue
+		}
+		if inb.Type != "vless" && inb.Type != "vmess" {
+			log.GetDefaultLogger().Warning().
+				Update("inbound", inb.Name).
+				Update("type", inb.Type).
+				Msg("users of this inbound type are only loaded on start, skipping inbound")
+			continue
+		}
+		keep := []string{}
+		for _, user := range inb.Users {
+			userClients[user.Name] = append(userClients[user.Name], userClientRef{
+				inboundTag: inb.Name,
+				id:         user.UUID,
+				flow:       user.Flow,
+			})
+			if xinb.StreamSettings.Security == "reality" {
+				// a new short id changes the inbound itself, xray gets restarted
+				xinb.EnsureShortID(user.ShortID)
+			}
+			if r.quota != nil && r.quota.isBlocked(user.Name) {
+				continue
+			}
+			xinb.EnsureClient(user.UUID, user.Flow, user.Name)
+			keep = append(keep, user.UUID)
+		}
+		for _, id := range xinb.ClientIDs() {
+			if !slices.Contains(keep, id) {
+				xinb.RemoveClient(id)
+			}
+		}
+	}
+	r.userClients = userClients
+	if r.subscription != nil {
+		r.subscription.updateUsers(rc.Spec.Inbounds)
+	}
+	r.applyXrayClientChanges()
+	return nil
+}
+
+// Rebuilds the limited users from the reloaded inbounds, users that are gone
+// or lost their limits are no longer blocked
+func (r *reflector) reloadQuotaUsers(inbounds []reflectorConfigV1SpecInbound) {
+	limited := []string{}
+	for _, inb := range inbounds {
+		if inb.Type != "vless" && inb.Type != "vmess" {
+			continue
+		}
+		for _, user := range inb.Users {
+			if slices.Contains(limited, user.Name) || (user.Quota == "" && user.Expires == "") {
+				continue
+			}
+			limited = append(limited, user.Name)
+			if r.quota != nil {
+				r.addQuotaUser(&user)
+			}
+		}
+	}
+	if r.quota == nil {
+		if len(limited) > 0 {
+			log.GetDefaultLogger().Warning().
+				Update("users", strings.Join(limited, ",")).
+				Msg("quotas and expiry were not enabled on start, restart reflector to enforce them")
+		}
+		return
+	}
+	r.quota.retainUsers(limited)
+}
@@ -0,0 +1,168 @@
+package logic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflector/xray"
+	"strconv"
+	"time"
+)
+
+// outcome of a single check, Err is nil when it passed
+type SelfTestResult struct {
+	Inbound string
+	// 'proxy' through the inbound or 'decoy' of its camo
+	Check     string
+	Transport string
+	Detail    string
+	Err       error
+}
+
+type SelfTestOptions struct {
+	XrayBinary string
+	// fetched through every inbound
+	URL string
+	// accept any certificate, for caddy's internal CA on localhost
+	Insecure bool
+	Timeout  time.Duration
+	// a running reflector picks up new users a moment after SIGHUP
+	Attempts int
+}
+
+// Inbounds a throwaway user can be added to, vless and vmess
+func (cf *ConfigFile) ClientInbounds() ([]string, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	inbounds := []string{}
+	for _, inb := range spec.Inbounds {
+		if inb.Type == "vless" || inb.Type == "vmess" {
+			inbounds = append(inbounds, inb.Name)
+		}
+	}
+	return inbounds, nil
+}
+
+// Connects through every inbound of user with a client side xray and fetches
+// opts.URL, then checks that every wtls decoy answers a plain https GET
+func (cf *ConfigFile) SelfTest(ctx context.Context, user string, opts SelfTestOptions) ([]SelfTestResult, error) {
+	spec, err := cf.spec()
+	if err != nil {
+		return nil, err
+	}
+	links, err := cf.UserLinks("", user)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Attempts < 1 {
+		opts.Attempts = 1
+	}
+
+	results := []SelfTestResult{}
+	decoysChecked := map[string]bool{}
+	for _, inb := range spec.Inbounds {
+		link, exists := links[inb.Name]
+		if !exists {
+			continue
+		}
+		result := SelfTestResult{
+			Inbound:   inb.Name,
+			Check:     "proxy",
+			Transport: link.Parameters.Type + "/" + link.Parameters.Security,
+		}
+		result.Detail, result.Err = selfTestProxy(ctx, link, opts)
+		results = append(results, result)
+
+		camoSpec, hasCamo := spec.Camos[inb.Camo]
+		if !hasCamo || camoSpec.Security != "wtls" {
+			continue
+		}
+		decoyURL := "https://" + net.JoinHostPort(camoSpec.FQDN, strconv.Itoa(inb.ListenPort)) + "/"
+		if decoysChecked[decoyURL] {
+			continue
+		}
+		decoysChecked[decoyURL] = true
+		result = SelfTestResult{Inbound: inb.Name, Check: "decoy", Transport: "https"}
+		result.Detail, result.Err = selfTestDecoy(ctx, &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.Insecure}},
+		}, decoyURL)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func selfTestProxy(ctx context.Context, link *xray.XrayLink, opts SelfTestOptions) (string, error) {
+	client, err := xray.StartXrayClient(opts.XrayBinary, link, opts.Insecure)
+	if err != nil {
+		return "", err
+	}
+	defer client.Stop()
+	httpClient := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{
+			Scheme: "socks5",
+			Host:   fmt.Sprintf("127.0.0.1:%d", client.SocksPort),
+		})},
+	}
+	for attempt := 1; ; attempt++ {
+		detail, err := selfTestFetch(ctx, httpClient, opts.URL)
+		if err == nil || attempt >= opts.Attempts {
+			return detail, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func selfTestFetch(ctx context.Context, client *http.Client, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return fmt.Sprintf("%s in %s", resp.Status, time.Since(started).Round(time.Millisecond)), nil
+}
+
+// an unauthenticated visitor has to get a page, not an error or an empty body
+func selfTestDecoy(ctx context.Context, client *http.Client, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("decoy returned %s", resp.Status)
+	}
+	if len(body) == 0 {
+		return "", errors.New("decoy returned an empty page")
+	}
+	return fmt.Sprintf("%s, %d bytes of %s", resp.Status, len(body), resp.Header.Get("Content-Type")), nil
+}
@@ -0,0 +1,125 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflector/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTestDecoy(t *testing.T) {
+	decoy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>camo</html>"))
+		case "/empty":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer decoy.Close()
+
+	ctx := context.Background()
+	if detail, err := selfTestDecoy(ctx, decoy.Client(), decoy.URL+"/"); err != nil || !strings.Contains(detail, "text/html") {
+		t.Fatalf("expected the decoy to pass, got %q, %v", detail, err)
+	}
+	if _, err := selfTestDecoy(ctx, decoy.Client(), decoy.URL+"/empty"); err == nil {
+		t.Fatal("empty pages should fail")
+	}
+	if _, err := selfTestDecoy(ctx, decoy.Client(), decoy.URL+"/missing"); err == nil {
+		t.Fatal("errors should fail")
+	}
+	if _, err := selfTestDecoy(ctx, http.DefaultClient, decoy.URL+"/"); err == nil {
+		t.Fatal("untrusted certificates should fail without insecure")
+	}
+}
+
+// full loopback run, downloads xray and caddy
+func TestSelfTestLoopback(t *testing.T) {
+	if os.Getenv("REFLECTOR_E2E") == "" {
+		t.Skip("set REFLECTOR_E2E=1 to run against real xray and caddy binaries")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	camoDir := filepath.Join(dir, "camo")
+	if err := os.Mkdir(camoDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(camoDir, "index.html"), []byte("<html>camo</html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ports, err := utils.FindFreePorts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Reflector
+spec:
+  camos:
+    web:
+      security: wtls
+      template: %s
+      fqdn: localhost
+      protocols: [h1, h2]
+  inbounds:
+    - name: xhttp-in
+      type: vless
+      camo: web
+      listen: 127.0.0.1
+      listen_port: %d
+      transport: xhttp
+      xhttpPath: /selftest
+      users:
+        - name: alice
+          uuid: aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa
+  outbounds:
+    - name: direct
+      type: direct
+`, camoDir, ports[0])
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	r := NewReflector("v2.9.0", "v25.9.11")
+	if err := r.ParseReflectorConfigV1(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	defer r.Stop()
+
+	cf, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := cf.SelfTest(context.Background(), "alice", SelfTestOptions{
+		XrayBinary: r.XrayCore.BinaryLocation(),
+		URL:        target.URL,
+		Insecure:   true,
+		Timeout:    10 * time.Second,
+		Attempts:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a proxy and a decoy check, got %+v", results)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("%s %s failed: %v", result.Inbound, result.Check, result.Err)
+		}
+	}
+}
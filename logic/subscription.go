@@ -0,0 +1,219 @@
+package logic
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflector/log"
+	"reflector/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokens are derived from the secret, changing it revokes every subscription url
+func subscriptionToken(secret string, name string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Serves base64 link bundles at <path>/<token>, links are built per request
+// from the current spec so key, port and user changes show up on refresh
+type subscriptionHandler struct {
+	path           string
+	secret         string
+	updateInterval int
+	lock           sync.RWMutex
+	spec           *reflectorConfigV1Spec
+	quota          *quotaEnforcer
+}
+
+// picks up reloaded users of inbounds that are already served
+func (sh *subscriptionHandler) updateUsers(inbounds []reflectorConfigV1SpecInbound) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	for i, inb := range sh.spec.Inbounds {
+		for _, reloaded := range inbounds {
+			if reloaded.Name == inb.Name {
+				sh.spec.Inbounds[i].Users = reloaded.Users
+			}
+		}
+	}
+}
+
+func (sh *subscriptionHandler) userByToken(token string) (string, bool) {
+	for _, inb := range sh.spec.Inbounds {
+		for _, user := range inb.Users {
+			if hmac.Equal([]byte(subscriptionToken(sh.secret, user.Name)), []byte(token)) {
+				return user.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (sh *subscriptionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	token := strings.TrimPrefix(req.URL.Path, sh.path+"/")
+	name, exists := sh.userByToken(token)
+	if req.Method != http.MethodGet || !exists {
+		// caddy answers with the decoy's 404, nothing of this may reach the client
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	links := []string{}
+	for _, inb := range sh.spec.Inbounds {
+		for _, user := range inb.Users {
+			if user.Name != name {
+				continue
+			}
+			if sh.quota != nil && sh.quota.isBlocked(name) {
+				continue
+			}
+			link, err := sh.spec.inboundUserLink(&inb, &user)
+			if err != nil {
+				continue
+			}
+			links = append(links, link.MarshalLink())
+		}
+	}
+
+	if sh.quota != nil {
+		usage := sh.quota.usage(name)
+		quota, expires := sh.quota.limits(name)
+		userinfo := fmt.Sprintf("upload=%d; download=%d; total=%d", usage.Uplink, usage.Downlink, quota)
+		if !expires.IsZero() {
+			userinfo += fmt.Sprintf("; expire=%d", expires.Unix())
+		}
+		w.Header().Set("subscription-userinfo", userinfo)
+	}
+	w.Header().Set("profile-update-interval", strconv.Itoa(sh.updateInterval))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))))
+}
+
+// Public subscription url of the user, served on the first wtls inbound of the camo
+func (spec *reflectorConfigV1Spec) subscriptionURL(name string) (string, error) {
+	sub := spec.Subscription
+	if sub.Camo == "" {
+		return "", fmt.Errorf("subscriptions are not configured")
+	}
+	if sub.Secret == "" {
+		return "", fmt.Errorf("subscription has no secret, urls change on every start")
+	}
+	camoSpec, exists := spec.Camos[sub.Camo]
+	if !exists || camoSpec.Security != "wtls" {
+		return "", fmt.Errorf("subscriptions require a wtls camo")
+	}
+	for _, inb := range spec.Inbounds {
+		if inb.Camo != sub.Camo {
+			continue
+		}
+		host := camoSpec.FQDN
+		if inb.ListenPort != 443 {
+			host = fmt.Sprintf("%s:%d", host, inb.ListenPort)
+		}
+		return fmt.Sprintf("https://%s%s/%s", host, subscriptionPath(sub), subscriptionToken(sub.Secret, name)), nil
+	}
+	return "", fmt.Errorf("no inbound uses camo %s", sub.Camo)
+}
+
+func subscriptionPath(sub reflectorConfigV1SpecSubscription) string {
+	if sub.Path == "" {
+		return "/sub"
+	}
+	return "/" + strings.Trim(sub.Path, "/")
+}
+
+func (r *reflector) setupSubscription(spec *reflectorConfigV1Spec) error {
+	sub := &spec.Subscription
+	if sub.Camo == "" {
+		return nil
+	}
+	camoSpec, exists := spec.Camos[sub.Camo]
+	if !exists || camoSpec.Security != "wtls" {
+		return fmt.Errorf("subscription camo %s is not a wtls camo", sub.Camo)
+	}
+	if sub.Secret == "" {
+		sub.Secret = utils.RandomHex(16)
+		log.GetDefaultLogger().Warning().
+			Msg("no subscription secret set, generated a new one, subscription urls will change on restart")
+	}
+	updateInterval := sub.UpdateInterval
+	if updateInterval == 0 {
+		updateInterval = 12
+	}
+	ports, err := utils.FindFreePorts(1)
+	if err != nil {
+		return err
+	}
+	path := subscriptionPath(*sub)
+	r.subscription = &subscriptionHandler{
+		path:           path,
+		secret:         sub.Secret,
+		updateInterval: updateInterval,
+		spec:           spec,
+		quota:          r.quota,
+	}
+	r.subscriptionServer = &http.Server{
+		Addr:    utils.ListenAddress("127.0.0.1", ports[0]),
+		Handler: r.subscription,
+	}
+
+	served := map[string]bool{}
+	for _, inb := range spec.Inbounds {
+		address := utils.ListenAddress(inb.Listen, inb.ListenPort)
+		if inb.Camo != sub.Camo || served[address] {
+			continue
+		}
+		served[address] = true
+		r.Caddy.AddDecoyProxyLocation(camoSpec.FQDN, inb.Listen, inb.ListenPort, path+"/*", r.subscriptionServer.Addr)
+	}
+	logged := map[string]bool{}
+	for _, inb := range spec.Inbounds {
+		for _, user := range inb.Users {
+			if logged[user.Name] {
+				continue
+			}
+			logged[user.Name] = true
+			if url, err := spec.subscriptionURL(user.Name); err == nil {
+				log.GetDefaultLogger().Info().
+					Update("user", user.Name).
+					Update("url", url).
+					Msg("subscription url")
+			}
+		}
+	}
+	return nil
+}
+
+func (r *reflector) startSubscription() {
+	if r.subscriptionServer == nil {
+		return
+	}
+	go func() {
+		err := r.subscriptionServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.GetDefaultLogger().Error().
+				Update("err", err.Error()).
+				Msg("subscription server failed")
+		}
+	}()
+}
+
+func (r *reflector) stopSubscription() {
+	if r.subscriptionServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.subscriptionServer.Shutdown(ctx)
+}
@@ -0,0 +1,67 @@
+package logic
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionHandler(t *testing.T) {
+	rc := loadTestConfig(t)
+	rc.Spec.Subscription = reflectorConfigV1SpecSubscription{Camo: "web", Secret: "s3cret"}
+	quota := newQuotaEnforcer(fakeStatsQuerier{}, reflectorConfigV1SpecQuota{
+		StateFile: filepath.Join(t.TempDir(), "usage.json"),
+	})
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	quota.addUser("bob", 1<<30, expires)
+	sh := &subscriptionHandler{
+		path:           "/sub",
+		secret:         "s3cret",
+		updateInterval: 12,
+		spec:           &rc.Spec,
+		quota:          quota,
+	}
+
+	url, err := rc.Spec.subscriptionURL("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://example.com/sub/"+subscriptionToken("s3cret", "bob") {
+		t.Fatalf("unexpected subscription url %s", url)
+	}
+
+	resp := httptest.NewRecorder()
+	sh.ServeHTTP(resp, httptest.NewRequest("GET", strings.TrimPrefix(url, "https://example.com"), nil))
+	if resp.Code != 200 {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if userinfo := resp.Header().Get("subscription-userinfo"); userinfo != "upload=0; download=0; total=1073741824; expire=1893456000" {
+		t.Fatalf("unexpected userinfo %q", userinfo)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := strings.Split(string(decoded), "\n")
+	if len(links) != 2 || !strings.Contains(links[1], "security=reality") {
+		t.Fatalf("expected xhttp and reality links, got %v", links)
+	}
+
+	// port changes show up on the next refresh
+	rc.Spec.Inbounds[1].ListenPort = 9443
+	resp = httptest.NewRecorder()
+	sh.ServeHTTP(resp, httptest.NewRequest("GET", "/sub/"+subscriptionToken("s3cret", "bob"), nil))
+	decoded, _ = base64.StdEncoding.DecodeString(resp.Body.String())
+	if !strings.Contains(string(decoded), ":9443") {
+		t.Fatalf("expected the new port in %s", decoded)
+	}
+
+	resp = httptest.NewRecorder()
+	sh.ServeHTTP(resp, httptest.NewRequest("GET", "/sub/"+subscriptionToken("other", "bob"), nil))
+	if resp.Code != 404 {
+		t.Fatalf("unknown tokens should 404, got %d", resp.Code)
+	}
+}
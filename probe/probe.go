@@ -0,0 +1,326 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflector/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	FindingOK   = "ok"
+	FindingWarn = "warn"
+	FindingFail = "fail"
+)
+
+type Finding struct {
+	Check    string
+	Severity string
+	Detail   string
+}
+
+// A deployed camo as a prober sees it
+type Target struct {
+	FQDN string
+	// host:port to connect to, fqdn:443 when empty
+	Address string
+	// reality camos serve the certificate of the real fqdn
+	Reality bool
+	// where the real fqdn is reached for comparison, fqdn:443 when empty
+	RealAddress string
+	// paths routed to xray, they must not answer differently than random ones
+	PathPrefixes []string
+	// skip chain verification, for caddy's internal CA
+	Insecure bool
+	// trusted roots, the system pool when nil
+	RootCAs *x509.CertPool
+	Timeout time.Duration
+}
+
+// headers that legitimately differ between pages of the same site
+var volatileHeaders = map[string]bool{
+	"Content-Length": true,
+	"Content-Type":   true,
+	"Date":           true,
+	"Etag":           true,
+	"Last-Modified":  true,
+	"Accept-Ranges":  true,
+	"Vary":           true,
+}
+
+type probeResponse struct {
+	path   string
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (t *Target) address() string {
+	if t.Address != "" {
+		return t.Address
+	}
+	return net.JoinHostPort(t.FQDN, "443")
+}
+
+func (t *Target) realAddress() string {
+	if t.RealAddress != "" {
+		return t.RealAddress
+	}
+	return net.JoinHostPort(t.FQDN, "443")
+}
+
+func (t *Target) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         t.FQDN,
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: t.Insecure,
+		RootCAs:            t.RootCAs,
+	}
+}
+
+func tlsHandshake(
+	ctx context.Context,
+	address string,
+	config *tls.Config,
+	timeout time.Duration,
+) (*tls.ConnectionState, error) {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	return &state, nil
+}
+
+func (t *Target) handshake(ctx context.Context, address string) (*tls.ConnectionState, error) {
+	return tlsHandshake(ctx, address, t.tlsConfig(), t.Timeout)
+}
+
+// Runs every check against the target, the report flags anything that sets
+// the deployment apart from an ordinary website
+func Probe(ctx context.Context, t Target) []Finding {
+	if t.Timeout == 0 {
+		t.Timeout = 10 * time.Second
+	}
+	findings := checkTLS(ctx, &t)
+	if t.Reality {
+		findings = append(findings, checkRealityCertificate(ctx, &t)...)
+	}
+	return append(findings, checkHTTP(ctx, &t)...)
+}
+
+func checkTLS(ctx context.Context, t *Target) []Finding {
+	state, err := t.handshake(ctx, t.address())
+	if err != nil {
+		return []Finding{{"tls", FindingFail, fmt.Sprintf("handshake with %s failed: %s", t.address(), err)}}
+	}
+	findings := []Finding{}
+	if t.Insecure {
+		findings = append(findings, Finding{"tls chain", FindingWarn, "not verified, insecure mode"})
+	} else {
+		findings = append(findings, Finding{"tls chain", FindingOK, "verifies for " + t.FQDN})
+	}
+	leaf := state.PeerCertificates[0]
+	if err := leaf.VerifyHostname(t.FQDN); err != nil {
+		findings = append(findings, Finding{"tls name", FindingFail, err.Error()})
+	}
+	if remaining := time.Until(leaf.NotAfter); remaining < 7*24*time.Hour {
+		findings = append(findings, Finding{"tls expiry", FindingWarn,
+			fmt.Sprintf("certificate expires in %s", remaining.Round(time.Hour))})
+	}
+
+	if state.Version == tls.VersionTLS13 {
+		findings = append(findings, Finding{"tls version", FindingOK, tls.VersionName(state.Version)})
+	} else {
+		findings = append(findings, Finding{"tls version", FindingWarn,
+			tls.VersionName(state.Version) + ", most sites negotiate TLS 1.3"})
+	}
+	switch state.NegotiatedProtocol {
+	case "h2":
+		findings = append(findings, Finding{"alpn", FindingOK, "h2"})
+	case "":
+		findings = append(findings, Finding{"alpn", FindingWarn, "no protocol negotiated, browsers expect h2"})
+	default:
+		findings = append(findings, Finding{"alpn", FindingWarn,
+			state.NegotiatedProtocol + " instead of h2"})
+	}
+	return findings
+}
+
+// reality forwards the handshake, the certificate has to be the real one
+func checkRealityCertificate(ctx context.Context, t *Target) []Finding {
+	served, err := t.handshake(ctx, t.address())
+	if err != nil {
+		return nil
+	}
+	real, err := t.handshake(ctx, t.realAddress())
+	if err != nil {
+		return []Finding{{"reality cert", FindingWarn,
+			fmt.Sprintf("can't reach %s for comparison: %s", t.realAddress(), err)}}
+	}
+	servedLeaf, realLeaf := served.PeerCertificates[0], real.PeerCertificates[0]
+	switch {
+	case bytes.Equal(servedLeaf.Raw, realLeaf.Raw):
+		return []Finding{{"reality cert", FindingOK, "same certificate as " + t.realAddress()}}
+	case servedLeaf.Subject.String() == realLeaf.Subject.String() &&
+		servedLeaf.Issuer.String() == realLeaf.Issuer.String():
+		return []Finding{{"reality cert", FindingWarn,
+			"different certificate with the same subject and issuer, the target may rotate certificates"}}
+	default:
+		return []Finding{{"reality cert", FindingFail, fmt.Sprintf(
+			"served %q by %q, %s serves %q by %q",
+			servedLeaf.Subject, servedLeaf.Issuer, t.realAddress(), realLeaf.Subject, realLeaf.Issuer)}}
+	}
+}
+
+func (t *Target) httpClient() *http.Client {
+	dialer := &net.Dialer{Timeout: t.Timeout}
+	return &http.Client{
+		Timeout: t.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, t.address())
+			},
+			TLSClientConfig:   t.tlsConfig(),
+			ForceAttemptHTTP2: true,
+		},
+		// redirects are part of the response being compared
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (t *Target) get(ctx context.Context, client *http.Client, path string) (*probeResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+t.FQDN+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return &probeResponse{path: path, status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// header names that are not expected to vary between pages
+func stableHeaderNames(header http.Header) []string {
+	names := []string{}
+	for name := range header {
+		if !volatileHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// how pr differs from what the site answers for unknown paths
+func compareResponse(baseline *probeResponse, pr *probeResponse) []string {
+	differences := []string{}
+	if pr.status != baseline.status {
+		differences = append(differences, fmt.Sprintf("status %d, unknown paths answer %d", pr.status, baseline.status))
+	}
+	if got, want := pr.header.Get("Content-Type"), baseline.header.Get("Content-Type"); got != want {
+		differences = append(differences, fmt.Sprintf("content type %q, unknown paths answer %q", got, want))
+	}
+	baselineNames := stableHeaderNames(baseline.header)
+	for _, name := range stableHeaderNames(pr.header) {
+		if !slices.Contains(baselineNames, name) {
+			differences = append(differences, "extra header "+name)
+		}
+	}
+	for _, name := range baselineNames {
+		if pr.header.Get(name) == "" {
+			differences = append(differences, "missing header "+name)
+		}
+	}
+	return differences
+}
+
+func checkHTTP(ctx context.Context, t *Target) []Finding {
+	client := t.httpClient()
+	findings := []Finding{}
+
+	root, err := t.get(ctx, client, "/")
+	if err != nil {
+		return append(findings, Finding{"http /", FindingFail, err.Error()})
+	}
+	switch {
+	case root.status == http.StatusOK && len(root.body) > 0:
+		findings = append(findings, Finding{"http /", FindingOK,
+			fmt.Sprintf("%d, %d bytes of %s", root.status, len(root.body), root.header.Get("Content-Type"))})
+	case root.status >= http.StatusMultipleChoices && root.status < http.StatusBadRequest:
+		findings = append(findings, Finding{"http /", FindingOK,
+			fmt.Sprintf("%d to %s", root.status, root.header.Get("Location"))})
+	default:
+		findings = append(findings, Finding{"http /", FindingWarn,
+			fmt.Sprintf("%d with %d bytes, a website should serve a page", root.status, len(root.body))})
+	}
+
+	randomPaths := []string{"/" + utils.RandomHex(6), "/" + utils.RandomHex(4) + "/" + utils.RandomHex(4) + ".php"}
+	randoms := []*probeResponse{}
+	for _, path := range randomPaths {
+		pr, err := t.get(ctx, client, path)
+		if err != nil {
+			findings = append(findings, Finding{"http " + path, FindingFail, err.Error()})
+			continue
+		}
+		randoms = append(randoms, pr)
+	}
+	if len(randoms) == 0 {
+		return findings
+	}
+	baseline := randoms[0]
+	consistent := true
+	for _, pr := range randoms[1:] {
+		if differences := compareResponse(baseline, pr); len(differences) > 0 {
+			consistent = false
+			findings = append(findings, Finding{"http random paths", FindingWarn,
+				pr.path + ": " + strings.Join(differences, ", ")})
+		}
+	}
+	if consistent {
+		findings = append(findings, Finding{"http random paths", FindingOK,
+			fmt.Sprintf("unknown paths answer %d", baseline.status)})
+	}
+
+	if server := root.header.Get("Server"); server != baseline.header.Get("Server") {
+		findings = append(findings, Finding{"http headers", FindingFail, fmt.Sprintf(
+			"server %q on / and %q on unknown paths", server, baseline.header.Get("Server"))})
+	}
+	for _, prefix := range t.PathPrefixes {
+		prefix = "/" + strings.Trim(prefix, "/")
+		for _, path := range []string{prefix, prefix + "/" + utils.RandomHex(6)} {
+			pr, err := t.get(ctx, client, path)
+			if err != nil {
+				findings = append(findings, Finding{"http proxy path", FindingFail, path + ": " + err.Error()})
+				continue
+			}
+			if differences := compareResponse(baseline, pr); len(differences) > 0 {
+				findings = append(findings, Finding{"http proxy path", FindingFail,
+					path + ": " + strings.Join(differences, ", ")})
+			} else {
+				findings = append(findings, Finding{"http proxy path", FindingOK,
+					path + " answers like unknown paths"})
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,145 @@
+package probe_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflector/probe"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startDecoy(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func decoyTarget(server *httptest.Server) probe.Target {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return probe.Target{
+		FQDN:    "example.com",
+		Address: server.Listener.Addr().String(),
+		RootCAs: pool,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func findingsBySeverity(findings []probe.Finding, severity string) []probe.Finding {
+	matched := []probe.Finding{}
+	for _, finding := range findings {
+		if finding.Severity == severity {
+			matched = append(matched, finding)
+		}
+	}
+	return matched
+}
+
+func decoyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "Caddy")
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>camo</html>"))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestProbeConsistentDecoy(t *testing.T) {
+	target := decoyTarget(startDecoy(t, decoyHandler))
+	target.PathPrefixes = []string{"/secondsbeforedawn"}
+	findings := probe.Probe(context.Background(), target)
+	if failed := findingsBySeverity(findings, probe.FindingFail); len(failed) > 0 {
+		t.Fatalf("expected no failures, got %+v", failed)
+	}
+	ok := findingsBySeverity(findings, probe.FindingOK)
+	checks := map[string]bool{}
+	for _, finding := range ok {
+		checks[finding.Check] = true
+	}
+	for _, check := range []string{"tls chain", "tls version", "alpn", "http /", "http random paths", "http proxy path"} {
+		if !checks[check] {
+			t.Errorf("expected %s to pass, got %+v", check, findings)
+		}
+	}
+}
+
+func TestProbeLeakyProxyPath(t *testing.T) {
+	target := decoyTarget(startDecoy(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/secondsbeforedawn") {
+			w.Header().Set("Server", "Caddy")
+			w.Header().Set("X-Padding", "000")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		decoyHandler(w, r)
+	}))
+	target.PathPrefixes = []string{"/secondsbeforedawn"}
+	failed := findingsBySeverity(probe.Probe(context.Background(), target), probe.FindingFail)
+	if len(failed) != 2 {
+		t.Fatalf("expected both proxy path requests to fail, got %+v", failed)
+	}
+	for _, finding := range failed {
+		if finding.Check != "http proxy path" ||
+			!strings.Contains(finding.Detail, "status 400") ||
+			!strings.Contains(finding.Detail, "extra header X-Padding") {
+			t.Fatalf("unexpected finding %+v", finding)
+		}
+	}
+}
+
+func selfSignedCertificate(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour * 30),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProbeRealityCertificate(t *testing.T) {
+	real := startDecoy(t, decoyHandler)
+	target := decoyTarget(startDecoy(t, decoyHandler))
+	target.Reality = true
+	target.RealAddress = real.Listener.Addr().String()
+	findings := probe.Probe(context.Background(), target)
+	if failed := findingsBySeverity(findings, probe.FindingFail); len(failed) > 0 {
+		t.Fatalf("the same certificate should pass, got %+v", failed)
+	}
+
+	forged := httptest.NewUnstartedServer(http.HandlerFunc(decoyHandler))
+	forged.TLS = &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t, "forged")}}
+	forged.StartTLS()
+	defer forged.Close()
+	target.Address = forged.Listener.Addr().String()
+	target.Insecure = true
+	failed := findingsBySeverity(probe.Probe(context.Background(), target), probe.FindingFail)
+	if len(failed) != 1 || failed[0].Check != "reality cert" {
+		t.Fatalf("expected a reality cert failure, got %+v", failed)
+	}
+}
@@ -0,0 +1,71 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// what the reality dest negotiated for one server name
+type RealityDestHandshake struct {
+	ServerName string
+	Version    string
+	Curve      string
+	SANs       []string
+}
+
+// Handshakes with dest once per server name the way xray needs it, TLS 1.3
+// over X25519 with a certificate that covers the name
+func CheckRealityDest(
+	ctx context.Context,
+	dest string,
+	serverNames []string,
+	opts RealityScanOptions,
+) ([]RealityDestHandshake, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return nil, fmt.Errorf("dest should be host:port: %w", err)
+	}
+	handshakes := []RealityDestHandshake{}
+	for _, serverName := range serverNames {
+		state, err := tlsHandshake(ctx, dest, &tls.Config{
+			ServerName: serverName,
+			RootCAs:    opts.RootCAs,
+		}, opts.Timeout)
+		hostnameErr := x509.HostnameError{}
+		if errors.As(err, &hostnameErr) {
+			return handshakes, fmt.Errorf("certificate of %s does not cover %s, it is valid for %v",
+				dest, serverName, hostnameErr.Certificate.DNSNames)
+		}
+		if err != nil {
+			return handshakes, fmt.Errorf("%s is not reachable over tls for %s: %w", dest, serverName, err)
+		}
+		if state.Version != tls.VersionTLS13 {
+			return handshakes, fmt.Errorf("%s negotiated %s for %s, reality requires TLS 1.3",
+				dest, tls.VersionName(state.Version), serverName)
+		}
+		// a server without X25519 asks for another curve, which is not offered
+		_, err = tlsHandshake(ctx, dest, &tls.Config{
+			ServerName:       serverName,
+			MinVersion:       tls.VersionTLS13,
+			CurvePreferences: []tls.CurveID{tls.X25519},
+			RootCAs:          opts.RootCAs,
+		}, opts.Timeout)
+		if err != nil {
+			return handshakes, fmt.Errorf("%s does not accept X25519 for %s: %w", dest, serverName, err)
+		}
+		handshakes = append(handshakes, RealityDestHandshake{
+			ServerName: serverName,
+			Version:    tls.VersionName(state.Version),
+			Curve:      tls.X25519.String(),
+			SANs:       state.PeerCertificates[0].DNSNames,
+		})
+	}
+	return handshakes, nil
+}
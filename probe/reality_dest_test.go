@@ -0,0 +1,56 @@
+package probe_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"reflector/probe"
+	"strings"
+	"testing"
+)
+
+func TestCheckRealityDest(t *testing.T) {
+	cert := selfSignedCertificate(t, "example.com")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := probe.RealityScanOptions{RootCAs: x509.NewCertPool()}
+	opts.RootCAs.AddCert(leaf)
+	startDest := func(config *tls.Config) string {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(decoyHandler))
+		server.TLS = config
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server.Listener.Addr().String()
+	}
+
+	good := startDest(&tls.Config{Certificates: []tls.Certificate{cert}})
+	handshakes, err := probe.CheckRealityDest(context.Background(), good, []string{"example.com"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handshakes) != 1 || handshakes[0].Version != "TLS 1.3" || handshakes[0].Curve != "X25519" ||
+		len(handshakes[0].SANs) != 1 || handshakes[0].SANs[0] != "example.com" {
+		t.Fatalf("unexpected handshakes %+v", handshakes)
+	}
+
+	failures := map[string]struct {
+		dest        string
+		serverNames []string
+	}{
+		"TLS 1.3":       {startDest(&tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}), []string{"example.com"}},
+		"X25519":        {startDest(&tls.Config{Certificates: []tls.Certificate{cert}, CurvePreferences: []tls.CurveID{tls.CurveP256}}), []string{"example.com"}},
+		"cover":         {good, []string{"example.com", "www.example.org"}},
+		"host:port":     {"example.com", []string{"example.com"}},
+		"not reachable": {"127.0.0.1:1", []string{"example.com"}},
+	}
+	for expected, failure := range failures {
+		_, err := probe.CheckRealityDest(context.Background(), failure.dest, failure.serverNames, opts)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error about %s, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflector/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// larger ranges stop being a neighborhood of the server
+const maxScanAddresses = 256
+
+type RealityScanOptions struct {
+	Timeout time.Duration
+	// trusted roots, the system pool when nil
+	RootCAs *x509.CertPool
+	// candidates scanned at once
+	Workers int
+}
+
+// A possible reality fqdn, Address is host:port, fqdn:443 when empty
+type RealityCandidate struct {
+	FQDN    string
+	Address string
+
+	TLS13        bool
+	X25519       bool
+	H2           bool
+	OCSPStapling bool
+	// host / redirects to when it is not the fqdn itself
+	RedirectHost string
+	Latency      time.Duration
+	Err          error
+}
+
+func (rc *RealityCandidate) address() string {
+	if rc.Address != "" {
+		return rc.Address
+	}
+	return net.JoinHostPort(rc.FQDN, "443")
+}
+
+// xray needs TLS 1.3 with X25519, clients expect h2 and no redirect away
+func (rc *RealityCandidate) Suitable() bool {
+	return rc.Err == nil && rc.TLS13 && rc.X25519 && rc.H2 && rc.RedirectHost == ""
+}
+
+func (rc *RealityCandidate) score() int {
+	score := 0
+	for _, passed := range []bool{rc.TLS13, rc.X25519, rc.H2, rc.RedirectHost == "", rc.OCSPStapling} {
+		if passed {
+			score += 1
+		}
+	}
+	return score
+}
+
+// lowest of a few tcp connects, handshakes depend on the server too much
+func connectLatency(ctx context.Context, address string, timeout time.Duration) (time.Duration, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var best time.Duration
+	for range 3 {
+		started := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return 0, err
+		}
+		elapsed := time.Since(started)
+		conn.Close()
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best, nil
+}
+
+// host of the redirect on /, empty when there is none or it stays on fqdn
+func redirectHost(ctx context.Context, rc *RealityCandidate, opts RealityScanOptions) (string, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, rc.address())
+			},
+			TLSClientConfig:   &tls.Config{ServerName: rc.FQDN, RootCAs: opts.RootCAs},
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+rc.FQDN+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if errors.Is(err, http.ErrNoLocation) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(location.Hostname(), rc.FQDN) {
+		return "", nil
+	}
+	return location.Hostname(), nil
+}
+
+// Fills in the capabilities of the candidate
+func ScanRealityCandidate(ctx context.Context, rc *RealityCandidate, opts RealityScanOptions) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	state, err := tlsHandshake(ctx, rc.address(), &tls.Config{
+		ServerName: rc.FQDN,
+		NextProtos: []string{"h2", "http/1.1"},
+		RootCAs:    opts.RootCAs,
+	}, opts.Timeout)
+	if err != nil {
+		rc.Err = err
+		return
+	}
+	rc.TLS13 = state.Version == tls.VersionTLS13
+	rc.H2 = state.NegotiatedProtocol == "h2"
+	rc.OCSPStapling = len(state.OCSPResponse) > 0
+
+	// a server without X25519 asks for another curve, which is not offered
+	_, err = tlsHandshake(ctx, rc.address(), &tls.Config{
+		ServerName:       rc.FQDN,
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519},
+		RootCAs:          opts.RootCAs,
+	}, opts.Timeout)
+	rc.X25519 = err == nil
+
+	if rc.RedirectHost, err = redirectHost(ctx, rc, opts); err != nil {
+		rc.Err = err
+		return
+	}
+	rc.Latency, rc.Err = connectLatency(ctx, rc.address(), opts.Timeout)
+}
+
+// Scans every candidate and ranks them, suitable ones first, then by the
+// number of passed checks and latency
+func ScanRealityCandidates(ctx context.Context, candidates []*RealityCandidate, opts RealityScanOptions) []*RealityCandidate {
+	if opts.Workers < 1 {
+		opts.Workers = 16
+	}
+	queue := make(chan *RealityCandidate)
+	wg := sync.WaitGroup{}
+	for range opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rc := range queue {
+				ScanRealityCandidate(ctx, rc, opts)
+				log.GetDefaultLogger().Debug().
+					Update("fqdn", rc.FQDN).
+					Update("address", rc.address()).
+					Update("suitable", rc.Suitable()).
+					Msg("reality candidate scanned")
+			}
+		}()
+	}
+	for _, rc := range candidates {
+		queue <- rc
+	}
+	close(queue)
+	wg.Wait()
+
+	ranked := append([]*RealityCandidate{}, candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Suitable() != b.Suitable() {
+			return a.Suitable()
+		}
+		if a.score() != b.score() {
+			return a.score() > b.score()
+		}
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		return a.Latency < b.Latency
+	})
+	return ranked
+}
+
+// Candidates from the addresses of cidr, names are taken from the
+// certificate every address serves without sni
+func CIDRRealityCandidates(ctx context.Context, cidr string, port int, opts RealityScanOptions) ([]*RealityCandidate, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	if bits := prefix.Addr().BitLen() - prefix.Bits(); bits > 8 {
+		return nil, fmt.Errorf("%s has more than %d addresses", cidr, maxScanAddresses)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 16
+	}
+
+	addresses := []string{}
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		addresses = append(addresses, net.JoinHostPort(addr.String(), fmt.Sprint(port)))
+	}
+	candidates := make([]*RealityCandidate, len(addresses))
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, opts.Workers)
+	for i, address := range addresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			state, err := tlsHandshake(ctx, address, &tls.Config{InsecureSkipVerify: true}, opts.Timeout)
+			if err != nil {
+				return
+			}
+			if name := certificateName(state.PeerCertificates[0]); name != "" {
+				candidates[i] = &RealityCandidate{FQDN: name, Address: address}
+			}
+		}()
+	}
+	wg.Wait()
+
+	found := []*RealityCandidate{}
+	for _, rc := range candidates {
+		if rc != nil {
+			found = append(found, rc)
+		}
+	}
+	return found, nil
+}
+
+// first name of the certificate that can be used as an sni
+func certificateName(cert *x509.Certificate) string {
+	for _, name := range append(cert.DNSNames, cert.Subject.CommonName) {
+		if name != "" && !strings.HasPrefix(name, "*.") && net.ParseIP(name) == nil {
+			return name
+		}
+	}
+	return ""
+}
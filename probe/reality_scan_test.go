@@ -0,0 +1,99 @@
+package probe_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflector/probe"
+	"testing"
+	"time"
+)
+
+type scanServer struct {
+	name     string
+	tls      *tls.Config
+	http2    bool
+	redirect bool
+}
+
+func TestScanRealityCandidates(t *testing.T) {
+	cert := selfSignedCertificate(t, "example.com")
+	stapled := cert
+	stapled.OCSPStaple = []byte("stapled")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	servers := []scanServer{
+		{name: "tls12", tls: &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}, http2: true},
+		{name: "p256", tls: &tls.Config{Certificates: []tls.Certificate{cert}, CurvePreferences: []tls.CurveID{tls.CurveP256}}, http2: true},
+		{name: "h1", tls: &tls.Config{Certificates: []tls.Certificate{cert}}},
+		{name: "redirect", tls: &tls.Config{Certificates: []tls.Certificate{cert}}, http2: true, redirect: true},
+		{name: "good", tls: &tls.Config{Certificates: []tls.Certificate{stapled}}, http2: true},
+	}
+	candidates := []*probe.RealityCandidate{}
+	names := map[*probe.RealityCandidate]string{}
+	for _, s := range servers {
+		redirect := s.redirect
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if redirect {
+				http.Redirect(w, r, "https://elsewhere.example/", http.StatusMovedPermanently)
+			}
+		}))
+		server.TLS = s.tls
+		server.EnableHTTP2 = s.http2
+		server.StartTLS()
+		defer server.Close()
+		rc := &probe.RealityCandidate{FQDN: "example.com", Address: server.Listener.Addr().String()}
+		names[rc] = s.name
+		candidates = append(candidates, rc)
+	}
+
+	ranked := probe.ScanRealityCandidates(context.Background(), candidates, probe.RealityScanOptions{
+		Timeout: 5 * time.Second,
+		RootCAs: roots,
+	})
+	best := ranked[0]
+	if names[best] != "good" || !best.Suitable() || !best.OCSPStapling || best.Latency == 0 {
+		t.Fatalf("expected the good server first, got %s %+v", names[best], best)
+	}
+	for _, rc := range ranked[1:] {
+		if rc.Suitable() {
+			t.Errorf("%s should not be suitable: %+v", names[rc], rc)
+		}
+		failed := map[string]bool{
+			"tls12":    !rc.TLS13,
+			"p256":     !rc.X25519,
+			"h1":       !rc.H2,
+			"redirect": rc.RedirectHost == "elsewhere.example",
+		}
+		if !failed[names[rc]] {
+			t.Errorf("%s was not flagged: %+v", names[rc], rc)
+		}
+	}
+}
+
+func TestCIDRRealityCandidates(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(decoyHandler))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t, "example.com")}}
+	server.StartTLS()
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	candidates, err := probe.CIDRRealityCandidates(context.Background(), "127.0.0.1/32", port, probe.RealityScanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].FQDN != "example.com" {
+		t.Fatalf("expected example.com from the certificate, got %+v", candidates)
+	}
+	if _, err := probe.CIDRRealityCandidates(context.Background(), "10.0.0.0/16", 443, probe.RealityScanOptions{}); err == nil {
+		t.Fatal("large ranges should be refused")
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// git+https://host/repo.git#ref:subdir, ref defaults to HEAD, subdir to the
+// repository root. Returns the commit hash.
+func unpackGit(ref, dest string, options UnpackOptions) (string, error) {
+	repository, fragment, _ := strings.Cut(strings.TrimPrefix(ref, "git+"), "#")
+	gitRef, subdir, _ := strings.Cut(fragment, ":")
+	if gitRef == "" {
+		gitRef = "HEAD"
+	}
+	if strings.HasPrefix(repository, "-") || strings.HasPrefix(gitRef, "-") {
+		return "", fmt.Errorf("invalid git source %s", ref)
+	}
+	options.Subdir = path.Join("/", subdir, options.Subdir)
+
+	workdir, err := os.MkdirTemp("", "reflector-git-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workdir)
+	git := func(stdout io.Writer, args ...string) error {
+		stderr := bytes.NewBuffer(nil)
+		cmd := exec.Command("git", append([]string{"-C", workdir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	if err := git(nil, "init", "--quiet", "--bare"); err != nil {
+		return "", err
+	}
+	if err := git(nil, "fetch", "--quiet", "--depth", "1", repository, gitRef); err != nil {
+		return "", err
+	}
+	commit := bytes.NewBuffer(nil)
+	if err := git(commit, "rev-parse", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+
+	// the tree goes through the same checks as image layers
+	archiveReader, archiveWriter := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		err := git(archiveWriter, "archive", "--format=tar", "FETCH_HEAD")
+		archiveWriter.CloseWithError(err)
+		archived <- err
+	}()
+	err = UnpackTarWithOptions(archiveReader, dest, options)
+	if err == nil {
+		// git pads the archive past the end marker tar stops at
+		_, err = io.Copy(io.Discard, archiveReader)
+	}
+	archiveReader.CloseWithError(io.ErrClosedPipe)
+	if archiveErr := <-archived; err == nil && archiveErr != nil {
+		err = archiveErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit.String()), nil
+}
+
+func isZip(location string) bool {
+	return strings.HasSuffix(strings.ToLower(location), ".zip")
+}
+
+// tar or gzipped tar, told apart by the gzip magic bytes
+func unpackTarball(tarballReader io.Reader, dest string, options UnpackOptions) error {
+	buffered := bufio.NewReader(tarballReader)
+	magic, _ := buffered.Peek(2)
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return UnpackTarWithOptions(buffered, dest, options)
+	}
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	return UnpackTarWithOptions(gzipReader, dest, options)
+}
+
+// zip entries are rewritten as a tar stream, so they go through the same
+// checks as tarballs
+func unpackZip(zar *zip.Reader, dest string, options UnpackOptions) error {
+	tarReader, tarWriter := io.Pipe()
+	go func() {
+		tarWriter.CloseWithError(zipToTar(zar, tarWriter))
+	}()
+	err := UnpackTarWithOptions(tarReader, dest, options)
+	tarReader.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+func zipToTar(zar *zip.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, zfile := range zar.File {
+		info := zfile.FileInfo()
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkBytes, err := readZipFile(zfile)
+			if err != nil {
+				return err
+			}
+			link = string(linkBytes)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = zfile.Name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		zFileDescriptor, err := zfile.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, zFileDescriptor)
+		zFileDescriptor.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", zfile.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func readZipFile(zfile *zip.File) ([]byte, error) {
+	zFileDescriptor, err := zfile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer zFileDescriptor.Close()
+	return io.ReadAll(zFileDescriptor)
+}
+
+func archiveDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// file:///site.tar.gz, file:///site.zip or a folder, returns the sha256 of
+// archives
+func unpackArchiveFile(ref, dest string, options UnpackOptions) (string, error) {
+	location := strings.TrimPrefix(ref, "file://")
+	if stat, err := os.Stat(location); err == nil && stat.IsDir() {
+		return "", CopyDir(path.Join(location, options.Subdir), dest)
+	}
+	archive, err := os.Open(location)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	h := sha256.New()
+	if isZip(location) {
+		stat, err := archive.Stat()
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, archive); err != nil {
+			return "", err
+		}
+		zar, err := zip.NewReader(archive, stat.Size())
+		if err != nil {
+			return "", err
+		}
+		if err := unpackZip(zar, dest, options); err != nil {
+			return "", err
+		}
+		return archiveDigest(h), nil
+	}
+	if err := unpackTarball(io.TeeReader(archive, h), dest, options); err != nil {
+		return "", err
+	}
+	// trailing padding the tar reader left unread
+	if _, err := io.Copy(h, archive); err != nil {
+		return "", err
+	}
+	return archiveDigest(h), nil
+}
+
+// https://.../site.tar.gz or https://.../site.zip, zips are downloaded to a
+// temporary file first, tarballs are streamed
+func unpackArchiveURL(ref, dest string, options UnpackOptions) (string, error) {
+	if isZip(strings.Split(ref, "?")[0]) {
+		download, err := os.CreateTemp("", "reflector-camo-*.zip")
+		if err != nil {
+			return "", err
+		}
+		download.Close()
+		defer os.Remove(download.Name())
+		if err := DownloadFile(download.Name(), ref); err != nil {
+			return "", err
+		}
+		return unpackArchiveFile(download.Name(), dest, options)
+	}
+
+	resp, err := http.Get(ref)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status: %s", resp.Status)
+	}
+	h := sha256.New()
+	if err := unpackTarball(io.TeeReader(resp.Body, h), dest, options); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return archiveDigest(h), nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// simple signing payload cosign signs for an image
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+func ParsePublicKeyPEM(publicKeyPEM []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block in the public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func verifySignature(publicKey crypto.PublicKey, payload []byte, signature []byte) error {
+	digest := sha256.Sum256(payload)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("ecdsa signature mismatch")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// Checks that one of the cosign signatures stored next to the image, under
+// the sha256-<hex>.sig tag, is made by publicKeyPEM for exactly this digest
+func VerifyCosignSignature(repository name.Repository, digest v1.Hash, publicKeyPEM []byte, options ...remote.Option) error {
+	publicKey, err := ParsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	signatureTag := repository.Tag(strings.Replace(digest.String(), ":", "-", 1) + ".sig")
+	signatureImage, err := remote.Image(signatureTag, options...)
+	if err != nil {
+		return fmt.Errorf("no signature at %s: %w", signatureTag, err)
+	}
+	manifest, err := signatureImage.Manifest()
+	if err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for _, descriptor := range manifest.Layers {
+		encodedSignature, exists := descriptor.Annotations[cosignSignatureAnnotation]
+		if !exists {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		layer, err := signatureImage.LayerByDigest(descriptor.Digest)
+		if err != nil {
+			return err
+		}
+		payloadReader, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		payload, err := io.ReadAll(payloadReader)
+		payloadReader.Close()
+		if err != nil {
+			return err
+		}
+		if err := verifySignature(publicKey, payload, signature); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		// the signature is only worth something for the digest it names
+		signed := cosignPayload{}
+		if err := json.Unmarshal(payload, &signed); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if signed.Critical.Image.DockerManifestDigest != digest.String() {
+			failures = append(failures, "signature is for "+signed.Critical.Image.DockerManifestDigest)
+			continue
+		}
+		return nil
+	}
+	if len(failures) == 0 {
+		return fmt.Errorf("%s has no cosign signatures", signatureTag)
+	}
+	return fmt.Errorf("no valid signature for %s: %s", digest, strings.Join(failures, ", "))
+}
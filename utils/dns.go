@@ -17,7 +17,8 @@ func IsLocalIPAddress(address net.IPAddr) bool {
 	}
 	for _, addr := range addrs {
 		ipNet, ok := addr.(*net.IPNet)
-		if ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+		// link-local addresses are never reachable through DNS
+		if ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
 			if ipNet.IP.Equal(address.IP) {
 				return true
 			}
@@ -26,10 +27,22 @@ func IsLocalIPAddress(address net.IPAddr) bool {
 	return false
 }
 
+// both A and AAAA records
 func NSLookup(fqdn string) ([]net.IPAddr, error) {
 	return net.DefaultResolver.LookupIPAddr(context.Background(), fqdn)
 }
 
+func SplitIPFamilies(addresses []net.IPAddr) (v4 []net.IPAddr, v6 []net.IPAddr) {
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			v4 = append(v4, address)
+		} else {
+			v6 = append(v6, address)
+		}
+	}
+	return v4, v6
+}
+
 func IsDomainPointingToThisHost(fqdn string) bool {
 	addresses, err := NSLookup(fqdn)
 	if err != nil {
@@ -53,3 +53,23 @@ func CopyDir(src, dest string) error {
 		return os.WriteFile(target, data, info.Mode())
 	})
 }
+
+// total size of the regular files under path
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
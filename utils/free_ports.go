@@ -1,12 +1,32 @@
 package utils
 
 import (
-	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
-func IsPortBindable(port int) bool {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Used when listen is unset, by xray, caddy and the bind checks alike. Go
+// programs listen on both families for it, and unlike '::' it still binds
+// on hosts with IPv6 disabled
+const DefaultListen = "0.0.0.0"
+
+// host:port for binding, both bare and bracketed IPv6 addresses are accepted
+func ListenAddress(listen string, port int) string {
+	return net.JoinHostPort(ListenHost(listen), strconv.Itoa(port))
+}
+
+// listen address without IPv6 brackets, as xray expects it, DefaultListen
+// when unset
+func ListenHost(listen string) string {
+	if listen == "" {
+		return DefaultListen
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(listen, "["), "]")
+}
+
+func IsPortBindable(listen string, port int) bool {
+	ln, err := net.Listen("tcp", ListenAddress(listen, port))
 	if err != nil {
 		return false
 	}
@@ -14,6 +34,16 @@ func IsPortBindable(port int) bool {
 	return true
 }
 
+// QUIC/HTTP3 listeners need the same port over UDP
+func IsUDPPortBindable(listen string, port int) bool {
+	conn, err := net.ListenPacket("udp", ListenAddress(listen, port))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
 func FindFreePorts(n int) ([]int, error) {
 	ports := make([]int, 0, n)
 
@@ -1,11 +1,16 @@
 package utils
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"reflector/decoy"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 type ContainerImageController struct {
@@ -16,36 +21,107 @@ func NewContainerImageController() *ContainerImageController {
 	return &ContainerImageController{DefaultRegistry: "docker.io/library"}
 }
 
-func (c *ContainerImageController) UnpackImage(ref, dest string) error {
+// Unpacks ref into dest, returns the image digest, empty for local folders
+func (c *ContainerImageController) UnpackImage(ref, dest string) (string, error) {
+	return c.UnpackImageWithOptions(ref, dest, UnpackOptions{})
+}
+
+// Same as UnpackImage, images are checked against the cosign public key
+// before anything is unpacked when publicKeyPEM is set
+func (c *ContainerImageController) UnpackVerifiedImage(ref, dest string, publicKeyPEM []byte) (string, error) {
+	return c.UnpackImageWithOptions(ref, dest, UnpackOptions{PublicKeyPEM: publicKeyPEM})
+}
+
+// true for refs that are pulled from a registry
+func IsContainerImage(ref string) bool {
+	for _, prefix := range []string{"generate://", "git+", "file://", "http://", "https://", "./", "/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// ref can also be a git repository, git+https://host/repo.git#ref:subdir,
+// a tarball or zip, file:///site.tar.gz, https://host/site.zip, or a generated
+// site, generate://blog?seed=... The digest is the commit of repositories and
+// the sha256 of archives.
+func (c *ContainerImageController) UnpackImageWithOptions(ref, dest string, options UnpackOptions) (string, error) {
+	if options.PublicKeyPEM != nil && !IsContainerImage(ref) {
+		return "", errors.New("only container images can be verified")
+	}
 	switch {
+	case strings.HasPrefix(ref, "generate://"):
+		return "", decoy.Generate(ref, dest)
+	case strings.HasPrefix(ref, "git+"):
+		return unpackGit(ref, dest, options)
+	case strings.HasPrefix(ref, "file://"):
+		return unpackArchiveFile(ref, dest, options)
+	case strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://"):
+		return unpackArchiveURL(ref, dest, options)
 	case strings.HasPrefix(ref, "docker://"):
-		return c.unpackContainerImage(strings.TrimPrefix(ref, "docker://"), dest)
+		return c.unpackContainerImage(strings.TrimPrefix(ref, "docker://"), dest, options)
 	case strings.HasPrefix(ref, "oci://"):
-		return c.unpackContainerImage(strings.TrimPrefix(ref, "oci://"), dest)
+		return c.unpackContainerImage(strings.TrimPrefix(ref, "oci://"), dest, options)
 	case strings.HasPrefix(ref, "./") || strings.HasPrefix(ref, "/"):
-		return CopyDir(ref, dest)
+		return "", CopyDir(filepath.Join(ref, options.Subdir), dest)
 	default:
 		// Assume it's a plain image name, prepend default registry
 		imageRef := fmt.Sprintf("%s/%s", strings.TrimSuffix(c.DefaultRegistry, "/"), ref)
-		return c.unpackContainerImage(imageRef, dest)
+		return c.unpackContainerImage(imageRef, dest, options)
 	}
 }
 
-func (c *ContainerImageController) unpackContainerImage(ref, dest string) error {
-	img, err := crane.Pull(ref)
+// ref may be a tag or pinned as repo@sha256:..., the returned digest is the
+// one of ref, the index for multi platform images
+func (c *ContainerImageController) unpackContainerImage(ref, dest string, options UnpackOptions) (string, error) {
+	parsedRef, err := name.ParseReference(ref)
 	if err != nil {
-		return err
+		return "", err
 	}
-	buff := bytes.NewBuffer(make([]byte, 0))
-
-	err = crane.Export(img, buff)
+	desc, err := remote.Get(parsedRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
 	if err != nil {
-		return err
+		return "", err
+	}
+	// signatures are made for the digest the reference points to
+	digest := desc.Digest
+	if options.PublicKeyPEM != nil {
+		err := VerifyCosignSignature(
+			parsedRef.Context(), digest, options.PublicKeyPEM,
+			remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return "", fmt.Errorf("signature verification failed: %w", err)
+		}
+	}
+	// the platform image of an index, the image itself otherwise
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+	if err := UnpackImageLayers(img, dest, options); err != nil {
+		return "", err
 	}
+	return digest.String(), nil
+}
 
-	err = UnpackTar(buff, dest)
+// Streams the layers of img into dest bottom up, whiteouts of upper layers
+// remove what lower ones unpacked
+func UnpackImageLayers(img v1.Image, dest string, options UnpackOptions) error {
+	layers, err := img.Layers()
 	if err != nil {
 		return err
 	}
-	return nil
+	extractor := newTarExtractor(dest, options)
+	for i, layer := range layers {
+		layerReader, err := layer.Uncompressed()
+		if err != nil {
+			return err
+		}
+		err = extractor.extractLayer(layerReader)
+		layerReader.Close()
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	return extractor.checkLinks()
 }
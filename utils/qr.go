@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// links are long, medium recovery keeps the code scannable off a screen share
+const qrRecoveryLevel = qrcode.Medium
+
+// Half block rendering, light modules are drawn so it scans on dark terminals
+func QRTerminal(content string) (string, error) {
+	qr, err := qrcode.New(content, qrRecoveryLevel)
+	if err != nil {
+		return "", err
+	}
+	return qr.ToSmallString(false), nil
+}
+
+// size is the image side in pixels
+func WriteQRPNG(content string, path string, size int) error {
+	qr, err := qrcode.New(content, qrRecoveryLevel)
+	if err != nil {
+		return err
+	}
+	return qr.WriteFile(size, path)
+}
+
+// one rect per dark module, the viewBox is in modules so it scales freely
+func QRSVG(content string) (string, error) {
+	qr, err := qrcode.New(content, qrRecoveryLevel)
+	if err != nil {
+		return "", err
+	}
+	bits := qr.Bitmap()
+	svg := &strings.Builder{}
+	fmt.Fprintf(svg,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		len(bits), len(bits))
+	fmt.Fprintf(svg, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", len(bits), len(bits))
+	svg.WriteString(`<path fill="#000" d="`)
+	for y := range bits {
+		for x := range bits[y] {
+			if bits[y][x] {
+				fmt.Fprintf(svg, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	svg.WriteString(`"/>` + "\n</svg>\n")
+	return svg.String(), nil
+}
+
+func WriteQRSVG(content string, path string) error {
+	svg, err := QRSVG(content)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(svg), 0o644)
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// '50GiB', '1.5 TB', '1024' -> bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	split := strings.IndexFunc(size, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '.'
+	})
+	number, unit := size, ""
+	if split >= 0 {
+		number, unit = size[:split], strings.TrimSpace(size[split:])
+	}
+	multiplier, exists := sizeUnits[strings.ToLower(unit)]
+	if !exists {
+		return 0, fmt.Errorf("unknown size unit: %s", unit)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("negative size: %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// bytes -> '1.5GiB'
+func FormatSize(bytes int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	number := strings.TrimRight(strconv.FormatFloat(value, 'f', 2, 64), "0")
+	return strings.TrimSuffix(number, ".") + units[unit]
+}
@@ -2,18 +2,251 @@ package utils
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"reflector/log"
+	"strings"
 )
 
+const (
+	whiteoutPrefix = ".wh."
+	// hides everything lower layers put in the directory
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// How an image or tarball is unpacked, the zero value unpacks everything
+type UnpackOptions struct {
+	// only this directory is unpacked, as the root of dest, e.g. /srv/www
+	Subdir string
+	// bytes of file content unpacking fails past, 0 is unlimited
+	MaxSize int64
+	// cosign public key the image must be signed with, images only
+	PublicKeyPEM []byte
+}
+
+// Extracts tarballs, or image layers one after the other, into dest. Entries
+// can't leave dest, neither by their name nor through symlinks.
+type tarExtractor struct {
+	dest    string
+	subdir  string
+	maxSize int64
+	written int64
+	// paths of the current layer and their parents, opaque whiteouts keep them
+	layerPaths map[string]bool
+}
+
+func newTarExtractor(dest string, options UnpackOptions) *tarExtractor {
+	return &tarExtractor{
+		dest:    dest,
+		subdir:  strings.Trim(path.Clean("/"+options.Subdir), "/"),
+		maxSize: options.MaxSize,
+	}
+}
+
 func UnpackTar(tarballReader io.Reader, dest string) error {
+	return UnpackTarWithOptions(tarballReader, dest, UnpackOptions{})
+}
+
+func UnpackTarWithOptions(tarballReader io.Reader, dest string, options UnpackOptions) error {
+	extractor := newTarExtractor(dest, options)
+	if err := extractor.extractLayer(tarballReader); err != nil {
+		return err
+	}
+	return extractor.checkLinks()
+}
+
+// archive name relative to the subdir, false when it is outside of it
+func (x *tarExtractor) relative(name string) (string, bool) {
+	switch {
+	case x.subdir == "":
+		return name, true
+	case name == x.subdir:
+		return ".", true
+	case strings.HasPrefix(name, x.subdir+"/"):
+		return strings.TrimPrefix(name, x.subdir+"/"), true
+	default:
+		return "", false
+	}
+}
+
+// true when removing name removes the whole subdir
+func (x *tarExtractor) coversSubdir(name string) bool {
+	return x.subdir != "" && (name == x.subdir || name == "." || strings.HasPrefix(x.subdir, name+"/"))
+}
+
+func cleanArchiveName(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("absolute path %s", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %s leaves the archive", name)
+	}
+	return cleaned, nil
+}
+
+// entries are never written through symlinks, otherwise a link that is fine
+// where it stands could move later entries out of dest
+func (x *tarExtractor) checkParents(rel string) error {
+	current := x.dest
+	parts := strings.Split(path.Dir(rel), "/")
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		stat, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is written through the symlink %s", rel, current)
+		}
+	}
+	return nil
+}
+
+// link target relative to the link, absolute targets are taken as paths of
+// the archive root, false when the target is outside of dest
+func (x *tarExtractor) containedLink(rel string, linkname string) (string, bool) {
+	if path.IsAbs(linkname) {
+		target, ok := x.relative(strings.TrimPrefix(path.Clean(linkname), "/"))
+		if !ok {
+			return "", false
+		}
+		relativeTarget, err := filepath.Rel(path.Dir(rel), target)
+		if err != nil {
+			return "", false
+		}
+		return filepath.ToSlash(relativeTarget), true
+	}
+	target := path.Join(path.Dir(rel), linkname)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return linkname, true
+}
+
+// Links are only checked lexically while unpacking, later entries can still
+// change what their directories resolve to, e.g. x/s -> .., y -> x/s/..
+// Once everything is unpacked every link is resolved on disk, links that
+// resolve out of dest fail the unpacking and dangling ones are removed.
+func (x *tarExtractor) checkLinks() error {
+	root, err := filepath.EvalSymlinks(x.dest)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(x.dest, func(location string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		resolved, err := filepath.EvalSymlinks(location)
+		if err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("path", location).
+				Update("err", err.Error()).
+				Msg("removing symlink that does not resolve")
+			return os.Remove(location)
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("symlink %s resolves out of the unpacked root", location)
+		}
+		return nil
+	})
+}
+
+func (x *tarExtractor) markWritten(rel string) {
+	for ; rel != "." && rel != "/"; rel = path.Dir(rel) {
+		x.layerPaths[rel] = true
+	}
+}
+
+// replaces whatever is at target unless both are directories
+func removeExisting(target string, isDir bool) error {
+	stat, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isDir && stat.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+func (x *tarExtractor) clearDir(rel string, keepLayerPaths bool) error {
+	dir := filepath.Join(x.dest, rel)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := path.Join(rel, entry.Name())
+		if keepLayerPaths && x.layerPaths[child] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removes what lower layers put where the whiteout points
+func (x *tarExtractor) applyWhiteout(name string) error {
+	dir, base := path.Split(name)
+	dir = path.Clean(dir)
+	if base == whiteoutOpaque {
+		if x.coversSubdir(dir) && dir != x.subdir {
+			return x.clearDir(".", true)
+		}
+		if rel, ok := x.relative(dir); ok {
+			if err := x.checkParents(path.Join(rel, "_")); err != nil {
+				return err
+			}
+			return x.clearDir(rel, true)
+		}
+		return nil
+	}
+	hidden := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	if x.coversSubdir(hidden) {
+		return x.clearDir(".", false)
+	}
+	if rel, ok := x.relative(hidden); ok {
+		if err := x.checkParents(rel); err != nil {
+			return err
+		}
+		return os.RemoveAll(filepath.Join(x.dest, rel))
+	}
+	return nil
+}
+
+// extractLayer applies one tarball on top of what dest already has
+func (x *tarExtractor) extractLayer(tarballReader io.Reader) error {
+	if err := os.MkdirAll(x.dest, 0o755); err != nil {
+		return err
+	}
+	x.layerPaths = map[string]bool{}
 	tarr := tar.NewReader(tarballReader)
 
 	for {
 		hdr, err := tarr.Next()
-		//fmt.Printf("new file %s\n", hdr.Name)
 		if err == io.EOF {
 			break
 		}
@@ -21,20 +254,51 @@ func UnpackTar(tarballReader io.Reader, dest string) error {
 			return fmt.Errorf("reading tar header: %w", err)
 		}
 
-		target := filepath.Join(dest, hdr.Name)
+		name, err := cleanArchiveName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			if err := x.applyWhiteout(name); err != nil {
+				return fmt.Errorf("applying whiteout %s: %w", name, err)
+			}
+			continue
+		}
+		rel, ok := x.relative(name)
+		if !ok {
+			continue
+		}
+		if rel == "." && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%s is not a directory", name)
+		}
+		if err := x.checkParents(rel); err != nil {
+			return err
+		}
+		target := filepath.Join(x.dest, rel)
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, hdr.FileInfo().Mode()); err != nil {
+			if err := removeExisting(target, true); err != nil {
+				return err
+			}
+			// owner write is kept, children still have to be created
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0o700); err != nil {
 				return fmt.Errorf("creating dir %s: %w", target, err)
 			}
 
 		case tar.TypeReg:
+			if x.maxSize > 0 && x.written+hdr.Size > x.maxSize {
+				return fmt.Errorf("unpacking %s exceeds the size limit of %s", rel, FormatSize(x.maxSize))
+			}
+			x.written += hdr.Size
 			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
 				return fmt.Errorf("creating parent dirs for %s: %w", target, err)
 			}
+			if err := removeExisting(target, false); err != nil {
+				return err
+			}
 
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode())
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, hdr.FileInfo().Mode().Perm())
 			if err != nil {
 				return fmt.Errorf("creating file %s: %w", target, err)
 			}
@@ -47,21 +311,56 @@ func UnpackTar(tarballReader io.Reader, dest string) error {
 			f.Close()
 
 		case tar.TypeSymlink:
+			linkname, ok := x.containedLink(rel, hdr.Linkname)
+			if !ok {
+				log.GetDefaultLogger().Warning().
+					Update("path", rel).
+					Update("link", hdr.Linkname).
+					Msg("skipping symlink out of the unpacked root")
+				continue
+			}
 			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
 				return fmt.Errorf("creating parent dirs for symlink %s: %w", target, err)
 			}
-			if err := os.Symlink(hdr.Linkname, target); err != nil && !os.IsExist(err) {
+			if err := removeExisting(target, false); err != nil {
+				return err
+			}
+			if err := os.Symlink(linkname, target); err != nil {
 				return fmt.Errorf("creating symlink %s: %w", target, err)
 			}
 
 		case tar.TypeLink:
-			if err := os.Link(filepath.Join(dest, hdr.Linkname), target); err != nil {
+			linkname, err := cleanArchiveName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			source, ok := x.relative(linkname)
+			if !ok {
+				log.GetDefaultLogger().Warning().
+					Update("path", rel).
+					Update("link", hdr.Linkname).
+					Msg("skipping hard link out of the unpacked root")
+				continue
+			}
+			if err := x.checkParents(source); err != nil {
+				return err
+			}
+			// the link would be a copy of the symlink, resolved from another dir
+			if stat, err := os.Lstat(filepath.Join(x.dest, source)); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("hard link %s to the symlink %s", rel, source)
+			}
+			if err := removeExisting(target, false); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(x.dest, source), target); err != nil {
 				return fmt.Errorf("creating hard link %s: %w", target, err)
 			}
 
 		default:
 			// ignore other types
+			continue
 		}
+		x.markWritten(rel)
 	}
 
 	return nil
@@ -1,9 +1,37 @@
 package utils_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflector/utils"
+	"strings"
 	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 func TestUnpackZipSubpath(t *testing.T) {
@@ -13,3 +41,534 @@ func TestUnpackZipSubpath(t *testing.T) {
 func TestFindFreePorts(t *testing.T) {
 	fmt.Println(utils.FindFreePorts(1))
 }
+
+func TestListenAddress(t *testing.T) {
+	cases := map[string]string{
+		"":        "0.0.0.0:443",
+		"0.0.0.0": "0.0.0.0:443",
+		"::":      "[::]:443",
+		"[::]":    "[::]:443",
+		"[::1]":   "[::1]:443",
+	}
+	for listen, expected := range cases {
+		if address := utils.ListenAddress(listen, 443); address != expected {
+			t.Fatalf("ListenAddress(%q) = %q, expected %q", listen, address, expected)
+		}
+	}
+}
+
+func TestIsPortBindableIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback available")
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if utils.IsPortBindable("::1", port) || utils.IsPortBindable("[::1]", port) {
+		t.Fatalf("port in use should not be bindable")
+	}
+	ln.Close()
+	if !utils.IsPortBindable("::1", port) || !utils.IsPortBindable("[::1]", port) {
+		t.Fatalf("free port should be bindable with bare and bracketed addresses")
+	}
+}
+
+func TestIsUDPPortBindable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if utils.IsUDPPortBindable("127.0.0.1", port) {
+		t.Fatalf("taken udp port should not be bindable")
+	}
+	conn.Close()
+	if !utils.IsUDPPortBindable("127.0.0.1", port) {
+		t.Fatalf("free udp port should be bindable")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"1024":   1024,
+		"50GiB":  50 << 30,
+		"1.5 GB": 1500 * 1000 * 1000,
+		"500mib": 500 << 20,
+		"10B":    10,
+		"0.5KiB": 512,
+	}
+	for size, expected := range cases {
+		parsed, err := utils.ParseSize(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != expected {
+			t.Fatalf("ParseSize(%q) = %d, expected %d", size, parsed, expected)
+		}
+	}
+	for _, invalid := range []string{"", "GiB", "10 parsecs", "-1GB"} {
+		if _, err := utils.ParseSize(invalid); err == nil {
+			t.Fatalf("ParseSize(%q) should fail", invalid)
+		}
+	}
+	if formatted := utils.FormatSize(3 << 29); formatted != "1.5GiB" {
+		t.Fatalf("unexpected formatted size %s", formatted)
+	}
+}
+
+func TestQR(t *testing.T) {
+	link := "vless://bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb@example.com:443?security=tls&type=tcp#bob"
+	terminal, err := utils.QRTerminal(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.ContainsAny(terminal, "▀▄█") {
+		t.Fatal("terminal qr should be drawn with half blocks")
+	}
+	svg, err := utils.QRSVG(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, "h1v1h-1z") {
+		t.Fatalf("unexpected svg %s", svg)
+	}
+	pngPath := filepath.Join(t.TempDir(), "bob.png")
+	if err := utils.WriteQRPNG(link, pngPath, 256); err != nil {
+		t.Fatal(err)
+	}
+	png, err := os.ReadFile(pngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Fatal("expected a png file")
+	}
+}
+
+// pushes a random image and, when signer is set, a cosign signature of it
+// to an in-process registry
+func pushTestImage(t *testing.T, signer *ecdsa.PrivateKey) (string, v1.Hash) {
+	server := httptest.NewServer(registry.New())
+	t.Cleanup(server.Close)
+	repository, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/camo/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repository.Tag("latest"), img); err != nil {
+		t.Fatal(err)
+	}
+	signTestImage(t, repository, digest, signer)
+	return repository.String(), digest
+}
+
+// multi platform image, the signature is made for the index
+func pushTestIndex(t *testing.T, signer *ecdsa.PrivateKey) (string, v1.Hash) {
+	server := httptest.NewServer(registry.New())
+	t.Cleanup(server.Close)
+	repository, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/camo/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index v1.ImageIndex = empty.Index
+	for _, platform := range []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}} {
+		img, err := random.Image(512, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(repository.Tag("latest"), index); err != nil {
+		t.Fatal(err)
+	}
+	signTestImage(t, repository, digest, signer)
+	return repository.String(), digest
+}
+
+// cosign signature of digest, nothing is signed without signer
+func signTestImage(t *testing.T, repository name.Repository, digest v1.Hash, signer *ecdsa.PrivateKey) {
+	if signer == nil {
+		return
+	}
+	payload := fmt.Sprintf(
+		`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		repository.String(), digest.String())
+	payloadDigest := sha256.Sum256([]byte(payload))
+	signature, err := ecdsa.SignASN1(rand.Reader, signer, payloadDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureImage, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: static.NewLayer([]byte(payload), "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: map[string]string{
+			"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureTag := repository.Tag(strings.Replace(digest.String(), ":", "-", 1) + ".sig")
+	if err := remote.Write(signatureTag, signatureImage); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publicKeyPEM(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestVerifyCosignSignature(t *testing.T) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedRepository, signedDigest := pushTestImage(t, signer)
+	unsignedRepository, unsignedDigest := pushTestImage(t, nil)
+	cases := []struct {
+		name       string
+		repository string
+		digest     v1.Hash
+		key        []byte
+		valid      bool
+	}{
+		{"signed", signedRepository, signedDigest, publicKeyPEM(t, signer), true},
+		{"wrong key", signedRepository, signedDigest, publicKeyPEM(t, other), false},
+		{"unsigned", unsignedRepository, unsignedDigest, publicKeyPEM(t, signer), false},
+	}
+	for _, c := range cases {
+		repository, err := name.NewRepository(c.repository)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = utils.VerifyCosignSignature(repository, c.digest, c.key)
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: verified", c.name)
+		}
+	}
+}
+
+func TestUnpackVerifiedImage(t *testing.T) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, digest := pushTestImage(t, signer)
+	cic := utils.NewContainerImageController()
+
+	pinned := "docker://" + repository + "@" + digest.String()
+	dest := filepath.Join(t.TempDir(), "pinned")
+	got, err := cic.UnpackVerifiedImage(pinned, dest, publicKeyPEM(t, signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != digest.String() {
+		t.Errorf("digest %s, expected %s", got, digest)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest = filepath.Join(t.TempDir(), "rejected")
+	if _, err := cic.UnpackVerifiedImage("docker://"+repository+":latest", dest, publicKeyPEM(t, other)); err == nil {
+		t.Error("unpacked with the wrong key")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("rejected image was unpacked")
+	}
+
+	// the signature covers the index the tag points to, not the platform image
+	repository, digest = pushTestIndex(t, signer)
+	dest = filepath.Join(t.TempDir(), "index")
+	got, err = cic.UnpackVerifiedImage("docker://"+repository+":latest", dest, publicKeyPEM(t, signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != digest.String() {
+		t.Errorf("digest %s, expected the index digest %s", got, digest)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) == 0 {
+		t.Error("the platform image was not unpacked")
+	}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func tarball(t *testing.T, entries ...tarEntry) []byte {
+	buff := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buff)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0o644, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func TestUnpackTarRejects(t *testing.T) {
+	cases := map[string][]tarEntry{
+		"parent":   {{name: "../escape", typeflag: tar.TypeReg, content: "x"}},
+		"nested":   {{name: "a/../../escape", typeflag: tar.TypeReg, content: "x"}},
+		"absolute": {{name: "/etc/escape", typeflag: tar.TypeReg, content: "x"}},
+		"through symlink": {
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "link/file", typeflag: tar.TypeReg, content: "x"},
+		},
+		"hard link": {{name: "file", typeflag: tar.TypeLink, linkname: "../../etc/passwd"}},
+		"chained symlinks": {
+			{name: "x/s", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "y", typeflag: tar.TypeSymlink, linkname: "x/s/.."},
+			{name: "z", typeflag: tar.TypeSymlink, linkname: "y/.."},
+		},
+		"hard link to symlink": {
+			{name: "a/b/up", typeflag: tar.TypeSymlink, linkname: "../.."},
+			{name: "up", typeflag: tar.TypeLink, linkname: "a/b/up"},
+		},
+		"size": {
+			{name: "a", typeflag: tar.TypeReg, content: "12345"},
+			{name: "b", typeflag: tar.TypeReg, content: "12345"},
+		},
+	}
+	for name, entries := range cases {
+		dest := filepath.Join(t.TempDir(), "dest")
+		err := utils.UnpackTarWithOptions(bytes.NewReader(tarball(t, entries...)), dest, utils.UnpackOptions{MaxSize: 8})
+		if err == nil {
+			t.Errorf("%s: unpacked", name)
+		}
+	}
+}
+
+func TestUnpackTarSymlinks(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "dest")
+	err := utils.UnpackTarWithOptions(bytes.NewReader(tarball(t,
+		tarEntry{name: "srv/www/index.html", typeflag: tar.TypeReg, content: "index"},
+		tarEntry{name: "srv/www/assets/", typeflag: tar.TypeDir},
+		tarEntry{name: "srv/www/assets/home.html", typeflag: tar.TypeSymlink, linkname: "/srv/www/index.html"},
+		tarEntry{name: "srv/www/passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		tarEntry{name: "srv/www/up", typeflag: tar.TypeSymlink, linkname: "../../.."},
+		tarEntry{name: "etc/passwd", typeflag: tar.TypeReg, content: "root"},
+	)), dest, utils.UnpackOptions{Subdir: "/srv/www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "assets/home.html")); err != nil || link != "../index.html" {
+		t.Errorf("absolute symlink should point inside, got %q, %v", link, err)
+	}
+	for _, skipped := range []string{"passwd", "up", "etc", "srv"} {
+		if _, err := os.Lstat(filepath.Join(dest, skipped)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be unpacked", skipped)
+		}
+	}
+}
+
+func TestUnpackImageLayersWhiteouts(t *testing.T) {
+	lower := static.NewLayer(tarball(t,
+		tarEntry{name: "srv/www/index.html", typeflag: tar.TypeReg, content: "old"},
+		tarEntry{name: "srv/www/removed.html", typeflag: tar.TypeReg, content: "removed"},
+		tarEntry{name: "srv/www/assets/old.css", typeflag: tar.TypeReg, content: "old"},
+	), types.DockerLayer)
+	upper := static.NewLayer(tarball(t,
+		tarEntry{name: "srv/www/index.html", typeflag: tar.TypeReg, content: "new"},
+		tarEntry{name: "srv/www/.wh.removed.html", typeflag: tar.TypeReg},
+		tarEntry{name: "srv/www/assets/new.css", typeflag: tar.TypeReg, content: "new"},
+		tarEntry{name: "srv/www/assets/.wh..wh..opq", typeflag: tar.TypeReg},
+	), types.DockerLayer)
+	img, err := mutate.AppendLayers(empty.Image, lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := utils.UnpackImageLayers(img, dest, utils.UnpackOptions{Subdir: "srv/www"}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "index.html")); string(content) != "new" {
+		t.Errorf("index.html is %q", content)
+	}
+	for _, path := range []string{"removed.html", "assets/old.css", "assets/.wh..wh..opq", ".wh.removed.html"} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); !os.IsNotExist(err) {
+			t.Errorf("%s should be whited out", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "assets/new.css")); err != nil {
+		t.Errorf("opaque whiteouts keep their own layer: %v", err)
+	}
+}
+
+func TestUnpackGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	work, bare := filepath.Join(t.TempDir(), "work"), filepath.Join(t.TempDir(), "site.git")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=web", "GIT_AUTHOR_EMAIL=web@example.com",
+			"GIT_COMMITTER_NAME=web", "GIT_COMMITTER_EMAIL=web@example.com")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	if err := os.MkdirAll(filepath.Join(work, "public"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "init", "--quiet")
+	os.WriteFile(filepath.Join(work, "public", "index.html"), []byte("v1"), 0o644)
+	os.WriteFile(filepath.Join(work, "README.md"), []byte("decoy"), 0o644)
+	git(work, "add", "-A")
+	git(work, "commit", "--quiet", "-m", "v1")
+	git(work, "tag", "v1")
+	v1Commit := git(work, "rev-parse", "HEAD")
+	os.WriteFile(filepath.Join(work, "public", "index.html"), []byte("v2"), 0o644)
+	git(work, "commit", "--quiet", "-am", "v2")
+	git(filepath.Dir(bare), "clone", "--quiet", "--bare", work, bare)
+
+	cic := utils.NewContainerImageController()
+	dest := filepath.Join(t.TempDir(), "v1")
+	digest, err := cic.UnpackImage("git+file://"+bare+"#v1:public", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != v1Commit {
+		t.Errorf("digest %s, expected the v1 commit %s", digest, v1Commit)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "index.html")); string(content) != "v1" {
+		t.Errorf("index.html is %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "README.md")); !os.IsNotExist(err) {
+		t.Error("files outside of the subdir were unpacked")
+	}
+
+	dest = filepath.Join(t.TempDir(), "head")
+	if _, err := cic.UnpackImage("git+file://"+bare, dest); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "public", "index.html")); string(content) != "v2" {
+		t.Errorf("HEAD index.html is %q", content)
+	}
+}
+
+func TestUnpackArchiveSources(t *testing.T) {
+	site := tarball(t,
+		tarEntry{name: "site/", typeflag: tar.TypeDir},
+		tarEntry{name: "site/index.html", typeflag: tar.TypeReg, content: "tarball"},
+	)
+	gzipped := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(gzipped)
+	gw.Write(site)
+	gw.Close()
+	zipped := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(zipped)
+	fw, _ := zw.Create("site/index.html")
+	fw.Write([]byte("zip"))
+	zw.Close()
+	escaping := bytes.NewBuffer(nil)
+	zw = zip.NewWriter(escaping)
+	fw, _ = zw.Create("../index.html")
+	fw.Write([]byte("escaped"))
+	zw.Close()
+	// each link stays inside where it stands, together they leave the camo
+	chained := bytes.NewBuffer(nil)
+	zw = zip.NewWriter(chained)
+	for _, link := range [][2]string{{"x/s", ".."}, {"y", "x/s/.."}, {"z", "y/.."}} {
+		fh := &zip.FileHeader{Name: link[0]}
+		fh.SetMode(os.ModeSymlink | 0o777)
+		fw, _ = zw.CreateHeader(fh)
+		fw.Write([]byte(link[1]))
+	}
+	zw.Close()
+
+	archives := map[string][]byte{
+		"site.tar.gz":  gzipped.Bytes(),
+		"site.tar":     site,
+		"site.zip":     zipped.Bytes(),
+		"escaping.zip": escaping.Bytes(),
+		"chained.zip":  chained.Bytes(),
+	}
+	dir := t.TempDir()
+	for name, content := range archives {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	cic := utils.NewContainerImageController()
+	cases := []struct {
+		ref     string
+		archive string
+		content string
+	}{
+		{"file://" + filepath.Join(dir, "site.tar.gz"), "site.tar.gz", "tarball"},
+		{"file://" + filepath.Join(dir, "site.zip"), "site.zip", "zip"},
+		{server.URL + "/site.tar", "site.tar", "tarball"},
+		{server.URL + "/site.tar.gz", "site.tar.gz", "tarball"},
+		{server.URL + "/site.zip", "site.zip", "zip"},
+	}
+	for _, c := range cases {
+		dest := filepath.Join(t.TempDir(), "dest")
+		digest, err := cic.UnpackImageWithOptions(c.ref, dest, utils.UnpackOptions{Subdir: "site"})
+		if err != nil {
+			t.Errorf("%s: %v", c.ref, err)
+			continue
+		}
+		if content, _ := os.ReadFile(filepath.Join(dest, "index.html")); string(content) != c.content {
+			t.Errorf("%s: index.html is %q", c.ref, content)
+		}
+		if expected := fmt.Sprintf("sha256:%x", sha256.Sum256(archives[c.archive])); digest != expected {
+			t.Errorf("%s: digest %s, expected %s", c.ref, digest, expected)
+		}
+	}
+
+	for _, ref := range []string{
+		"file://" + filepath.Join(dir, "escaping.zip"),
+		"file://" + filepath.Join(dir, "chained.zip"),
+		server.URL + "/missing.tar.gz",
+	} {
+		if _, err := cic.UnpackImage(ref, filepath.Join(t.TempDir(), "dest")); err == nil {
+			t.Errorf("%s: unpacked", ref)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package xray
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// xray API messages are encoded by hand with protowire, importing xray-core
+// for its generated protobuf code pulls the whole core into the build
+
+const (
+	StatsServiceName                  = "xray.app.stats.command.StatsService"
+	StatsServiceQueryStats            = "/" + StatsServiceName + "/QueryStats"
+	HandlerServiceName                = "xray.app.proxyman.command.HandlerService"
+	HandlerServiceAlterInbound        = "/" + HandlerServiceName + "/AlterInbound"
+	APIInboundTag                     = "api"
+	addUserOperationType              = "xray.app.proxyman.command.AddUserOperation"
+	removeUserOperationType           = "xray.app.proxyman.command.RemoveUserOperation"
+	vlessAccountType                  = "xray.proxy.vless.Account"
+	vmessAccountType                  = "xray.proxy.vmess.Account"
+	vmessSecurityTypeAuto      uint64 = 2
+)
+
+// 'user>>>bob>>>traffic>>>uplink' -> user, bob, uplink
+func ParseStatName(name string) (kind string, tag string, direction string, ok bool) {
+	parts := strings.Split(name, ">>>")
+	if len(parts) != 4 || parts[2] != "traffic" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[3], true
+}
+
+type APIMessage interface {
+	MarshalProto() []byte
+	UnmarshalProto([]byte) error
+}
+
+// grpc codec for APIMessage, named proto to stay wire compatible with xray
+type APICodec struct{}
+
+func (APICodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(APIMessage)
+	if !ok {
+		return nil, fmt.Errorf("unsupported api message type %T", v)
+	}
+	return m.MarshalProto(), nil
+}
+
+func (APICodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(APIMessage)
+	if !ok {
+		return fmt.Errorf("unsupported api message type %T", v)
+	}
+	return m.UnmarshalProto(data)
+}
+
+func (APICodec) Name() string {
+	return "proto"
+}
+
+// walks over top level fields, fn receives the raw value of each field
+func consumeProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := fn(num, typ, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func consumeProtoString(typ protowire.Type, value []byte) (string, error) {
+	if typ != protowire.BytesType {
+		return "", fmt.Errorf("unexpected wire type %d for string", typ)
+	}
+	s, n := protowire.ConsumeString(value)
+	if n < 0 {
+		return "", protowire.ParseError(n)
+	}
+	return s, nil
+}
+
+func consumeProtoBytes(typ protowire.Type, value []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, fmt.Errorf("unexpected wire type %d for bytes", typ)
+	}
+	b, n := protowire.ConsumeBytes(value)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return b, nil
+}
+
+func consumeProtoVarint(typ protowire.Type, value []byte) (uint64, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d for varint", typ)
+	}
+	v, n := protowire.ConsumeVarint(value)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return v, nil
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendProtoVarint(b, num, protowire.EncodeBool(v))
+}
+
+// BEGIN StatsService
+
+type QueryStatsRequest struct {
+	Pattern string
+	Reset   bool
+}
+
+func (m *QueryStatsRequest) MarshalProto() []byte {
+	b := appendProtoString(nil, 1, m.Pattern)
+	return appendProtoBool(b, 2, m.Reset)
+}
+
+func (m *QueryStatsRequest) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case 1:
+			m.Pattern, err = consumeProtoString(typ, value)
+		case 2:
+			var v uint64
+			v, err = consumeProtoVarint(typ, value)
+			m.Reset = protowire.DecodeBool(v)
+		}
+		return err
+	})
+}
+
+type Stat struct {
+	Name  string
+	Value int64
+}
+
+func (m *Stat) MarshalProto() []byte {
+	b := appendProtoString(nil, 1, m.Name)
+	return appendProtoVarint(b, 2, uint64(m.Value))
+}
+
+func (m *Stat) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case 1:
+			m.Name, err = consumeProtoString(typ, value)
+		case 2:
+			var v uint64
+			v, err = consumeProtoVarint(typ, value)
+			m.Value = int64(v)
+		}
+		return err
+	})
+}
+
+type QueryStatsResponse struct {
+	Stat []*Stat
+}
+
+func (m *QueryStatsResponse) MarshalProto() []byte {
+	var b []byte
+	for _, stat := range m.Stat {
+		b = appendProtoBytes(b, 1, stat.MarshalProto())
+	}
+	return b
+}
+
+func (m *QueryStatsResponse) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		raw, err := consumeProtoBytes(typ, value)
+		if err != nil {
+			return err
+		}
+		stat := &Stat{}
+		if err := stat.UnmarshalProto(raw); err != nil {
+			return err
+		}
+		m.Stat = append(m.Stat, stat)
+		return nil
+	})
+}
+
+// END StatsService
+
+// BEGIN HandlerService
+
+type TypedMessage struct {
+	Type  string
+	Value []byte
+}
+
+func (m *TypedMessage) MarshalProto() []byte {
+	b := appendProtoString(nil, 1, m.Type)
+	return appendProtoBytes(b, 2, m.Value)
+}
+
+func (m *TypedMessage) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case 1:
+			m.Type, err = consumeProtoString(typ, value)
+		case 2:
+			m.Value, err = consumeProtoBytes(typ, value)
+		}
+		return err
+	})
+}
+
+func unmarshalTypedMessage(typ protowire.Type, value []byte) (*TypedMessage, error) {
+	raw, err := consumeProtoBytes(typ, value)
+	if err != nil {
+		return nil, err
+	}
+	tm := &TypedMessage{}
+	return tm, tm.UnmarshalProto(raw)
+}
+
+// xray.common.protocol.User
+type User struct {
+	Level   uint32
+	Email   string
+	Account *TypedMessage
+}
+
+func (m *User) MarshalProto() []byte {
+	b := appendProtoVarint(nil, 1, uint64(m.Level))
+	b = appendProtoString(b, 2, m.Email)
+	if m.Account != nil {
+		b = appendProtoBytes(b, 3, m.Account.MarshalProto())
+	}
+	return b
+}
+
+func (m *User) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case 1:
+			var v uint64
+			v, err = consumeProtoVarint(typ, value)
+			m.Level = uint32(v)
+		case 2:
+			m.Email, err = consumeProtoString(typ, value)
+		case 3:
+			m.Account, err = unmarshalTypedMessage(typ, value)
+		}
+		return err
+	})
+}
+
+// vless Account is id, flow, encryption, vmess Account is id and a nested
+// security config, the server side ignores vmess security so it's always auto
+func marshalAccount(protocol string, id string, flow string) (*TypedMessage, error) {
+	switch protocol {
+	case "vless":
+		b := appendProtoString(nil, 1, id)
+		b = appendProtoString(b, 2, flow)
+		b = appendProtoString(b, 3, "none")
+		return &TypedMessage{Type: vlessAccountType, Value: b}, nil
+	case "vmess":
+		b := appendProtoString(nil, 1, id)
+		b = appendProtoBytes(b, 3, appendProtoVarint(nil, 1, vmessSecurityTypeAuto))
+		return &TypedMessage{Type: vmessAccountType, Value: b}, nil
+	default:
+		return nil, fmt.Errorf("users of %s inbounds can't be altered through the api", protocol)
+	}
+}
+
+type AddUserOperation struct {
+	User *User
+}
+
+func (m *AddUserOperation) MarshalProto() []byte {
+	if m.User == nil {
+		return nil
+	}
+	return appendProtoBytes(nil, 1, m.User.MarshalProto())
+}
+
+func (m *AddUserOperation) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		raw, err := consumeProtoBytes(typ, value)
+		if err != nil {
+			return err
+		}
+		m.User = &User{}
+		return m.User.UnmarshalProto(raw)
+	})
+}
+
+type RemoveUserOperation struct {
+	Email string
+}
+
+func (m *RemoveUserOperation) MarshalProto() []byte {
+	return appendProtoString(nil, 1, m.Email)
+}
+
+func (m *RemoveUserOperation) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		if num == 1 {
+			m.Email, err = consumeProtoString(typ, value)
+		}
+		return err
+	})
+}
+
+type AlterInboundRequest struct {
+	Tag       string
+	Operation *TypedMessage
+}
+
+func (m *AlterInboundRequest) MarshalProto() []byte {
+	b := appendProtoString(nil, 1, m.Tag)
+	if m.Operation != nil {
+		b = appendProtoBytes(b, 2, m.Operation.MarshalProto())
+	}
+	return b
+}
+
+func (m *AlterInboundRequest) UnmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case 1:
+			m.Tag, err = consumeProtoString(typ, value)
+		case 2:
+			m.Operation, err = unmarshalTypedMessage(typ, value)
+		}
+		return err
+	})
+}
+
+type AlterInboundResponse struct{}
+
+func (m *AlterInboundResponse) MarshalProto() []byte { return nil }
+
+func (m *AlterInboundResponse) UnmarshalProto(b []byte) error { return nil }
+
+// END HandlerService
+
+type XrayAPIClient struct {
+	conn *grpc.ClientConn
+}
+
+// the connection is established lazily, xray doesn't have to be running yet
+func NewXrayAPIClient(address string) (*XrayAPIClient, error) {
+	conn, err := grpc.NewClient(
+		address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(APICodec{})),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &XrayAPIClient{conn: conn}, nil
+}
+
+// stat name to value, pattern is a substring match, empty matches everything
+func (c *XrayAPIClient) QueryStats(ctx context.Context, pattern string, reset bool) (map[string]int64, error) {
+	resp := &QueryStatsResponse{}
+	err := c.conn.Invoke(ctx, StatsServiceQueryStats, &QueryStatsRequest{Pattern: pattern, Reset: reset}, resp)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]int64, len(resp.Stat))
+	for _, stat := range resp.Stat {
+		stats[stat.Name] = stat.Value
+	}
+	return stats, nil
+}
+
+// users are keyed by email in xray, the email is what RemoveInboundUser takes
+func (c *XrayAPIClient) AddInboundUser(
+	ctx context.Context,
+	tag string,
+	protocol string,
+	id string,
+	flow string,
+	email string,
+) error {
+	account, err := marshalAccount(protocol, id, flow)
+	if err != nil {
+		return err
+	}
+	op := &AddUserOperation{User: &User{Email: email, Account: account}}
+	return c.alterInbound(ctx, tag, &TypedMessage{Type: addUserOperationType, Value: op.MarshalProto()})
+}
+
+func (c *XrayAPIClient) RemoveInboundUser(ctx context.Context, tag string, email string) error {
+	op := &RemoveUserOperation{Email: email}
+	return c.alterInbound(ctx, tag, &TypedMessage{Type: removeUserOperationType, Value: op.MarshalProto()})
+}
+
+func (c *XrayAPIClient) alterInbound(ctx context.Context, tag string, op *TypedMessage) error {
+	return c.conn.Invoke(
+		ctx,
+		HandlerServiceAlterInbound,
+		&AlterInboundRequest{Tag: tag, Operation: op},
+		&AlterInboundResponse{},
+	)
+}
+
+func (c *XrayAPIClient) Close() error {
+	return c.conn.Close()
+}
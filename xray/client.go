@@ -0,0 +1,113 @@
+package xray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflector/utils"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Second xray process in client mode, a single link behind a loopback socks
+// inbound, used to check links the way a client would use them
+type XrayClientProcess struct {
+	SocksPort      int
+	configLocation string
+	process        *exec.Cmd
+	processExited  chan struct{}
+}
+
+func (c *PortableXray) BinaryLocation() string {
+	return c.binaryLocation
+}
+
+// insecure accepts any tls certificate, meant for locally issued ones
+func xrayClientConfigForLink(xl *XrayLink, socksPort int, insecure bool) ([]byte, error) {
+	ob, err := xrayClientOutboundFromLink(xl, "proxy")
+	if err != nil {
+		return nil, err
+	}
+	if insecure && ob.StreamSettings.TLSSettings != nil {
+		ob.StreamSettings.TLSSettings.AllowInsecure = true
+	}
+	config := xrayClientConfig{
+		Log: xrayConfigLog{Loglevel: "warning"},
+		Inbounds: []xrayClientInbound{{
+			Tag: "socks-in", Listen: "127.0.0.1", Port: socksPort, Protocol: "socks",
+		}},
+		Outbounds: []*xrayClientOutbound{ob},
+	}
+	return json.Marshal(config)
+}
+
+func StartXrayClient(binaryLocation string, xl *XrayLink, insecure bool) (*XrayClientProcess, error) {
+	ports, err := utils.FindFreePorts(1)
+	if err != nil {
+		return nil, err
+	}
+	config, err := xrayClientConfigForLink(xl, ports[0], insecure)
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := os.CreateTemp("", "xray-client-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+	if _, err := configFile.Write(config); err != nil {
+		os.Remove(configFile.Name())
+		return nil, err
+	}
+
+	xp := &XrayClientProcess{
+		SocksPort:      ports[0],
+		configLocation: configFile.Name(),
+		process:        exec.Command(binaryLocation, "run", "-c", configFile.Name()),
+		processExited:  make(chan struct{}),
+	}
+	stdout, _ := xp.process.StdoutPipe()
+	stderr, _ := xp.process.StderrPipe()
+	if err := xp.process.Start(); err != nil {
+		os.Remove(xp.configLocation)
+		return nil, err
+	}
+	logsForwarded := sync.WaitGroup{}
+	logsForwarded.Add(2)
+	go func() { forwardXrayLogs(stdout); logsForwarded.Done() }()
+	go func() { forwardXrayLogs(stderr); logsForwarded.Done() }()
+	go func() {
+		// pipes have to be drained before Wait closes them
+		logsForwarded.Wait()
+		xp.process.Wait()
+		close(xp.processExited)
+	}()
+
+	// xray takes a moment before the socks inbound accepts connections
+	for range 50 {
+		select {
+		case <-xp.processExited:
+			os.Remove(xp.configLocation)
+			return nil, errors.New("xray client exited on start")
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", xp.SocksPort), 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return xp, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	xp.Stop()
+	return nil, errors.New("xray client socks inbound did not come up")
+}
+
+func (xp *XrayClientProcess) Stop() {
+	syscall.Kill(xp.process.Process.Pid, syscall.SIGTERM)
+	<-xp.processExited
+	os.Remove(xp.configLocation)
+}
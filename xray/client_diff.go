@@ -0,0 +1,99 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+type ClientChange struct {
+	InboundTag string
+	Protocol   string
+	ID         string
+	Flow       string
+	Email      string
+	Remove     bool
+}
+
+// Clients that can be added and removed through the HandlerService
+func apiAlterableProtocol(protocol string) bool {
+	return protocol == "vless" || protocol == "vmess"
+}
+
+func withoutClients(xc *XrayConfig) ([]byte, error) {
+	configBytes, err := json.Marshal(xc)
+	if err != nil {
+		return nil, err
+	}
+	stripped := NewXrayConfig()
+	if err := json.Unmarshal(configBytes, stripped); err != nil {
+		return nil, err
+	}
+	for _, inb := range stripped.Inbounds {
+		if apiAlterableProtocol(inb.Protocol) {
+			inb.Settings.Clients = nil
+		}
+	}
+	return json.Marshal(stripped)
+}
+
+// Client list changes from old to new, structural is set when anything else
+// differs or a change can't be expressed as api calls
+func DiffClients(old *XrayConfig, new *XrayConfig) (changes []ClientChange, structural bool) {
+	oldStripped, err := withoutClients(old)
+	if err != nil {
+		return nil, true
+	}
+	newStripped, err := withoutClients(new)
+	if err != nil || !bytes.Equal(oldStripped, newStripped) {
+		return nil, true
+	}
+
+	for _, newInb := range new.Inbounds {
+		if !apiAlterableProtocol(newInb.Protocol) {
+			continue
+		}
+		oldInb := old.inboundsByTag[newInb.Tag]
+		oldClients := map[string]*xrayConfigInboundSettingsClient{}
+		for _, c := range oldInb.Settings.Clients {
+			oldClients[c.ID] = c
+		}
+		newClients := map[string]bool{}
+		removals := []ClientChange{}
+		additions := []ClientChange{}
+		for _, c := range newInb.Settings.Clients {
+			newClients[c.ID] = true
+			oldc, exists := oldClients[c.ID]
+			if exists && *oldc == *c {
+				continue
+			}
+			if exists {
+				removals = append(removals, ClientChange{
+					InboundTag: newInb.Tag, Protocol: newInb.Protocol,
+					ID: oldc.ID, Flow: oldc.Flow, Email: oldc.Email, Remove: true,
+				})
+			}
+			additions = append(additions, ClientChange{
+				InboundTag: newInb.Tag, Protocol: newInb.Protocol,
+				ID: c.ID, Flow: c.Flow, Email: c.Email,
+			})
+		}
+		for _, c := range oldInb.Settings.Clients {
+			if newClients[c.ID] {
+				continue
+			}
+			removals = append(removals, ClientChange{
+				InboundTag: newInb.Tag, Protocol: newInb.Protocol,
+				ID: c.ID, Flow: c.Flow, Email: c.Email, Remove: true,
+			})
+		}
+		// xray finds users to remove by email
+		for _, removal := range removals {
+			if removal.Email == "" {
+				return nil, true
+			}
+		}
+		changes = append(changes, removals...)
+		changes = append(changes, additions...)
+	}
+	return changes, false
+}
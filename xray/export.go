@@ -0,0 +1,507 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflector/log"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Full client configs built from links, links already carry everything a
+// client needs, including xhttp extra. Transports a client doesn't implement
+// are skipped with a warning
+
+// BEGIN sing-box
+
+type singBoxConfig struct {
+	Log       singBoxLog         `json:"log"`
+	Inbounds  []singBoxInbound   `json:"inbounds"`
+	Outbounds []*singBoxOutbound `json:"outbounds"`
+	Route     singBoxRoute       `json:"route"`
+}
+
+type singBoxLog struct {
+	Level string `json:"level"`
+}
+
+type singBoxInbound struct {
+	Type       string `json:"type"`
+	Tag        string `json:"tag"`
+	Listen     string `json:"listen"`
+	ListenPort int    `json:"listen_port"`
+}
+
+type singBoxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort int               `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Flow       string            `json:"flow,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	TLS        *singBoxTLS       `json:"tls,omitempty"`
+	Transport  *singBoxTransport `json:"transport,omitempty"`
+}
+
+type singBoxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	UTLS       *singBoxUTLS    `json:"utls,omitempty"`
+	Reality    *singBoxReality `json:"reality,omitempty"`
+}
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id,omitempty"`
+}
+
+type singBoxTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Host        string            `json:"host,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type singBoxRoute struct {
+	Final string `json:"final"`
+}
+
+func singBoxOutboundFromLink(xl *XrayLink, tag string) (*singBoxOutbound, error) {
+	p := xl.Parameters
+	ob := &singBoxOutbound{
+		Type:       xl.Protocol,
+		Tag:        tag,
+		Server:     xl.Host,
+		ServerPort: xl.Port,
+		UUID:       xl.User,
+		Flow:       p.Flow,
+	}
+	if xl.Protocol == "vmess" {
+		ob.Security = "auto"
+	}
+	if p.Security == "tls" || p.Security == "reality" {
+		ob.TLS = &singBoxTLS{Enabled: true, ServerName: p.SNI}
+		if p.Fingerprint != "" {
+			ob.TLS.UTLS = &singBoxUTLS{Enabled: true, Fingerprint: p.Fingerprint}
+		}
+		if p.Security == "reality" {
+			ob.TLS.Reality = &singBoxReality{Enabled: true, PublicKey: p.PublicKey, ShortID: p.ShortID}
+		}
+	}
+	switch p.Type {
+	case "", "tcp":
+	case "ws":
+		ob.Transport = &singBoxTransport{Type: "ws", Path: p.Path}
+		if p.Host != "" {
+			ob.Transport.Headers = map[string]string{"Host": p.Host}
+		}
+	case "httpupgrade":
+		ob.Transport = &singBoxTransport{Type: "httpupgrade", Path: p.Path, Host: p.Host}
+	case "grpc":
+		ob.Transport = &singBoxTransport{Type: "grpc", ServiceName: p.ServiceName}
+	default:
+		return nil, fmt.Errorf("sing-box has no %s transport", p.Type)
+	}
+	return ob, nil
+}
+
+func ExportSingBox(links []*XrayLink) ([]byte, error) {
+	config := singBoxConfig{
+		Log: singBoxLog{Level: "info"},
+		Inbounds: []singBoxInbound{{
+			Type: "mixed", Tag: "mixed-in", Listen: "127.0.0.1", ListenPort: 2080,
+		}},
+	}
+	for i, xl := range links {
+		ob, err := singBoxOutboundFromLink(xl, exportTag(links, i))
+		if err != nil {
+			logSkippedLink(xl, err)
+			continue
+		}
+		config.Outbounds = append(config.Outbounds, ob)
+	}
+	if len(config.Outbounds) == 0 {
+		return nil, errors.New("none of the links can be exported to sing-box")
+	}
+	config.Route.Final = config.Outbounds[0].Tag
+	config.Outbounds = append(config.Outbounds, &singBoxOutbound{Type: "direct", Tag: "direct"})
+	return json.MarshalIndent(config, "", strings.Repeat(" ", 4))
+}
+
+// END sing-box
+
+// BEGIN clash
+
+type clashConfig struct {
+	MixedPort   int               `yaml:"mixed-port"`
+	Mode        string            `yaml:"mode"`
+	Proxies     []*clashProxy     `yaml:"proxies"`
+	ProxyGroups []clashProxyGroup `yaml:"proxy-groups"`
+	Rules       []string          `yaml:"rules"`
+}
+
+type clashProxy struct {
+	Name              string            `yaml:"name"`
+	Type              string            `yaml:"type"`
+	Server            string            `yaml:"server"`
+	Port              int               `yaml:"port"`
+	UUID              string            `yaml:"uuid"`
+	Cipher            string            `yaml:"cipher,omitempty"`
+	AlterID           *int              `yaml:"alterId,omitempty"`
+	Network           string            `yaml:"network,omitempty"`
+	UDP               bool              `yaml:"udp"`
+	TLS               bool              `yaml:"tls,omitempty"`
+	ServerName        string            `yaml:"servername,omitempty"`
+	Flow              string            `yaml:"flow,omitempty"`
+	ClientFingerprint string            `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *clashRealityOpts `yaml:"reality-opts,omitempty"`
+	WSOpts            *clashWSOpts      `yaml:"ws-opts,omitempty"`
+	GRPCOpts          *clashGRPCOpts    `yaml:"grpc-opts,omitempty"`
+	XHTTPOpts         *clashXHTTPOpts   `yaml:"xhttp-opts,omitempty"`
+}
+
+type clashRealityOpts struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id,omitempty"`
+}
+
+type clashWSOpts struct {
+	Path             string            `yaml:"path,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	V2rayHTTPUpgrade bool              `yaml:"v2ray-http-upgrade,omitempty"`
+}
+
+type clashGRPCOpts struct {
+	GRPCServiceName string `yaml:"grpc-service-name"`
+}
+
+// mihomo only, the original clash has no xhttp
+type clashXHTTPOpts struct {
+	Path          string               `yaml:"path,omitempty"`
+	Host          string               `yaml:"host,omitempty"`
+	Mode          string               `yaml:"mode,omitempty"`
+	Headers       map[string]string    `yaml:"headers,omitempty"`
+	XPaddingBytes string               `yaml:"x-padding-bytes,omitempty"`
+	ReuseSettings *clashXHTTPReuseOpts `yaml:"reuse-settings,omitempty"`
+}
+
+// xmux
+type clashXHTTPReuseOpts struct {
+	MaxConcurrency   string `yaml:"max-concurrency,omitempty"`
+	MaxConnections   string `yaml:"max-connections,omitempty"`
+	CMaxReuseTimes   string `yaml:"c-max-reuse-times,omitempty"`
+	HMaxRequestTimes string `yaml:"h-max-request-times,omitempty"`
+	HMaxReusableSecs string `yaml:"h-max-reusable-secs,omitempty"`
+}
+
+// extra settings mihomo has no equivalent for fail the link instead of
+// being dropped, the client would not look like the other clients otherwise
+func clashXHTTPOptsFromLink(p *xrayLinkParameters) (*clashXHTTPOpts, error) {
+	opts := &clashXHTTPOpts{Path: p.Path, Host: p.Host, Mode: p.Mode}
+	if p.Extra == "" {
+		return opts, nil
+	}
+	extra := XHTTPExtra{}
+	decoder := json.NewDecoder(strings.NewReader(p.Extra))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&extra); err != nil {
+		return nil, fmt.Errorf("clash can't carry xhttp extra: %w", err)
+	}
+	opts.Headers = extra.Headers
+	opts.XPaddingBytes = extra.XPaddingBytes
+	if x := extra.Xmux; x != nil {
+		if x.HKeepAlivePeriod != 0 {
+			return nil, errors.New("clash has no xmux hKeepAlivePeriod")
+		}
+		opts.ReuseSettings = &clashXHTTPReuseOpts{
+			MaxConcurrency:   x.MaxConcurrency,
+			MaxConnections:   x.MaxConnections,
+			CMaxReuseTimes:   x.CMaxReuseTimes,
+			HMaxRequestTimes: x.HMaxRequestTimes,
+			HMaxReusableSecs: x.HMaxReusableSecs,
+		}
+	}
+	return opts, nil
+}
+
+type clashProxyGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+}
+
+func clashProxyFromLink(xl *XrayLink, name string) (*clashProxy, error) {
+	p := xl.Parameters
+	proxy := &clashProxy{
+		Name:              name,
+		Type:              xl.Protocol,
+		Server:            xl.Host,
+		Port:              xl.Port,
+		UUID:              xl.User,
+		UDP:               true,
+		Flow:              p.Flow,
+		ClientFingerprint: p.Fingerprint,
+	}
+	if xl.Protocol == "vmess" {
+		alterID := 0
+		proxy.Cipher = "auto"
+		proxy.AlterID = &alterID
+	}
+	if p.Security == "tls" || p.Security == "reality" {
+		proxy.TLS = true
+		proxy.ServerName = p.SNI
+	}
+	if p.Security == "reality" {
+		proxy.RealityOpts = &clashRealityOpts{PublicKey: p.PublicKey, ShortID: p.ShortID}
+	}
+	switch p.Type {
+	case "", "tcp":
+		proxy.Network = "tcp"
+	case "ws", "httpupgrade":
+		proxy.Network = "ws"
+		proxy.WSOpts = &clashWSOpts{Path: p.Path, V2rayHTTPUpgrade: p.Type == "httpupgrade"}
+		if p.Host != "" {
+			proxy.WSOpts.Headers = map[string]string{"Host": p.Host}
+		}
+	case "grpc":
+		proxy.Network = "grpc"
+		proxy.GRPCOpts = &clashGRPCOpts{GRPCServiceName: p.ServiceName}
+	case "xhttp":
+		if xl.Protocol != "vless" {
+			return nil, fmt.Errorf("clash has no xhttp transport for %s", xl.Protocol)
+		}
+		opts, err := clashXHTTPOptsFromLink(&p)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Network = "xhttp"
+		proxy.XHTTPOpts = opts
+	default:
+		return nil, fmt.Errorf("clash has no %s transport", p.Type)
+	}
+	return proxy, nil
+}
+
+func ExportClash(links []*XrayLink) ([]byte, error) {
+	config := clashConfig{
+		MixedPort: 7890,
+		Mode:      "rule",
+		Rules:     []string{"MATCH,reflector"},
+	}
+	group := clashProxyGroup{Name: "reflector", Type: "select"}
+	for i, xl := range links {
+		proxy, err := clashProxyFromLink(xl, exportTag(links, i))
+		if err != nil {
+			logSkippedLink(xl, err)
+			continue
+		}
+		config.Proxies = append(config.Proxies, proxy)
+		group.Proxies = append(group.Proxies, proxy.Name)
+	}
+	if len(config.Proxies) == 0 {
+		return nil, errors.New("none of the links can be exported to clash")
+	}
+	config.ProxyGroups = []clashProxyGroup{group}
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+// END clash
+
+// BEGIN xray client
+
+type xrayClientConfig struct {
+	Log       xrayConfigLog         `json:"log"`
+	Inbounds  []xrayClientInbound   `json:"inbounds"`
+	Outbounds []*xrayClientOutbound `json:"outbounds"`
+}
+
+type xrayClientInbound struct {
+	Tag      string `json:"tag"`
+	Listen   string `json:"listen"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Settings any    `json:"settings,omitempty"`
+}
+
+type xrayClientOutbound struct {
+	Tag            string                    `json:"tag"`
+	Protocol       string                    `json:"protocol"`
+	Settings       *xrayClientOutboundVnexts `json:"settings,omitempty"`
+	StreamSettings *xrayClientStreamSettings `json:"streamSettings,omitempty"`
+}
+
+type xrayClientOutboundVnexts struct {
+	Vnext []xrayClientOutboundVnext `json:"vnext"`
+}
+
+type xrayClientOutboundVnext struct {
+	Address string                        `json:"address"`
+	Port    int                           `json:"port"`
+	Users   []xrayClientOutboundVnextUser `json:"users"`
+}
+
+type xrayClientOutboundVnextUser struct {
+	ID         string `json:"id"`
+	Encryption string `json:"encryption,omitempty"`
+	Security   string `json:"security,omitempty"`
+	Flow       string `json:"flow,omitempty"`
+}
+
+type xrayClientStreamSettings struct {
+	Network             string                                              `json:"network"`
+	Security            string                                              `json:"security"`
+	TLSSettings         *xrayClientTLSSettings                              `json:"tlsSettings,omitempty"`
+	RealitySettings     *xrayClientRealitySettings                          `json:"realitySettings,omitempty"`
+	XHTTPSettings       *xrayClientXHTTPSettings                            `json:"xhttpSettings,omitempty"`
+	WSSettings          *xrayConfigInboundStreamSettingsWSSettings          `json:"wsSettings,omitempty"`
+	HTTPUpgradeSettings *xrayConfigInboundStreamSettingsHTTPUpgradeSettings `json:"httpupgradeSettings,omitempty"`
+	GRPCSettings        *xrayConfigInboundStreamSettingsGRPCSettings        `json:"grpcSettings,omitempty"`
+}
+
+type xrayClientTLSSettings struct {
+	ServerName  string `json:"serverName,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// only set by self tests against locally issued certificates
+	AllowInsecure bool `json:"allowInsecure,omitempty"`
+}
+
+type xrayClientRealitySettings struct {
+	ServerName  string `json:"serverName"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"publicKey"`
+	ShortID     string `json:"shortId,omitempty"`
+}
+
+type xrayClientXHTTPSettings struct {
+	Path  string          `json:"path,omitempty"`
+	Host  string          `json:"host,omitempty"`
+	Mode  string          `json:"mode,omitempty"`
+	Extra json.RawMessage `json:"extra,omitempty"`
+}
+
+func xrayClientOutboundFromLink(xl *XrayLink, tag string) (*xrayClientOutbound, error) {
+	p := xl.Parameters
+	user := xrayClientOutboundVnextUser{ID: xl.User, Flow: p.Flow}
+	switch xl.Protocol {
+	case "vless":
+		user.Encryption = "none"
+	case "vmess":
+		user.Security = "auto"
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", xl.Protocol)
+	}
+	ss := &xrayClientStreamSettings{Network: p.Type, Security: p.Security}
+	if ss.Network == "" {
+		ss.Network = "tcp"
+	}
+	if ss.Security == "" {
+		ss.Security = "none"
+	}
+	switch p.Security {
+	case "tls":
+		ss.TLSSettings = &xrayClientTLSSettings{ServerName: p.SNI, Fingerprint: p.Fingerprint}
+	case "reality":
+		ss.RealitySettings = &xrayClientRealitySettings{
+			ServerName:  p.SNI,
+			Fingerprint: p.Fingerprint,
+			PublicKey:   p.PublicKey,
+			ShortID:     p.ShortID,
+		}
+	}
+	switch ss.Network {
+	case "tcp":
+	case "xhttp":
+		ss.XHTTPSettings = &xrayClientXHTTPSettings{Path: p.Path, Host: p.Host, Mode: p.Mode}
+		if p.Extra != "" {
+			ss.XHTTPSettings.Extra = json.RawMessage(p.Extra)
+		}
+	case "ws":
+		ss.WSSettings = &xrayConfigInboundStreamSettingsWSSettings{Path: p.Path, Host: p.Host}
+	case "httpupgrade":
+		ss.HTTPUpgradeSettings = &xrayConfigInboundStreamSettingsHTTPUpgradeSettings{Path: p.Path, Host: p.Host}
+	case "grpc":
+		ss.GRPCSettings = &xrayConfigInboundStreamSettingsGRPCSettings{ServiceName: p.ServiceName}
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", ss.Network)
+	}
+	return &xrayClientOutbound{
+		Tag:      tag,
+		Protocol: xl.Protocol,
+		Settings: &xrayClientOutboundVnexts{Vnext: []xrayClientOutboundVnext{{
+			Address: xl.Host,
+			Port:    xl.Port,
+			Users:   []xrayClientOutboundVnextUser{user},
+		}}},
+		StreamSettings: ss,
+	}, nil
+}
+
+// the first link becomes the default outbound
+func ExportXrayClient(links []*XrayLink) ([]byte, error) {
+	config := xrayClientConfig{
+		Log: xrayConfigLog{Loglevel: "warning"},
+		Inbounds: []xrayClientInbound{{
+			Tag: "socks-in", Listen: "127.0.0.1", Port: 10808, Protocol: "socks",
+			Settings: map[string]bool{"udp": true},
+		}, {
+			Tag: "http-in", Listen: "127.0.0.1", Port: 10809, Protocol: "http",
+		}},
+	}
+	for i, xl := range links {
+		ob, err := xrayClientOutboundFromLink(xl, exportTag(links, i))
+		if err != nil {
+			logSkippedLink(xl, err)
+			continue
+		}
+		config.Outbounds = append(config.Outbounds, ob)
+	}
+	if len(config.Outbounds) == 0 {
+		return nil, errors.New("none of the links can be exported to xray")
+	}
+	config.Outbounds = append(config.Outbounds, &xrayClientOutbound{Tag: "direct", Protocol: "freedom"})
+	return json.MarshalIndent(config, "", strings.Repeat(" ", 4))
+}
+
+// END xray client
+
+// link names, numbered when they repeat
+func exportTag(links []*XrayLink, i int) string {
+	tag := links[i].LinkName
+	if tag == "" {
+		tag = "proxy"
+	}
+	seen := 0
+	for _, xl := range links[:i] {
+		if xl.LinkName == links[i].LinkName {
+			seen += 1
+		}
+	}
+	if seen > 0 {
+		return fmt.Sprintf("%s-%d", tag, seen+1)
+	}
+	return tag
+}
+
+func logSkippedLink(xl *XrayLink, err error) {
+	log.GetDefaultLogger().Warning().
+		Update("link", xl.LinkName).
+		Update("err", err.Error()).
+		Msg("skipping link")
+}
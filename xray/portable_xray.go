@@ -2,6 +2,7 @@ package xray
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"reflector/log"
 	"reflector/utils"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,6 +25,17 @@ type PortableXray struct {
 	configLocation string
 	XrayConfig     *XrayConfig
 	currentProcess *exec.Cmd
+	processExited  chan struct{}
+	stateLock      sync.Mutex
+	running        bool
+	restarts       int
+	// config the current process was started with or brought to through the api
+	appliedConfig []byte
+}
+
+type InboundUserAlterer interface {
+	AddInboundUser(ctx context.Context, tag string, protocol string, id string, flow string, email string) error
+	RemoveInboundUser(ctx context.Context, tag string, email string) error
 }
 
 func (c *PortableXray) xrayVersion() *xrayVersion {
@@ -98,6 +111,7 @@ func (c *PortableXray) Start() {
 	if err := c.updateConfig(); err != nil {
 		panic(err)
 	}
+	c.appliedConfig = c.XrayConfig.Marshal()
 	c.currentProcess = exec.Command(
 		c.binaryLocation, "run",
 		"-c", c.configLocation,
@@ -109,10 +123,98 @@ func (c *PortableXray) Start() {
 		panic(err)
 	}
 
-	go forwardXrayLogs(stdout)
-	go forwardXrayLogs(stderr)
+	logsForwarded := sync.WaitGroup{}
+	logsForwarded.Add(2)
+	go func() { forwardXrayLogs(stdout); logsForwarded.Done() }()
+	go func() { forwardXrayLogs(stderr); logsForwarded.Done() }()
+
+	c.setRunning(true)
+	c.processExited = make(chan struct{})
+	go func(process *exec.Cmd, exited chan struct{}) {
+		// pipes have to be drained before Wait closes them
+		logsForwarded.Wait()
+		err := process.Wait()
+		c.setRunning(false)
+		log.GetDefaultLogger().Info().
+			Update("err", err).
+			Msg("xray exited")
+		close(exited)
+	}(c.currentProcess, c.processExited)
+}
+
+func (c *PortableXray) setRunning(running bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.running = running
+}
+
+func (c *PortableXray) IsRunning() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.running
+}
+
+func (c *PortableXray) Restarts() int {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.restarts
+}
 
-	c.currentProcess.Start()
+// Full process restart with the current config, drops active connections
+func (c *PortableXray) Restart() {
+	c.Stop()
+	c.stateLock.Lock()
+	c.restarts += 1
+	c.stateLock.Unlock()
+	c.Start()
+}
+
+// Brings the running xray to XrayConfig, client list changes go through the
+// HandlerService and keep connections alive, anything else restarts xray
+func (c *PortableXray) Apply(ctx context.Context, api InboundUserAlterer) {
+	if api == nil || !c.IsRunning() {
+		c.Restart()
+		return
+	}
+	applied := NewXrayConfig()
+	if err := json.Unmarshal(c.appliedConfig, applied); err != nil {
+		c.Restart()
+		return
+	}
+	changes, structural := DiffClients(applied, c.XrayConfig)
+	if structural {
+		log.GetDefaultLogger().Info().
+			Msg("xray config changed beyond the client lists, restarting xray")
+		c.Restart()
+		return
+	}
+	for _, change := range changes {
+		var err error
+		if change.Remove {
+			err = api.RemoveInboundUser(ctx, change.InboundTag, change.Email)
+		} else {
+			err = api.AddInboundUser(ctx, change.InboundTag, change.Protocol, change.ID, change.Flow, change.Email)
+		}
+		if err != nil {
+			log.GetDefaultLogger().Warning().
+				Update("err", err.Error()).
+				Update("inbound", change.InboundTag).
+				Update("email", change.Email).
+				Msg("failed to alter inbound through the api, restarting xray")
+			c.Restart()
+			return
+		}
+	}
+	// keep the file in sync for the next start
+	if err := c.updateConfig(); err != nil {
+		log.GetDefaultLogger().Error().
+			Update("err", err.Error()).
+			Msg("failed to write xray config")
+	}
+	c.appliedConfig = c.XrayConfig.Marshal()
+	log.GetDefaultLogger().Info().
+		Update("changes", len(changes)).
+		Msg("xray clients updated without a restart")
 }
 
 func (c *PortableXray) Reload() {
@@ -136,8 +238,11 @@ func (c *PortableXray) Reload() {
 }
 
 func (c *PortableXray) Stop() {
+	if c.currentProcess == nil {
+		return
+	}
 	syscall.Kill(c.currentProcess.Process.Pid, syscall.SIGTERM)
-	c.currentProcess.Wait()
+	<-c.processExited
 	// for range 30 {
 	// 	time.Sleep(time.Second)
 	// 	if c.currentProcess.ProcessState.Exited() {
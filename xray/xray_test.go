@@ -1,10 +1,25 @@
 package xray_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"reflector/xray"
+	"strings"
 	"testing"
+	"testing/quick"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 func TestPortableXray(t *testing.T) {
@@ -13,3 +28,413 @@ func TestPortableXray(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	xr.Start()
 }
+
+func TestXrayConfigLocalProxyInbounds(t *testing.T) {
+	xc := xray.NewXrayConfig()
+	socks, err := xc.EnsureInboundProtocol("socks", "lan-socks", "0.0.0.0", 1080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if socks.Settings.Auth != "noauth" {
+		t.Fatalf("socks without accounts should be noauth, got %s", socks.Settings.Auth)
+	}
+	socks.EnsureAccount("bob", "pass")
+	socks.EnsureAccount("bob", "newpass")
+	if socks.Settings.Auth != "password" || len(socks.Settings.Accounts) != 1 {
+		t.Fatalf("unexpected socks settings: %+v", socks.Settings)
+	}
+	if socks.Settings.Accounts[0].Pass != "newpass" {
+		t.Fatalf("account was not updated")
+	}
+
+	vmess, err := xc.EnsureInboundProtocol("vmess", "vmess-in", "0.0.0.0", 8443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmess.EnsureClient("bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb", "xtls-rprx-vision", "bob")
+	if vmess.Settings.Clients[0].Flow != "" {
+		t.Fatalf("vmess clients should not have a flow")
+	}
+
+	if _, err := xc.EnsureInboundProtocol("trojan", "trojan-in", "0.0.0.0", 443); err == nil {
+		t.Fatalf("unsupported protocol should fail")
+	}
+	fmt.Println(string(xc.Marshal()))
+}
+
+func TestXrayConfigRealityDest(t *testing.T) {
+	xc := xray.NewXrayConfig()
+	inb, err := xc.EnsureInboundProtocol("vless", "reality-in", "0.0.0.0", 8443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &inb.SecurityReality("google.com", []string{}).StreamSettings.RealitySettings
+	if rs.Dest != "google.com:443" || len(rs.ServerNames) != 1 {
+		t.Fatalf("reality should default to the sni, got %s %v", rs.Dest, rs.ServerNames)
+	}
+	inb.RealityDest("", nil)
+	if rs.Dest != "google.com:443" || len(rs.ServerNames) != 1 {
+		t.Fatalf("empty dest and server names should keep the defaults, got %s %v", rs.Dest, rs.ServerNames)
+	}
+	inb.RealityDest("142.250.0.1:443", []string{"google.com", "www.google.com"})
+	if rs.Dest != "142.250.0.1:443" || len(rs.ServerNames) != 2 {
+		t.Fatalf("unexpected reality settings %s %v", rs.Dest, rs.ServerNames)
+	}
+}
+
+func TestEnsureClientReturnClientLink(t *testing.T) {
+	xc := xray.NewXrayConfig()
+	inb, err := xc.EnsureInboundProtocol("vless", "reality-in", "0.0.0.0", 8443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inb.SecurityRealityAutoShortIDs("example.com").TransportXHTTPAutoParams("/xhttp", "auto")
+	xl := inb.EnsureClientReturnClientLink("bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb", "xtls-rprx-vision", "bob")
+	if len(inb.ClientIDs()) != 1 {
+		t.Fatalf("expected the client added, got %v", inb.ClientIDs())
+	}
+	p := xl.Parameters
+	if p.Security != "reality" || p.SNI != "example.com" || p.PublicKey == "" || len(p.ShortID) != 8 ||
+		p.Type != "xhttp" || p.Path != "/xhttp" || p.Mode != "auto" || p.Flow != "xtls-rprx-vision" {
+		t.Fatalf("unexpected link parameters %+v", p)
+	}
+}
+
+func TestXrayConfigAPI(t *testing.T) {
+	xc := xray.NewXrayConfig()
+	xc.EnsureRoutingRule("vless-in", "direct", "")
+	xc.EnableAPI("127.0.0.1", 10085, xray.StatsServiceName)
+	xc.EnableAPI("127.0.0.1", 10085, xray.StatsServiceName)
+	xc.EnableStats()
+	if len(xc.API.Services) != 1 {
+		t.Fatalf("services should not repeat: %v", xc.API.Services)
+	}
+	if len(xc.Routing.Rules) != 2 || xc.Routing.Rules[0].OutboundTag != xray.APIInboundTag {
+		t.Fatalf("api routing rule should come first")
+	}
+	jsn := string(xc.Marshal())
+	fmt.Println(jsn)
+	for _, expected := range []string{`"statsUserUplink": true`, `"protocol": "dokodemo-door"`, `"stats": {}`} {
+		if !strings.Contains(jsn, expected) {
+			t.Fatalf("config is missing %s", expected)
+		}
+	}
+}
+
+func TestParseStatName(t *testing.T) {
+	kind, tag, direction, ok := xray.ParseStatName("user>>>bob>>>traffic>>>downlink")
+	if !ok || kind != "user" || tag != "bob" || direction != "downlink" {
+		t.Fatalf("unexpected parse result %s %s %s", kind, tag, direction)
+	}
+	if _, _, _, ok := xray.ParseStatName("user>>>bob>>>online"); ok {
+		t.Fatalf("non traffic stats should not parse")
+	}
+}
+
+func cloneXrayConfig(t *testing.T, xc *xray.XrayConfig) *xray.XrayConfig {
+	t.Helper()
+	clone := xray.NewXrayConfig()
+	if err := json.Unmarshal(xc.Marshal(), clone); err != nil {
+		t.Fatal(err)
+	}
+	return clone
+}
+
+func TestDiffClients(t *testing.T) {
+	old := xray.NewXrayConfig()
+	inb, _ := old.EnsureInboundProtocol("vless", "vless-in", "0.0.0.0", 443)
+	inb.EnsureClient("id-bob", "xtls-rprx-vision", "bob")
+	inb.EnsureClient("id-alice", "", "alice")
+
+	updated := cloneXrayConfig(t, old)
+	inb, _ = updated.Inbound("vless-in")
+	inb.RemoveClient("id-alice")
+	inb.EnsureClient("id-carol", "", "carol")
+	changes, structural := xray.DiffClients(old, updated)
+	if structural {
+		t.Fatal("client list changes should not be structural")
+	}
+	if len(changes) != 2 ||
+		!changes[0].Remove || changes[0].Email != "alice" ||
+		changes[1].Remove || changes[1].ID != "id-carol" || changes[1].Protocol != "vless" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	inb.TransportGRPC("svc")
+	if _, structural := xray.DiffClients(old, updated); !structural {
+		t.Fatal("transport changes should be structural")
+	}
+}
+
+// HandlerService stand-in recording every AlterInbound request
+func startRecordingHandlerServer(t *testing.T) (*xray.XrayAPIClient, *[]*xray.AlterInboundRequest) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := &[]*xray.AlterInboundRequest{}
+	server := grpc.NewServer(grpc.ForceServerCodec(xray.APICodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: xray.HandlerServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "AlterInbound",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				req := &xray.AlterInboundRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				*calls = append(*calls, req)
+				return &xray.AlterInboundResponse{}, nil
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	client, err := xray.NewXrayAPIClient(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, calls
+}
+
+func TestXrayAPIClientAlterInbound(t *testing.T) {
+	client, calls := startRecordingHandlerServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.AddInboundUser(ctx, "vless-in", "vless", "id-bob", "xtls-rprx-vision", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveInboundUser(ctx, "vless-in", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddInboundUser(ctx, "socks-in", "socks", "id", "", "bob"); err == nil {
+		t.Fatal("socks users can't be added through the api")
+	}
+
+	if len(*calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(*calls))
+	}
+	add := (*calls)[0]
+	if add.Tag != "vless-in" || add.Operation.Type != "xray.app.proxyman.command.AddUserOperation" {
+		t.Fatalf("unexpected add request %+v", add)
+	}
+	op := &xray.AddUserOperation{}
+	if err := op.UnmarshalProto(add.Operation.Value); err != nil {
+		t.Fatal(err)
+	}
+	if op.User.Email != "bob" || op.User.Account.Type != "xray.proxy.vless.Account" {
+		t.Fatalf("unexpected user %+v", op.User)
+	}
+	num, _, tagLen := protowire.ConsumeTag(op.User.Account.Value)
+	id, n := protowire.ConsumeString(op.User.Account.Value[tagLen:])
+	if num != 1 || n < 0 || id != "id-bob" {
+		t.Fatalf("unexpected account id %q", id)
+	}
+	remove := &xray.RemoveUserOperation{}
+	if err := remove.UnmarshalProto((*calls)[1].Operation.Value); err != nil {
+		t.Fatal(err)
+	}
+	if remove.Email != "bob" {
+		t.Fatalf("unexpected remove email %q", remove.Email)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func exportTestLinks() []*xray.XrayLink {
+	reality := xray.NewXrayLink("vless", "bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb", "203.0.113.7", 443, "bob")
+	reality.Parameters.Security = "reality"
+	reality.Parameters.SNI = "www.example.com"
+	reality.Parameters.Fingerprint = "chrome"
+	reality.Parameters.PublicKey = "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw"
+	reality.Parameters.ShortID = "b0b01d"
+	reality.Parameters.Type = "tcp"
+	reality.Parameters.Flow = "xtls-rprx-vision"
+
+	xhttp := xray.NewXrayLink("vless", "bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb", "example.com", 443, "bob")
+	xhttp.Parameters.Security = "tls"
+	xhttp.Parameters.SNI = "example.com"
+	xhttp.Parameters.Fingerprint = "chrome"
+	xhttp.Parameters.Type = "xhttp"
+	xhttp.Parameters.Path = "/secondsbeforedawn"
+	xhttp.Parameters.Host = "example.com"
+	xhttp.Parameters.Mode = "packet-up"
+	xhttp.Parameters.Extra = (&xray.XHTTPExtra{XPaddingBytes: "100-1000"}).Marshal()
+
+	ws := xray.NewXrayLink("vless", "bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb", "example.com", 8443, "bob-ws")
+	ws.Parameters.Security = "tls"
+	ws.Parameters.SNI = "example.com"
+	ws.Parameters.Fingerprint = "chrome"
+	ws.Parameters.Type = "ws"
+	ws.Parameters.Path = "/ws"
+	ws.Parameters.Host = "example.com"
+
+	grpc := xray.NewXrayLink("vmess", "aa1aa1aa-aaaa-aaaa-aaaa-aa1aaaaaa1aa", "example.com", 443, "bob-grpc")
+	grpc.Parameters.Security = "tls"
+	grpc.Parameters.SNI = "example.com"
+	grpc.Parameters.Type = "grpc"
+	grpc.Parameters.ServiceName = "svc"
+	return []*xray.XrayLink{reality, xhttp, ws, grpc}
+}
+
+func TestExportGolden(t *testing.T) {
+	exporters := map[string]func([]*xray.XrayLink) ([]byte, error){
+		"export.singbox.json":     xray.ExportSingBox,
+		"export.clash.yaml":       xray.ExportClash,
+		"export.xray-client.json": xray.ExportXrayClient,
+	}
+	for golden, export := range exporters {
+		got, err := export(exportTestLinks())
+		if err != nil {
+			t.Fatalf("%s: %s", golden, err)
+		}
+		path := filepath.Join("testdata", golden)
+		if *updateGolden {
+			if err := os.WriteFile(path, got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s differs from the golden file, rerun with -update if intended:\n%s", golden, got)
+		}
+	}
+}
+
+func TestExportClashXHTTPExtra(t *testing.T) {
+	xhttp := exportTestLinks()[1]
+	xhttp.Parameters.Extra = `{"xPaddingBytes":"100-1000","noSSEHeader":true}`
+	if _, err := xray.ExportClash([]*xray.XrayLink{xhttp}); err == nil {
+		t.Fatal("extra settings mihomo has no equivalent for should not be dropped")
+	}
+}
+
+// random links for round-trip checks, hosts are drawn from valid forms only
+// and transports from the ones reflector serves, tcp links without a header
+// type are the type=none vmess links
+type randomLink struct {
+	*xray.XrayLink
+}
+
+func randomString(r *rand.Rand) string {
+	v, _ := quick.Value(reflect.TypeOf(""), r)
+	return v.String()
+}
+
+func (randomLink) Generate(r *rand.Rand, size int) reflect.Value {
+	hosts := []string{"example.com", "203.0.113.7", "2001:db8::1", "sub.domain-with-dash.example"}
+	xl := xray.NewXrayLink(
+		[]string{"vless", "vmess"}[r.Intn(2)],
+		"u"+randomString(r),
+		hosts[r.Intn(len(hosts))],
+		1+r.Intn(65535),
+		randomString(r),
+	)
+	params := reflect.ValueOf(&xl.Parameters).Elem()
+	for i := 0; i < params.NumField(); i++ {
+		if r.Intn(2) == 0 {
+			params.Field(i).SetString(randomString(r))
+		}
+	}
+	transports := []string{"", "tcp", "ws", "grpc", "httpupgrade", "xhttp"}
+	xl.Parameters.Type = transports[r.Intn(len(transports))]
+	// vmess grpc links carry the service name in path
+	if xl.Protocol == "vmess" && xl.Parameters.Type == "grpc" {
+		xl.Parameters.Path = ""
+	}
+	return reflect.ValueOf(randomLink{xl})
+}
+
+func TestXrayLinkRoundTrip(t *testing.T) {
+	roundTrip := func(rl randomLink) bool {
+		parsed, err := xray.ParseXrayLink(rl.MarshalLink())
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return reflect.DeepEqual(parsed, rl.XrayLink)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseXrayLink(t *testing.T) {
+	xl, err := xray.ParseXrayLink("vless://id@[2001:db8::1]:443?security=reality&pbk=key&sid=b0b01d&alpn=h2%2Chttp%2F1.1&spx=%2F&flow=xtls-rprx-vision#bob%20phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xl.Host != "2001:db8::1" || xl.Port != 443 || xl.LinkName != "bob phone" ||
+		xl.Parameters.ALPN != "h2,http/1.1" || xl.Parameters.SpiderX != "/" || xl.Parameters.PublicKey != "key" {
+		t.Fatalf("unexpected link %+v", xl)
+	}
+	for _, invalid := range []string{
+		"trojan://id@example.com:443",
+		"vless://example.com:443",
+		"vless://id@example.com",
+		// no id
+		"vmess://eyJhZGQiOiJleGFtcGxlLmNvbSJ9",
+		"vmess://not base64",
+	} {
+		if _, err := xray.ParseXrayLink(invalid); err == nil {
+			t.Errorf("expected %s to fail", invalid)
+		}
+	}
+}
+
+func TestParseVmessLink(t *testing.T) {
+	// as v2rayN writes them, numbers as strings
+	encoded := base64.StdEncoding.EncodeToString([]byte(`{"v":"2","ps":"bob","add":"example.com","port":"443",` +
+		`"id":"bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb","aid":"0","scy":"auto","net":"grpc","type":"none",` +
+		`"host":"","path":"svc","tls":"tls","sni":"example.com"}`))
+	xl, err := xray.ParseXrayLink("vmess://" + encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xl.Protocol != "vmess" || xl.Host != "example.com" || xl.Port != 443 || xl.LinkName != "bob" ||
+		xl.Parameters.Type != "grpc" || xl.Parameters.ServiceName != "svc" || xl.Parameters.Path != "" ||
+		xl.Parameters.Mode != "" || xl.Parameters.Security != "tls" {
+		t.Fatalf("unexpected link %+v", xl)
+	}
+	link := xl.MarshalLink()
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(link, "vmess://"))
+	if err != nil {
+		t.Fatalf("vmess links should be base64 json: %s", link)
+	}
+	for _, expected := range []string{`"v":"2"`, `"add":"example.com"`, `"net":"grpc"`, `"path":"svc"`} {
+		if !strings.Contains(string(decoded), expected) {
+			t.Fatalf("vmess link is missing %s: %s", expected, decoded)
+		}
+	}
+}
+
+func TestXrayConfigOutboundChain(t *testing.T) {
+	xc := xray.NewXrayConfig()
+	xc.EnsureOutbound("upstream").Upstream("socks", "10.0.0.1", 1080, "bob", "secret")
+	xl, err := xray.ParseXrayLink("vless://bb3bb3bb-bbbb-bbbb-bbbb-bb3bbbbbb3bb@example.com:443?security=tls&sni=example.com&type=tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained, err := xc.EnsureOutbound("exit").Link(xl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained.Via("upstream")
+	xc.EnsureRoutingRule("lan-socks", "exit", "")
+	jsn := string(xc.Marshal())
+	for _, expected := range []string{
+		`"protocol": "socks"`, `"address": "10.0.0.1"`, `"pass": "secret"`,
+		`"protocol": "vless"`, `"proxySettings": {`, `"tag": "upstream"`, `"outboundTag": "exit"`,
+	} {
+		if !strings.Contains(jsn, expected) {
+			t.Fatalf("config is missing %s: %s", expected, jsn)
+		}
+	}
+}
@@ -5,21 +5,22 @@ import (
 	"fmt"
 	"os"
 	"reflector/utils"
+	"slices"
 	"strings"
 )
 
 type XrayConfig struct {
-	Log xrayConfigLog `json:"log,omitempty"`
-	//  API              any                `json:"api,omitempty"`
+	Log xrayConfigLog  `json:"log,omitempty"`
+	API *xrayConfigAPI `json:"api,omitempty"`
 	//  DNS              any                `json:"dns,omitempty"`
-	Routing xrayConfigRouting `json:"routing,omitempty"`
-	//  Policy    any                 `json:"policy,omitempty"`
+	Routing        xrayConfigRouting    `json:"routing,omitempty"`
+	Policy         *xrayConfigPolicy    `json:"policy,omitempty"`
 	Inbounds       []*xrayConfigInbound `json:"inbounds,omitempty"`
 	inboundsByTag  map[string]*xrayConfigInbound
 	Outbounds      []*xrayConfigOutbound `json:"outbounds,omitempty"`
 	outboundsByTag map[string]*xrayConfigOutbound
 	// Transport        any                `json:"transport,omitempty"`
-	// Stats            any                `json:"stats,omitempty"`
+	Stats *xrayConfigStats `json:"stats,omitempty"`
 	// Reverse          any                `json:"reverse,omitempty"`
 	// FakeDNS          any                `json:"fakedns,omitempty"`
 	// Metrics          any                `json:"metrics,omitempty"`
@@ -51,7 +52,7 @@ func (xc *XrayConfig) UnmarshalJSON(b []byte) error {
 		xc.outboundsByTag[ob.Tag] = ob
 	}
 	for _, rr := range xc.Routing.Rules {
-		xc.Routing.rulesByHash[routingRuleHashString(rr.InboundTag, rr.OutboundTag, rr.Port)] = rr
+		xc.Routing.rulesByHash[routingRuleHashString(strings.Join(rr.InboundTag, ","), rr.OutboundTag, rr.Port)] = rr
 	}
 	return nil
 }
@@ -69,22 +70,43 @@ func (xc *XrayConfig) EnsureInbound(tag string) *xrayConfigInbound {
 	return inb
 }
 
-func (xc *XrayConfig) EnsureInboundVless(
+// Inbound creation by reflector inbound type, errors on unknown types
+func (xc *XrayConfig) EnsureInboundProtocol(
+	protocol string,
 	tag string,
 	listen string,
 	port int,
+) (*xrayConfigInbound, error) {
+	switch protocol {
+	case "vless":
+		return xc.EnsureInboundVless(tag, listen, port), nil
+	case "vmess":
+		return xc.EnsureInboundVmess(tag, listen, port), nil
+	case "socks":
+		return xc.EnsureInboundSocks(tag, listen, port), nil
+	case "http":
+		return xc.EnsureInboundHTTP(tag, listen, port), nil
+	default:
+		return nil, fmt.Errorf("unsupported inbound protocol: %s", protocol)
+	}
+}
+
+func (xc *XrayConfig) ensureInboundWithProtocol(
+	tag string,
+	protocol string,
+	listen string,
+	port int,
 ) *xrayConfigInbound {
 	inb := xc.EnsureInbound(tag)
 	inb.Listen = listen
 	inb.Port = port
-	inb.Protocol = "vless"
-	if inb.Settings.Clients == nil {
-		inb.Settings.Clients = []*xrayConfigInboundSettingsClient{}
-	}
+	inb.Protocol = protocol
 	if inb.Settings.clientsById == nil {
 		inb.Settings.clientsById = make(map[string]*xrayConfigInboundSettingsClient)
 	}
-	inb.Settings.Decryption = "none"
+	if inb.Settings.accountsByUser == nil {
+		inb.Settings.accountsByUser = make(map[string]*xrayConfigInboundSettingsAccount)
+	}
 
 	inb.Sniffing.Enabled = true
 	inb.Sniffing.DestOverride = []string{
@@ -95,6 +117,67 @@ func (xc *XrayConfig) EnsureInboundVless(
 	return inb
 }
 
+func (xc *XrayConfig) RemoveInbound(tag string) {
+	inb, exists := xc.inboundsByTag[tag]
+	if !exists {
+		return
+	}
+	delete(xc.inboundsByTag, tag)
+	xc.Inbounds = slices.DeleteFunc(xc.Inbounds, func(i *xrayConfigInbound) bool { return i == inb })
+}
+
+func (xc *XrayConfig) Inbound(tag string) (*xrayConfigInbound, bool) {
+	inb, exists := xc.inboundsByTag[tag]
+	return inb, exists
+}
+
+func (xc *XrayConfig) EnsureInboundVless(
+	tag string,
+	listen string,
+	port int,
+) *xrayConfigInbound {
+	inb := xc.ensureInboundWithProtocol(tag, "vless", listen, port)
+	if inb.Settings.Clients == nil {
+		inb.Settings.Clients = []*xrayConfigInboundSettingsClient{}
+	}
+	inb.Settings.Decryption = "none"
+	return inb
+}
+
+func (xc *XrayConfig) EnsureInboundVmess(
+	tag string,
+	listen string,
+	port int,
+) *xrayConfigInbound {
+	inb := xc.ensureInboundWithProtocol(tag, "vmess", listen, port)
+	if inb.Settings.Clients == nil {
+		inb.Settings.Clients = []*xrayConfigInboundSettingsClient{}
+	}
+	return inb
+}
+
+// socks inbound, auth switches to password as soon as an account is added
+func (xc *XrayConfig) EnsureInboundSocks(
+	tag string,
+	listen string,
+	port int,
+) *xrayConfigInbound {
+	inb := xc.ensureInboundWithProtocol(tag, "socks", listen, port)
+	if len(inb.Settings.Accounts) == 0 {
+		inb.Settings.Auth = "noauth"
+	}
+	inb.Settings.UDP = true
+	return inb
+}
+
+func (xc *XrayConfig) EnsureInboundHTTP(
+	tag string,
+	listen string,
+	port int,
+) *xrayConfigInbound {
+	return xc.ensureInboundWithProtocol(tag, "http", listen, port)
+}
+
 func (inb *xrayConfigInbound) SecurityRealityAutoShortIDs(sni string) *xrayConfigInbound {
 	shortIDs := inb.StreamSettings.RealitySettings.ShortIds
 	if len(inb.StreamSettings.RealitySettings.ShortIds) == 0 {
@@ -122,6 +205,18 @@ func (inb *xrayConfigInbound) SecurityReality(sni string, shortIDs []string) *xr
 	return inb
 }
 
+// dest host:port and the server names clients may use, SecurityReality
+// defaults them to the sni
+func (inb *xrayConfigInbound) RealityDest(dest string, serverNames []string) *xrayConfigInbound {
+	if dest != "" {
+		inb.StreamSettings.RealitySettings.Dest = dest
+	}
+	if len(serverNames) > 0 {
+		inb.StreamSettings.RealitySettings.ServerNames = serverNames
+	}
+	return inb
+}
+
 func (inb *xrayConfigInbound) SecurityNone() *xrayConfigInbound {
 	inb.StreamSettings.Security = "none"
 	return inb
@@ -173,6 +268,26 @@ func (inb *xrayConfigInbound) TransportTCP() *xrayConfigInbound {
 	return inb
 }
 
+func (inb *xrayConfigInbound) TransportWS(path string, host string) *xrayConfigInbound {
+	inb.StreamSettings.Network = "ws"
+	inb.StreamSettings.WSSettings.Path = path
+	inb.StreamSettings.WSSettings.Host = host
+	return inb
+}
+
+func (inb *xrayConfigInbound) TransportHTTPUpgrade(path string, host string) *xrayConfigInbound {
+	inb.StreamSettings.Network = "httpupgrade"
+	inb.StreamSettings.HTTPUpgradeSettings.Path = path
+	inb.StreamSettings.HTTPUpgradeSettings.Host = host
+	return inb
+}
+
+func (inb *xrayConfigInbound) TransportGRPC(serviceName string) *xrayConfigInbound {
+	inb.StreamSettings.Network = "grpc"
+	inb.StreamSettings.GRPCSettings.ServiceName = serviceName
+	return inb
+}
+
 func (xc *XrayConfig) EnsureOutbound(tag string) *xrayConfigOutbound {
 	ob, exists := xc.outboundsByTag[tag]
 	if !exists {
@@ -205,7 +320,7 @@ func (xc *XrayConfig) EnsureRoutingRule(
 	}
 	newrr := &xrayConfigRoutingRule{
 		Type:        "field",
-		InboundTag:  inboundTag,
+		InboundTag:  []string{inboundTag},
 		OutboundTag: outboundTag,
 		Port:        port,
 	}
@@ -214,6 +329,74 @@ func (xc *XrayConfig) EnsureRoutingRule(
 	return newrr
 }
 
+// Loopback gRPC API inbound, services can be added with repeated calls
+func (xc *XrayConfig) EnableAPI(listen string, port int, services ...string) *xrayConfigInbound {
+	if xc.API == nil {
+		xc.API = &xrayConfigAPI{Tag: APIInboundTag}
+	}
+	for _, service := range services {
+		if !slices.Contains(xc.API.Services, service) {
+			xc.API.Services = append(xc.API.Services, service)
+		}
+	}
+	inb := xc.EnsureInbound(APIInboundTag)
+	inb.Listen = listen
+	inb.Port = port
+	inb.Protocol = "dokodemo-door"
+	inb.Settings.Address = listen
+
+	// api traffic has to be routed before anything else
+	if _, exists := xc.Routing.rulesByHash[routingRuleHashString(APIInboundTag, APIInboundTag, "")]; !exists {
+		rr := xc.EnsureRoutingRule(APIInboundTag, APIInboundTag, "")
+		xc.Routing.Rules = append([]*xrayConfigRoutingRule{rr}, xc.Routing.Rules[:len(xc.Routing.Rules)-1]...)
+	}
+	return inb
+}
+
+// Traffic counters for users (by email), inbounds and outbounds
+func (xc *XrayConfig) EnableStats() {
+	xc.Stats = &xrayConfigStats{}
+	if xc.Policy == nil {
+		xc.Policy = &xrayConfigPolicy{}
+	}
+	if xc.Policy.Levels == nil {
+		xc.Policy.Levels = map[string]*xrayConfigPolicyLevel{}
+	}
+	if _, exists := xc.Policy.Levels["0"]; !exists {
+		xc.Policy.Levels["0"] = &xrayConfigPolicyLevel{}
+	}
+	xc.Policy.Levels["0"].StatsUserUplink = true
+	xc.Policy.Levels["0"].StatsUserDownlink = true
+	xc.Policy.System.StatsInboundUplink = true
+	xc.Policy.System.StatsInboundDownlink = true
+	xc.Policy.System.StatsOutboundUplink = true
+	xc.Policy.System.StatsOutboundDownlink = true
+}
+
+type xrayConfigAPI struct {
+	Tag      string   `json:"tag,omitempty"`
+	Services []string `json:"services,omitempty"`
+}
+
+type xrayConfigStats struct{}
+
+type xrayConfigPolicy struct {
+	Levels map[string]*xrayConfigPolicyLevel `json:"levels,omitempty"`
+	System xrayConfigPolicySystem            `json:"system,omitempty"`
+}
+
+type xrayConfigPolicyLevel struct {
+	StatsUserUplink   bool `json:"statsUserUplink,omitempty"`
+	StatsUserDownlink bool `json:"statsUserDownlink,omitempty"`
+}
+
+type xrayConfigPolicySystem struct {
+	StatsInboundUplink    bool `json:"statsInboundUplink,omitempty"`
+	StatsInboundDownlink  bool `json:"statsInboundDownlink,omitempty"`
+	StatsOutboundUplink   bool `json:"statsOutboundUplink,omitempty"`
+	StatsOutboundDownlink bool `json:"statsOutboundDownlink,omitempty"`
+}
+
 type xrayConfigLog struct {
 	Access   string `json:"access,omitempty"`
 	Loglevel string `json:"loglevel,omitempty"`
@@ -229,7 +412,7 @@ type xrayConfigRouting struct {
 type xrayConfigRoutingRule struct {
 	Type        string   `json:"type,omitempty"`
 	OutboundTag string   `json:"outboundTag,omitempty"`
-	InboundTag  string   `json:"inboundTag,omitempty"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
 	Protocol    []string `json:"protocol,omitempty"`
 	IP          []string `json:"ip,omitempty"`
 	Port        string   `json:"port,omitempty"`
@@ -249,6 +432,75 @@ type xrayConfigInbound struct {
 	StreamSettings xrayConfigInboundStreamSettings `json:"streamSettings,omitempty"`
 }
 
+// Add or update a vless/vmess client, flow is vless only and dropped otherwise
+func (xi *xrayConfigInbound) EnsureClient(
+	id string,
+	flow string,
+	email string,
+) *xrayConfigInbound {
+	if xi.Protocol != "vless" {
+		flow = ""
+	}
+	newc := &xrayConfigInboundSettingsClient{
+		ID:    id,
+		Flow:  flow,
+		Email: email,
+	}
+	c, exists := xi.Settings.clientsById[id]
+	if !exists {
+		xi.Settings.clientsById[id] = newc
+		xi.Settings.Clients = append(xi.Settings.Clients, newc)
+	} else {
+		*c = *newc
+	}
+	return xi
+}
+
+// Returns whether the client existed
+func (xi *xrayConfigInbound) RemoveClient(id string) bool {
+	if _, exists := xi.Settings.clientsById[id]; !exists {
+		return false
+	}
+	delete(xi.Settings.clientsById, id)
+	xi.Settings.Clients = slices.DeleteFunc(xi.Settings.Clients, func(c *xrayConfigInboundSettingsClient) bool {
+		return c.ID == id
+	})
+	return true
+}
+
+func (xi *xrayConfigInbound) ClientIDs() []string {
+	ids := []string{}
+	for _, c := range xi.Settings.Clients {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// Add or update a socks/http account
+func (xi *xrayConfigInbound) EnsureAccount(
+	user string,
+	pass string,
+) *xrayConfigInbound {
+	newa := &xrayConfigInboundSettingsAccount{
+		User: user,
+		Pass: pass,
+	}
+	a, exists := xi.Settings.accountsByUser[user]
+	if !exists {
+		xi.Settings.accountsByUser[user] = newa
+		xi.Settings.Accounts = append(xi.Settings.Accounts, newa)
+	} else {
+		*a = *newa
+	}
+	if xi.Protocol == "socks" {
+		xi.Settings.Auth = "password"
+	}
+	return xi
+}
+
+// Adds the client to a reality inbound and returns its link, the host is
+// left for the caller to set since the inbound doesn't know its public name.
+// reflector builds links from the config instead, see 'reflector user link'.
 func (xi *xrayConfigInbound) EnsureClientReturnClientLink(
 	id string,
 	flow string,
@@ -272,32 +524,45 @@ func (xi *xrayConfigInbound) EnsureClientReturnClientLink(
 	xl.Parameters.Security = xi.StreamSettings.Security
 	xl.Parameters.ShortID = xi.StreamSettings.RealitySettings.ShortIds[0]
 	xl.Parameters.Type = xi.StreamSettings.Network
-
-	newc := &xrayConfigInboundSettingsClient{
-		ID:    id,
-		Flow:  flow,
-		Email: email,
+	if xi.Protocol == "vless" {
+		xl.Parameters.Flow = flow
 	}
-	c, exists := xi.Settings.clientsById[id]
-	if !exists {
-		xi.Settings.clientsById[id] = newc
-		xi.Settings.Clients = append(xi.Settings.Clients, newc)
-	} else {
-		*c = *newc
+	switch xi.StreamSettings.Network {
+	case "xhttp":
+		xl.Parameters.Path = xi.StreamSettings.XHTTPSettings.Path
+		xl.Parameters.Mode = xi.StreamSettings.XHTTPSettings.Mode
+		xl.Parameters.Host = xi.StreamSettings.XHTTPSettings.Host
+	case "ws":
+		xl.Parameters.Path = xi.StreamSettings.WSSettings.Path
+		xl.Parameters.Host = xi.StreamSettings.WSSettings.Host
+	case "httpupgrade":
+		xl.Parameters.Path = xi.StreamSettings.HTTPUpgradeSettings.Path
+		xl.Parameters.Host = xi.StreamSettings.HTTPUpgradeSettings.Host
+	case "grpc":
+		xl.Parameters.ServiceName = xi.StreamSettings.GRPCSettings.ServiceName
 	}
+
+	xi.EnsureClient(id, flow, email)
 	return xl
 }
 
 type xrayConfigInboundSettings struct {
-	Clients     []*xrayConfigInboundSettingsClient `json:"clients,omitempty"`
-	clientsById map[string]*xrayConfigInboundSettingsClient
-	Decryption  string `json:"decryption,omitempty"`
+	Clients        []*xrayConfigInboundSettingsClient `json:"clients,omitempty"`
+	clientsById    map[string]*xrayConfigInboundSettingsClient
+	Decryption     string                              `json:"decryption,omitempty"`
+	Auth           string                              `json:"auth,omitempty"`
+	Accounts       []*xrayConfigInboundSettingsAccount `json:"accounts,omitempty"`
+	accountsByUser map[string]*xrayConfigInboundSettingsAccount
+	UDP            bool `json:"udp,omitempty"`
+	// dokodemo-door
+	Address string `json:"address,omitempty"`
 }
 
 func (xs *xrayConfigInboundSettings) UnmarshalJSON(b []byte) error {
 	type aliasXrayConfigInboundSettings xrayConfigInboundSettings
 	newxcs := &aliasXrayConfigInboundSettings{}
 	newxcs.clientsById = make(map[string]*xrayConfigInboundSettingsClient)
+	newxcs.accountsByUser = make(map[string]*xrayConfigInboundSettingsAccount)
 	err := json.Unmarshal(b, newxcs)
 	if err != nil {
 		return err
@@ -306,6 +571,9 @@ func (xs *xrayConfigInboundSettings) UnmarshalJSON(b []byte) error {
 	for _, cli := range xs.Clients {
 		xs.clientsById[cli.ID] = cli
 	}
+	for _, acc := range xs.Accounts {
+		xs.accountsByUser[acc.User] = acc
+	}
 	return nil
 }
 
@@ -315,16 +583,24 @@ type xrayConfigInboundSettingsClient struct {
 	Flow  string `json:"flow,omitempty"`
 }
 
+type xrayConfigInboundSettingsAccount struct {
+	User string `json:"user,omitempty"`
+	Pass string `json:"pass,omitempty"`
+}
+
 type xrayConfigInboundSniffing struct {
 	DestOverride []string `json:"destOverride,omitempty"`
 	Enabled      bool     `json:"enabled,omitempty"`
 }
 
 type xrayConfigInboundStreamSettings struct {
-	Network         string                                         `json:"network,omitempty"`
-	Security        string                                         `json:"security,omitempty"`
-	XHTTPSettings   xrayConfigInboundStreamSettingsXHTTPSettings   `json:"xhttpSettings,omitempty"`
-	RealitySettings xrayConfigInboundStreamSettingsRealitySettings `json:"realitySettings,omitempty"`
+	Network             string                                             `json:"network,omitempty"`
+	Security            string                                             `json:"security,omitempty"`
+	XHTTPSettings       xrayConfigInboundStreamSettingsXHTTPSettings       `json:"xhttpSettings,omitempty"`
+	WSSettings          xrayConfigInboundStreamSettingsWSSettings          `json:"wsSettings,omitempty"`
+	HTTPUpgradeSettings xrayConfigInboundStreamSettingsHTTPUpgradeSettings `json:"httpupgradeSettings,omitempty"`
+	GRPCSettings        xrayConfigInboundStreamSettingsGRPCSettings        `json:"grpcSettings,omitempty"`
+	RealitySettings     xrayConfigInboundStreamSettingsRealitySettings     `json:"realitySettings,omitempty"`
 }
 
 type xrayConfigInboundStreamSettingsRealitySettings struct {
@@ -355,19 +631,100 @@ func (xs *xrayConfigInboundStreamSettingsRealitySettings) UnmarshalJSON(b []byte
 type xrayConfigInboundStreamSettingsXHTTPSettings struct {
 	Mode                 string `json:"mode,omitempty"`
 	Path                 string `json:"path,omitempty"`
+	Host                 string `json:"host,omitempty"`
+	NoSSEHeader          bool   `json:"noSSEHeader,omitempty"`
 	SCMaxBufferedPosts   int    `json:"scMaxBufferedPosts,omitempty"`
 	SCMaxEachPostBytes   string `json:"scMaxEachPostBytes,omitempty"`
 	SCStreamUpServerSecs string `json:"scStreamUpServerSecs,omitempty"`
 	XPaddingBytes        string `json:"xPaddingBytes,omitempty"`
 }
 
+type xrayConfigInboundStreamSettingsWSSettings struct {
+	Path string `json:"path,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+type xrayConfigInboundStreamSettingsHTTPUpgradeSettings struct {
+	Path string `json:"path,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+type xrayConfigInboundStreamSettingsGRPCSettings struct {
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
 // END Inbound
 
 // BEGIN Outbound
 
 type xrayConfigOutbound struct {
-	Tag      string `json:"tag,omitempty"`
-	Protocol string `json:"protocol,omitempty"`
+	Tag            string                           `json:"tag,omitempty"`
+	Protocol       string                           `json:"protocol,omitempty"`
+	Settings       any                              `json:"settings,omitempty"`
+	StreamSettings *xrayClientStreamSettings        `json:"streamSettings,omitempty"`
+	ProxySettings  *xrayConfigOutboundProxySettings `json:"proxySettings,omitempty"`
+}
+
+type xrayConfigOutboundServers struct {
+	Servers []xrayConfigOutboundServer `json:"servers"`
+}
+
+type xrayConfigOutboundServer struct {
+	Address string                         `json:"address"`
+	Port    int                            `json:"port"`
+	Users   []xrayConfigOutboundServerUser `json:"users,omitempty"`
+}
+
+type xrayConfigOutboundServerUser struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// the outbound dials through the one with tag, proxies are chained this way
+type xrayConfigOutboundProxySettings struct {
+	Tag string `json:"tag"`
+}
+
+func (ob *xrayConfigOutbound) Direct() *xrayConfigOutbound {
+	ob.Protocol = "freedom"
+	return ob
+}
+
+// drops everything, broken outbounds fail closed instead of leaking traffic
+func (ob *xrayConfigOutbound) Blackhole() *xrayConfigOutbound {
+	ob.Protocol = "blackhole"
+	ob.Settings = nil
+	ob.StreamSettings = nil
+	ob.ProxySettings = nil
+	return ob
+}
+
+// socks or http upstream proxy, user and password are optional
+func (ob *xrayConfigOutbound) Upstream(protocol string, address string, port int, user string, password string) *xrayConfigOutbound {
+	ob.Protocol = protocol
+	server := xrayConfigOutboundServer{Address: address, Port: port}
+	if user != "" || password != "" {
+		server.Users = []xrayConfigOutboundServerUser{{User: user, Pass: password}}
+	}
+	ob.Settings = &xrayConfigOutboundServers{Servers: []xrayConfigOutboundServer{server}}
+	return ob
+}
+
+// vless or vmess server of a client link, e.g. another reflector
+func (ob *xrayConfigOutbound) Link(xl *XrayLink) (*xrayConfigOutbound, error) {
+	clientOutbound, err := xrayClientOutboundFromLink(xl, ob.Tag)
+	if err != nil {
+		return nil, err
+	}
+	ob.Protocol = clientOutbound.Protocol
+	ob.Settings = clientOutbound.Settings
+	ob.StreamSettings = clientOutbound.StreamSettings
+	return ob, nil
+}
+
+func (ob *xrayConfigOutbound) Via(tag string) *xrayConfigOutbound {
+	ob.ProxySettings = &xrayConfigOutboundProxySettings{Tag: tag}
+	return ob
 }
 
 // END Outbound
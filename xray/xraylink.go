@@ -1,10 +1,14 @@
 package xray
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -24,6 +28,45 @@ type xrayLinkParameters struct {
 	PublicKey   string `url:"pbk,omitempty"`
 	ShortID     string `url:"sid,omitempty"`
 	Type        string `url:"type,omitempty"`
+	Flow        string `url:"flow,omitempty"`
+	Path        string `url:"path,omitempty"`
+	Host        string `url:"host,omitempty"`
+	Mode        string `url:"mode,omitempty"`
+	ServiceName string `url:"serviceName,omitempty"`
+	// xhttp client settings that have no dedicated parameter, json encoded
+	Extra string `url:"extra,omitempty"`
+	// comma separated
+	ALPN string `url:"alpn,omitempty"`
+	// reality spiderX, the path the client starts crawling the fqdn from
+	SpiderX string `url:"spx,omitempty"`
+}
+
+// xhttp `extra` link parameter, client side only settings
+type XHTTPExtra struct {
+	Headers       map[string]string `json:"headers,omitempty"`
+	XPaddingBytes string            `json:"xPaddingBytes,omitempty"`
+	Xmux          *XHTTPXmux        `json:"xmux,omitempty"`
+}
+
+type XHTTPXmux struct {
+	MaxConcurrency   string `json:"maxConcurrency,omitempty"`
+	MaxConnections   string `json:"maxConnections,omitempty"`
+	CMaxReuseTimes   string `json:"cMaxReuseTimes,omitempty"`
+	HMaxRequestTimes string `json:"hMaxRequestTimes,omitempty"`
+	HMaxReusableSecs string `json:"hMaxReusableSecs,omitempty"`
+	HKeepAlivePeriod int    `json:"hKeepAlivePeriod,omitempty"`
+}
+
+// empty string when there is nothing to carry
+func (xe *XHTTPExtra) Marshal() string {
+	if len(xe.Headers) == 0 && xe.XPaddingBytes == "" && xe.Xmux == nil {
+		return ""
+	}
+	bytes, err := json.Marshal(xe)
+	if err != nil {
+		panic(err)
+	}
+	return string(bytes)
 }
 
 func NewXrayLink(protocol, user, host string, port int, linkname string) *XrayLink {
@@ -38,49 +81,215 @@ func NewXrayLink(protocol, user, host string, port int, linkname string) *XrayLi
 	return &newXL
 }
 
-func (xl *XrayLink) MarshalLink() string {
-	if xl.Host == "" || xl.Port == 0 {
-		panic(errors.New("tried marshaling an xray link without a host|port"))
-	}
-	u := &url.URL{
-		Scheme: xl.Protocol,
-		Host:   fmt.Sprintf("%s:%d", xl.Host, xl.Port),
+// url tag key of every parameter field, in declaration order
+func linkParameterKeys() []string {
+	typ := reflect.TypeOf(xrayLinkParameters{})
+	keys := []string{}
+	for i := 0; i < typ.NumField(); i++ {
+		key, _, _ := strings.Cut(typ.Field(i).Tag.Get("url"), ",")
+		if key == "" {
+			key = typ.Field(i).Name
+		}
+		keys = append(keys, key)
 	}
-	u.User = url.User(xl.User)
+	return keys
+}
 
+// query parameters of the link, empty parameters are left out
+func (xl *XrayLink) Values() url.Values {
 	v := url.Values{}
 	val := reflect.ValueOf(xl.Parameters)
-	typ := reflect.TypeOf(xl.Parameters)
-	for i := 0; i < val.NumField(); i++ {
+	for i, key := range linkParameterKeys() {
 		field := val.Field(i)
-		fieldType := typ.Field(i)
-		tag := fieldType.Tag.Get("url")
-		if tag == "" {
-			tag = fieldType.Name
+		if field.IsZero() {
+			continue
 		}
+		v.Set(key, fmt.Sprintf("%v", field.Interface()))
+	}
+	return v
+}
 
-		parts := strings.Split(tag, ",")
-		key := ""
-		omitEmpty := false
-		for _, part := range parts {
-			if part == "omitempty" {
-				omitEmpty = true
-			} else if key == "" {
-				key = part
-			}
-		}
+// vmess links are base64 encoded json, the format v2rayN and most clients
+// understand
+type vmessLink struct {
+	V    string      `json:"v"`
+	PS   string      `json:"ps"`
+	Add  string      `json:"add"`
+	Port vmessNumber `json:"port"`
+	ID   string      `json:"id"`
+	Aid  vmessNumber `json:"aid"`
+	Scy  string      `json:"scy,omitempty"`
+	Net  string      `json:"net"`
+	// header type for tcp, the mode for xhttp and grpc
+	Type string `json:"type"`
+	Host string `json:"host"`
+	// grpc links put the service name here
+	Path string `json:"path"`
+	TLS  string `json:"tls"`
+	SNI  string `json:"sni,omitempty"`
+	ALPN string `json:"alpn,omitempty"`
+	FP   string `json:"fp,omitempty"`
+	// not part of the format, clients ignore them
+	PBK         string `json:"pbk,omitempty"`
+	SID         string `json:"sid,omitempty"`
+	SPX         string `json:"spx,omitempty"`
+	Flow        string `json:"flow,omitempty"`
+	ServiceName string `json:"serviceName,omitempty"`
+	Extra       string `json:"extra,omitempty"`
+}
 
-		if key == "" {
-			key = fieldType.Name
-		}
+// clients write numbers either as json numbers or as strings
+type vmessNumber string
 
-		if omitEmpty && field.IsZero() {
-			continue
-		}
+func (n *vmessNumber) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*n = vmessNumber(number)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*n = vmessNumber(str)
+	return nil
+}
 
-		v.Set(key, fmt.Sprintf("%v", field.Interface()))
+func (xl *XrayLink) marshalVmessLink() string {
+	p := xl.Parameters
+	vl := vmessLink{
+		V:           "2",
+		PS:          xl.LinkName,
+		Add:         xl.Host,
+		Port:        vmessNumber(strconv.Itoa(xl.Port)),
+		ID:          xl.User,
+		Aid:         "0",
+		Scy:         "auto",
+		Net:         p.Type,
+		Type:        p.Mode,
+		Host:        p.Host,
+		Path:        p.Path,
+		TLS:         p.Security,
+		SNI:         p.SNI,
+		ALPN:        p.ALPN,
+		FP:          p.Fingerprint,
+		PBK:         p.PublicKey,
+		SID:         p.ShortID,
+		SPX:         p.SpiderX,
+		Flow:        p.Flow,
+		ServiceName: p.ServiceName,
+		Extra:       p.Extra,
+	}
+	if vl.Type == "" {
+		vl.Type = "none"
 	}
-	u.RawQuery = v.Encode()
+	if vl.Net == "grpc" && vl.Path == "" {
+		vl.Path = p.ServiceName
+	}
+	bytes, err := json.Marshal(vl)
+	if err != nil {
+		panic(err)
+	}
+	return "vmess://" + base64.StdEncoding.EncodeToString(bytes)
+}
+
+func parseVmessLink(encoded string) (*XrayLink, error) {
+	encoded = strings.TrimRight(encoded, "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		decoded, err = base64.RawURLEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, errors.New("vmess link is neither base64 json nor a vmess://id@host:port link")
+	}
+	vl := vmessLink{}
+	if err := json.Unmarshal(decoded, &vl); err != nil {
+		return nil, fmt.Errorf("invalid vmess link json: %w", err)
+	}
+	if vl.ID == "" {
+		return nil, errors.New("link has no user id")
+	}
+	if vl.Add == "" {
+		return nil, errors.New("link has no host")
+	}
+	port, err := strconv.Atoi(string(vl.Port))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", vl.Port)
+	}
+	xl := NewXrayLink("vmess", vl.ID, vl.Add, port, vl.PS)
+	xl.Parameters = xrayLinkParameters{
+		Security:    vl.TLS,
+		SNI:         vl.SNI,
+		Fingerprint: vl.FP,
+		PublicKey:   vl.PBK,
+		ShortID:     vl.SID,
+		Type:        vl.Net,
+		Flow:        vl.Flow,
+		Path:        vl.Path,
+		Host:        vl.Host,
+		Mode:        vl.Type,
+		ServiceName: vl.ServiceName,
+		Extra:       vl.Extra,
+		ALPN:        vl.ALPN,
+		SpiderX:     vl.SPX,
+	}
+	if xl.Parameters.Mode == "none" {
+		xl.Parameters.Mode = ""
+	}
+	if vl.Net == "grpc" && (vl.ServiceName == "" || vl.ServiceName == vl.Path) {
+		xl.Parameters.ServiceName = vl.Path
+		xl.Parameters.Path = ""
+	}
+	return xl, nil
+}
+
+// vless://id@host:port?params#name, vmess links are base64 encoded json
+func (xl *XrayLink) MarshalLink() string {
+	if xl.Host == "" || xl.Port == 0 {
+		panic(errors.New("tried marshaling an xray link without a host|port"))
+	}
+	if xl.Protocol == "vmess" {
+		return xl.marshalVmessLink()
+	}
+	u := &url.URL{
+		Scheme:   xl.Protocol,
+		Host:     net.JoinHostPort(xl.Host, strconv.Itoa(xl.Port)),
+		User:     url.User(xl.User),
+		RawQuery: xl.Values().Encode(),
+		Fragment: xl.LinkName,
+	}
+	return u.String()
+}
 
-	return u.String() + "#" + xl.LinkName
+// Share link in the vless:// format, vmess links in the base64 json format
+// or in the vless one
+func ParseXrayLink(link string) (*XrayLink, error) {
+	link = strings.TrimSpace(link)
+	if encoded, isVmess := strings.CutPrefix(link, "vmess://"); isVmess && !strings.Contains(encoded, "@") {
+		return parseVmessLink(encoded)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "vless" && u.Scheme != "vmess" {
+		return nil, fmt.Errorf("unsupported link scheme %q", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("link has no user id")
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", u.Port())
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("link has no host")
+	}
+	xl := NewXrayLink(u.Scheme, u.User.Username(), u.Hostname(), port, u.Fragment)
+	query := u.Query()
+	val := reflect.ValueOf(&xl.Parameters).Elem()
+	for i, key := range linkParameterKeys() {
+		val.Field(i).SetString(query.Get(key))
+	}
+	return xl, nil
 }